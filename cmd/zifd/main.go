@@ -1,22 +1,29 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 
 	"strings"
 
 	zif "github.com/zif/zif"
 	data "github.com/zif/zif/data"
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/proto"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func SetupLocalPeer(addr string, newAddr bool) *zif.LocalPeer {
+func SetupLocalPeer(addr string, newAddr bool, dataDir string, minDifficulty int, diversity dht.DiversityLimits) *zif.LocalPeer {
 	var lp zif.LocalPeer
+	lp.DataDir = dataDir
+	lp.MinDifficulty = minDifficulty
+	lp.Diversity = diversity
 
 	if !newAddr {
 		if lp.ReadKey() != nil {
@@ -40,23 +47,47 @@ func main() {
 	formatter.TimestampFormat = "15:04:05"
 	log.SetFormatter(formatter)
 
-	os.Mkdir("./data", 0777)
-
 	var addr = flag.String("address", "0.0.0.0:5050", "Bind address")
-	var db_path = flag.String("database", "./data/posts.db", "Posts database path")
+	var dataDir = flag.String("data", "./data", "Data directory")
+	var db_path = flag.String("database", "", "Posts database path, defaults to posts.db in the data directory")
 	var newAddr = flag.Bool("new", false, "Ignore identity file and create a new address")
 	var tor = flag.Bool("tor", false, "Start hidden service and proxy connections through tor")
 	var torPort = flag.Int("torPort", 10051, "Port for Tor control")
 	var socksPort = flag.Int("socksPort", 10050, "Port for SOCKS5 proxy")
 	var torpath = flag.String("torpath", "./tor/", "Path to the tor folder")
 
+	var maxConns = flag.Int("maxConns", proto.DefaultMaxConnections, "Maximum inbound connections")
+	var maxConnsPerIP = flag.Int("maxConnsPerIP", proto.DefaultMaxPerIP, "Maximum inbound connections from one IP")
+
+	var difficulty = flag.Int("difficulty", dht.DefaultDifficulty, "Proof of work difficulty for our address")
+	var minDifficulty = flag.Int("minDifficulty", dht.DefaultMinDifficulty, "Lowest proof of work difficulty accepted from other peers")
+
+	var allowLegacy = flag.Bool("allowLegacy", false, "Talk to peers that predate negotiation, without encryption")
+
+	var maxPerBucket = flag.Int("maxPerBucket", dht.DefaultMaxPerBucket, "Most peers from one subnet or host in each routing table bucket")
+	var maxPerTable = flag.Int("maxPerTable", dht.DefaultMaxPerTable, "Most peers from one subnet or host in the routing table")
+	var maxHostnamesPerBucket = flag.Int("maxHostnamesPerBucket", dht.DefaultMaxHostnamesPerBucket, "Most peers known only by hostname in each routing table bucket")
+	var maxHostnamesPerTable = flag.Int("maxHostnamesPerTable", dht.DefaultMaxHostnamesPerTable, "Most peers known only by hostname in the routing table, raise this if using Tor")
+
 	var http = flag.String("http", "127.0.0.1:8080", "HTTP address and port")
 
 	flag.Parse()
 
 	port, _ := strconv.Atoi(strings.Split(*addr, ":")[1])
 
-	lp := SetupLocalPeer(fmt.Sprintf("%s:%v", *addr), *newAddr)
+	diversity := dht.DiversityLimits{
+		MaxPerBucket:          *maxPerBucket,
+		MaxPerTable:           *maxPerTable,
+		MaxHostnamesPerBucket: *maxHostnamesPerBucket,
+		MaxHostnamesPerTable:  *maxHostnamesPerTable,
+	}
+
+	if err := diversity.Check(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	lp := SetupLocalPeer(*addr, *newAddr, *dataDir, *minDifficulty, diversity)
+	lp.AllowLegacy = *allowLegacy
 	lp.LoadEntry()
 
 	if *tor {
@@ -74,17 +105,47 @@ func main() {
 		}
 	}
 
+	// Others need it to connect to us.
+	if lp.Entry.PublicAddress == "" {
+		log.Debug("Local peer public address is nil, attempting to fetch")
+		lp.Entry.PublicAddress = zif.ExternalIP()
+		log.Debug("External IP is ", lp.Entry.PublicAddress)
+	}
+
 	lp.Entry.Port = port
 	lp.Entry.SetLocalPeer(lp)
+
+	// Peers requiring more than we do would not accept us otherwise.
+	if *difficulty < *minDifficulty {
+		*difficulty = *minDifficulty
+	}
+
+	expected := uint64(1) << uint(*difficulty)
+
+	err := lp.Work(context.Background(), *difficulty, func(tries uint64) {
+		log.WithFields(log.Fields{
+			"tries":    tries,
+			"expected": expected,
+		}).Info("Generating proof of work")
+	})
+
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
 	lp.SignEntry()
 	lp.SaveEntry()
 
-	err := lp.SaveEntry()
+	err = lp.SaveEntry()
 
 	if err != nil {
 		panic(err)
 	}
 
+	if *db_path == "" {
+		*db_path = filepath.Join(*dataDir, "posts.db")
+	}
+
 	lp.Database = data.NewDatabase(*db_path)
 
 	err = lp.Database.Connect()
@@ -93,7 +154,20 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
-	lp.Listen(*addr)
+	err = lp.MigrateCollection()
+
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	lp.Server.Limits.MaxConnections = *maxConns
+	lp.Server.Limits.MaxPerIP = *maxConnsPerIP
+
+	err = lp.Listen(*addr)
+
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 
 	log.Info("My name: ", lp.Entry.Name)
 	s, _ := lp.Address().String()
@@ -105,13 +179,19 @@ func main() {
 	go httpServer.ListenHttp(*http)
 
 	lp.StartExploring()
+	lp.StartMaintenance()
+	commandServer.ResumeMirrors()
 
 	// Listen for SIGINT
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, os.Interrupt)
 
 	for _ = range sigchan {
-		lp.Close()
+		err = lp.Close()
+
+		if err != nil {
+			os.Exit(1)
+		}
 
 		os.Exit(0)
 	}
@@ -6,6 +6,7 @@ import (
 	"io"
 
 	"github.com/zif/zif/data"
+	"github.com/zif/zif/proto"
 )
 
 // Command input types
@@ -53,7 +54,17 @@ type CommandAddPost struct {
 type CommandSelfIndex struct {
 	Since int `json:"since"`
 }
-type CommandResolve CommandPeer
+type CommandResolve struct {
+	CommandPeer
+
+	// How many disjoint paths to look along, dht.DefaultPaths if not set.
+	Paths int `json:"paths"`
+}
+
+// Either an infohash, or a magnet link with one.
+type CommandFindProviders struct {
+	InfoHash string `json:"infohash"`
+}
 type CommandBootstrap CommandPeer
 
 type CommandSuggest struct {
@@ -64,6 +75,7 @@ type CommandSelfSearch struct {
 	CommandSuggest
 	Page int `json:"page"`
 }
+type CommandNetworkSearch CommandSelfSearch
 type CommandSelfRecent struct {
 	Page int `json:"page"`
 }
@@ -76,6 +88,7 @@ type CommandGetMeta CommandMeta
 type CommandSaveCollection interface{}
 type CommandRebuildCollection interface{}
 type CommandPeers interface{}
+type CommandMetrics interface{}
 type CommandSaveRoutingTable interface{}
 
 // Used for setting values in the localpeer entry
@@ -115,9 +128,17 @@ func (cr *CommandResult) WriteJSON(w io.Writer) {
 			cr.Error = errors.New("Something bad happened, but we don't know bad, which makes the fact much worse.")
 		}
 
+		// Errors from a remote peer also say why it refused.
+		code := ""
+
+		if pe, ok := cr.Error.(*proto.ProtocolError); ok {
+			code = pe.Code.String()
+		}
+
 		e.Encode(struct {
 			Status string `json:"status"`
 			Error  string `json:"err"`
-		}{"err", cr.Error.Error()})
+			Code   string `json:"code,omitempty"`
+		}{"err", cr.Error.Error(), code})
 	}
 }
@@ -1,13 +1,19 @@
 package libzif
 
 import (
+	"context"
+	"encoding/base32"
+	"encoding/hex"
 	"errors"
-	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/zif/zif/data"
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/proto"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/streamrail/concurrent-map"
@@ -33,20 +39,20 @@ func NewCommandServer(lp *LocalPeer) *CommandServer {
 
 // Command functions
 
-func (cs *CommandServer) Ping(p CommandPing) CommandResult {
+func (cs *CommandServer) Ping(ctx context.Context, p CommandPing) CommandResult {
 	log.Info("Command: Ping request")
 
-	peer, err := cs.LocalPeer.ConnectPeer(p.Address)
+	peer, err := cs.LocalPeer.ConnectPeerContext(ctx, p.Address)
 
 	if err != nil {
 		return CommandResult{false, nil, err}
 	}
 
-	time, err := peer.Ping()
+	time, err := peer.PingContext(ctx)
 
 	return CommandResult{err == nil, time.Seconds(), err}
 }
-func (cs *CommandServer) Announce(a CommandAnnounce) CommandResult {
+func (cs *CommandServer) Announce(ctx context.Context, a CommandAnnounce) CommandResult {
 	var err error
 
 	log.Info("Command: Announce request")
@@ -54,7 +60,7 @@ func (cs *CommandServer) Announce(a CommandAnnounce) CommandResult {
 	peer := cs.LocalPeer.GetPeer(a.Address)
 
 	if peer == nil {
-		peer, err = cs.LocalPeer.ConnectPeer(a.Address)
+		peer, err = cs.LocalPeer.ConnectPeerContext(ctx, a.Address)
 
 		if err != nil {
 			return CommandResult{false, nil, err}
@@ -65,11 +71,11 @@ func (cs *CommandServer) Announce(a CommandAnnounce) CommandResult {
 		return CommandResult{false, nil, err}
 	}
 
-	err = peer.Announce(cs.LocalPeer)
+	err = peer.AnnounceContext(ctx, cs.LocalPeer)
 
 	return CommandResult{err == nil, nil, err}
 }
-func (cs *CommandServer) RSearch(rs CommandRSearch) CommandResult {
+func (cs *CommandServer) RSearch(ctx context.Context, rs CommandRSearch) CommandResult {
 	var err error
 
 	log.Info("Command: Peer Remote Search request")
@@ -79,13 +85,13 @@ func (cs *CommandServer) RSearch(rs CommandRSearch) CommandResult {
 	if peer == nil {
 		// Remote searching is not allowed to be done on seeds, it has no
 		// verification so can be falsified easily. Mirror people, mirror!
-		peer, err = cs.LocalPeer.ConnectPeer(rs.CommandPeer.Address)
+		peer, err = cs.LocalPeer.ConnectPeerContext(ctx, rs.CommandPeer.Address)
 		if err != nil {
 			return CommandResult{false, nil, err}
 		}
 	}
 
-	posts, stream, err := peer.Search(rs.Query, rs.Page)
+	posts, stream, err := peer.SearchContext(ctx, rs.Query, rs.Page)
 
 	if stream != nil {
 		defer stream.Close()
@@ -93,13 +99,13 @@ func (cs *CommandServer) RSearch(rs CommandRSearch) CommandResult {
 
 	return CommandResult{err == nil, posts, err}
 }
-func (cs *CommandServer) PeerSearch(ps CommandPeerSearch) CommandResult {
+func (cs *CommandServer) PeerSearch(ctx context.Context, ps CommandPeerSearch) CommandResult {
 	var err error
 
 	log.Info("Command: Peer Search request")
 
 	if !cs.LocalPeer.Databases.Has(ps.CommandPeer.Address) {
-		return cs.RSearch(CommandRSearch{ps.CommandPeer, ps.Query, ps.Page})
+		return cs.RSearch(ctx, CommandRSearch{ps.CommandPeer, ps.Query, ps.Page})
 	}
 
 	db, _ := cs.LocalPeer.Databases.Get(ps.CommandPeer.Address)
@@ -108,7 +114,7 @@ func (cs *CommandServer) PeerSearch(ps CommandPeerSearch) CommandResult {
 
 	return CommandResult{err == nil, posts, err}
 }
-func (cs *CommandServer) PeerRecent(pr CommandPeerRecent) CommandResult {
+func (cs *CommandServer) PeerRecent(ctx context.Context, pr CommandPeerRecent) CommandResult {
 	var err error
 	var posts []*data.Post
 
@@ -123,13 +129,13 @@ func (cs *CommandServer) PeerRecent(pr CommandPeerRecent) CommandResult {
 
 	peer := cs.LocalPeer.GetPeer(pr.CommandPeer.Address)
 	if peer == nil {
-		peer, err = cs.LocalPeer.ConnectPeer(pr.CommandPeer.Address)
+		peer, err = cs.LocalPeer.ConnectPeerContext(ctx, pr.CommandPeer.Address)
 		if err != nil {
 			return CommandResult{false, nil, err}
 		}
 	}
 
-	posts, stream, err := peer.Recent(pr.Page)
+	posts, stream, err := peer.RecentContext(ctx, pr.Page)
 
 	if stream != nil {
 		defer stream.Close()
@@ -137,7 +143,7 @@ func (cs *CommandServer) PeerRecent(pr CommandPeerRecent) CommandResult {
 
 	return CommandResult{err == nil, posts, err}
 }
-func (cs *CommandServer) PeerPopular(pp CommandPeerPopular) CommandResult {
+func (cs *CommandServer) PeerPopular(ctx context.Context, pp CommandPeerPopular) CommandResult {
 	var err error
 	var posts []*data.Post
 
@@ -152,13 +158,13 @@ func (cs *CommandServer) PeerPopular(pp CommandPeerPopular) CommandResult {
 
 	peer := cs.LocalPeer.GetPeer(pp.CommandPeer.Address)
 	if peer == nil {
-		peer, err = cs.LocalPeer.ConnectPeer(pp.CommandPeer.Address)
+		peer, err = cs.LocalPeer.ConnectPeerContext(ctx, pp.CommandPeer.Address)
 		if err != nil {
 			return CommandResult{false, nil, err}
 		}
 	}
 
-	posts, stream, err := peer.Popular(pp.Page)
+	posts, stream, err := peer.PopularContext(ctx, pp.Page)
 
 	if stream != nil {
 		defer stream.Close()
@@ -166,7 +172,7 @@ func (cs *CommandServer) PeerPopular(pp CommandPeerPopular) CommandResult {
 
 	return CommandResult{err == nil, posts, err}
 }
-func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
+func (cs *CommandServer) Mirror(ctx context.Context, cm CommandMirror) CommandResult {
 	var err error
 
 	log.Info("Command: Peer Mirror request")
@@ -174,21 +180,33 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 	peer := cs.LocalPeer.GetPeer(cm.Address)
 
 	if peer == nil {
-		peer, err = cs.LocalPeer.ConnectPeer(cm.Address)
+		peer, err = cs.LocalPeer.ConnectPeerContext(ctx, cm.Address)
 
 		if err != nil {
 			return CommandResult{false, nil, err}
 		}
 	}
 
-	// TODO: make this configurable
 	s, _ := peer.Address().String()
-	d := fmt.Sprintf("./data/%s", s)
-	os.Mkdir(fmt.Sprintf("./data/%s", d), 0777)
-	db := data.NewDatabase(d)
-	db.Connect()
+	dir := cs.LocalPeer.dataPath(s)
+	os.MkdirAll(dir, 0777)
 
-	cs.LocalPeer.Databases.Set(s, db)
+	// Resuming a mirror, the database will already be open.
+	var db *data.Database
+
+	if existing, ok := cs.LocalPeer.Databases.Get(s); ok {
+		db = existing.(*data.Database)
+	} else {
+		db = data.NewDatabase(filepath.Join(dir, "posts.db"))
+
+		err = db.Connect()
+
+		if err != nil {
+			return CommandResult{false, nil, err}
+		}
+
+		cs.LocalPeer.Databases.Set(s, db)
+	}
 
 	progressChan := make(chan int)
 
@@ -198,7 +216,22 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 		}
 	}()
 
-	_, err = peer.Mirror(db, progressChan)
+	mirror := NewMirror(peer, db, dir)
+	mirror.Connect = func(ctx context.Context, addr string) (*Peer, error) {
+		if a := dht.DecodeAddress(addr); a.Equals(cs.LocalPeer.Address()) {
+			return nil, errors.New("Cannot mirror from ourselves")
+		}
+
+		return cs.LocalPeer.ConnectPeerContext(ctx, addr)
+	}
+
+	err = mirror.Run(ctx, progressChan)
+
+	// Even a partial mirror can be served to others, they check every piece.
+	if mirror.Collection != nil {
+		cs.LocalPeer.Collections.Set(s, mirror.Collection)
+	}
+
 	if err != nil {
 		return CommandResult{false, nil, err}
 	}
@@ -210,13 +243,43 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 }
 
 func (cs *CommandServer) GetMirrorProgress(cmp CommandMirrorProgress) CommandResult {
-	if !cs.MirrorProgress.Has(cmp.Address) {
+	if progress, ok := cs.MirrorProgress.Get(cmp.Address); ok {
+		return CommandResult{true, progress.(int), nil}
+	}
+
+	// Not running now, but it may have been before a restart.
+	state, err := LoadMirrorState(mirrorStatePath(cs.LocalPeer.dataPath(cmp.Address)))
+
+	if err != nil {
 		return CommandResult{false, nil, errors.New("Mirror not in progress")}
 	}
 
-	progress, _ := cs.MirrorProgress.Get(cmp.Address)
+	return CommandResult{true, state.Verified, nil}
+}
+
+// Carries on with every mirror that had not finished when we last stopped.
+func (cs *CommandServer) ResumeMirrors() {
+	for addr := range cs.LocalPeer.Databases.Items() {
+		state, err := LoadMirrorState(mirrorStatePath(cs.LocalPeer.dataPath(addr)))
+
+		if err != nil || state.Complete() {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"peer":     addr,
+			"verified": state.Verified,
+			"size":     state.Size,
+		}).Info("Resuming mirror")
+
+		go func(addr string) {
+			res := cs.Mirror(context.Background(), CommandMirror{Address: addr})
 
-	return CommandResult{true, progress.(int), nil}
+			if res.Error != nil {
+				log.WithField("peer", addr).Error(res.Error.Error())
+			}
+		}(addr)
+	}
 }
 
 func (cs *CommandServer) PeerIndex(ci CommandPeerIndex) CommandResult {
@@ -258,14 +321,78 @@ func (cs *CommandServer) SelfIndex(ci CommandSelfIndex) CommandResult {
 
 	return CommandResult{err == nil, nil, err}
 }
-func (cs *CommandServer) Resolve(cr CommandResolve) CommandResult {
+func (cs *CommandServer) Resolve(ctx context.Context, cr CommandResolve) CommandResult {
 	log.Info("Command: Resolve request")
 
-	entry, err := cs.LocalPeer.Resolve(cr.Address)
+	entry, err := cs.LocalPeer.ResolvePaths(ctx, cr.Address, cr.Paths)
 
 	return CommandResult{err == nil, entry, err}
 }
-func (cs *CommandServer) Bootstrap(cb CommandBootstrap) CommandResult {
+
+// Finds every peer that has a post for an infohash, returning their addresses.
+func (cs *CommandServer) FindProviders(ctx context.Context, cfp CommandFindProviders) CommandResult {
+	log.Info("Command: Find providers request")
+
+	infohash, err := infoHashOf(cfp.InfoHash)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	records, err := cs.LocalPeer.FindProviders(ctx, proto.ProviderKey(infohash))
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	providers := make([]string, 0, len(records))
+
+	for _, i := range records {
+		s, _ := i.Provider.String()
+		providers = append(providers, s)
+	}
+
+	return CommandResult{true, providers, nil}
+}
+
+// Takes the infohash from a magnet link, base32 infohashes are converted to
+// hex as that is how posts hold them. Anything else is taken as an infohash.
+func infoHashOf(s string) (string, error) {
+	if strings.HasPrefix(s, "magnet:") {
+		u, err := url.Parse(s)
+
+		if err != nil {
+			return "", err
+		}
+
+		s = ""
+
+		for _, i := range u.Query()["xt"] {
+			if strings.HasPrefix(i, "urn:btih:") {
+				s = strings.TrimPrefix(i, "urn:btih:")
+				break
+			}
+		}
+
+		if s == "" {
+			return "", errors.New("Magnet link has no infohash")
+		}
+	}
+
+	if len(s) == 32 {
+		raw, err := base32.StdEncoding.DecodeString(strings.ToUpper(s))
+
+		if err != nil {
+			return "", err
+		}
+
+		s = hex.EncodeToString(raw)
+	}
+
+	return strings.ToLower(s), nil
+}
+
+func (cs *CommandServer) Bootstrap(ctx context.Context, cb CommandBootstrap) CommandResult {
 	log.Info("Command: Bootstrap request")
 
 	addrnport := strings.Split(cb.Address, ":")
@@ -283,7 +410,7 @@ func (cs *CommandServer) Bootstrap(cb CommandBootstrap) CommandResult {
 		return CommandResult{false, nil, err}
 	}
 
-	_, err = peer.Bootstrap(cs.LocalPeer.DHT)
+	_, err = peer.BootstrapContext(ctx, cs.LocalPeer.DHT)
 
 	return CommandResult{err == nil, nil, err}
 }
@@ -300,6 +427,13 @@ func (cs *CommandServer) SelfSearch(css CommandSelfSearch) CommandResult {
 
 	return CommandResult{err == nil, posts, err}
 }
+func (cs *CommandServer) NetworkSearch(ctx context.Context, cns CommandNetworkSearch) CommandResult {
+	log.Info("Command: Network search request")
+
+	results, err := cs.LocalPeer.NetworkSearch(ctx, cns.Query, cns.Page)
+
+	return CommandResult{err == nil, results, err}
+}
 func (cs *CommandServer) SelfRecent(cr CommandSelfRecent) CommandResult {
 	log.Info("Command: Recent request")
 
@@ -324,8 +458,7 @@ func (cs *CommandServer) AddMeta(cam CommandAddMeta) CommandResult {
 func (cs *CommandServer) SaveCollection(csc CommandSaveCollection) CommandResult {
 	log.Info("Command: Save Collection request")
 
-	// TODO: make this configurable
-	cs.LocalPeer.Collection.Save("./data/collection.dat")
+	cs.LocalPeer.Collection.Save(cs.LocalPeer.dataPath("collection.dat"))
 
 	return CommandResult{true, nil, nil}
 }
@@ -353,36 +486,48 @@ func (cs *CommandServer) Peers(cp CommandPeers) CommandResult {
 	return CommandResult{true, ps, nil}
 }
 
-func (cs *CommandServer) RequestAddPeer(crap CommandRequestAddPeer) CommandResult {
+func (cs *CommandServer) Metrics(cm CommandMetrics) CommandResult {
+	log.Info("Command: Metrics request")
+
+	metrics := struct {
+		Messages    map[int]proto.MessageStats `json:"messages"`
+		Connections proto.AdmissionStats       `json:"connections"`
+	}{cs.LocalPeer.Metrics.Stats(), cs.LocalPeer.Server.Admission()}
+
+	return CommandResult{true, metrics, nil}
+}
+
+func (cs *CommandServer) RequestAddPeer(ctx context.Context, crap CommandRequestAddPeer) CommandResult {
 	log.Info("Command: Request Add Peer request")
 
-	peer, err := cs.LocalPeer.ConnectPeer(crap.Remote)
+	peer, err := cs.LocalPeer.ConnectPeerContext(ctx, crap.Remote)
 
 	if err != nil {
 		return CommandResult{true, nil, err}
 	}
 
-	_, err = peer.RequestAddPeer(crap.Peer)
+	_, err = peer.RequestAddPeerContext(ctx, crap.Peer)
 
 	return CommandResult{err == nil, nil, err}
 }
 
 // Set a value in the localpeer entry
 func (cs *CommandServer) LocalSet(cls CommandLocalSet) CommandResult {
+	var update func(e *proto.Entry)
 
 	switch strings.ToLower(cls.Key) {
 	case "name":
-		cs.LocalPeer.Entry.Name = cls.Value
+		update = func(e *proto.Entry) { e.Name = cls.Value }
 	case "desc":
-		cs.LocalPeer.Entry.Desc = cls.Value
+		update = func(e *proto.Entry) { e.Desc = cls.Value }
 	case "public":
-		cs.LocalPeer.Entry.PublicAddress = cls.Value
+		update = func(e *proto.Entry) { e.PublicAddress = cls.Value }
 
 	default:
 		return CommandResult{false, nil, errors.New("Unknown key")}
 	}
 
-	cs.LocalPeer.SignEntry()
+	cs.LocalPeer.UpdateEntry(update)
 	err := cs.LocalPeer.SaveEntry()
 
 	return CommandResult{err == nil, nil, err}
@@ -391,20 +536,21 @@ func (cs *CommandServer) LocalSet(cls CommandLocalSet) CommandResult {
 func (cs *CommandServer) LocalGet(clg CommandLocalGet) CommandResult {
 	log.Info("Command: LocalGet")
 	value := ""
+	entry := cs.LocalPeer.CopyEntry()
 
 	switch strings.ToLower(clg.Key) {
 	case "name":
-		value = cs.LocalPeer.Entry.Name
+		value = entry.Name
 	case "desc":
-		value = cs.LocalPeer.Entry.Desc
+		value = entry.Desc
 	case "public":
-		value = cs.LocalPeer.Entry.PublicAddress
+		value = entry.PublicAddress
 	case "zif":
-		value, _ = cs.LocalPeer.Entry.Address.String()
+		value, _ = entry.Address.String()
 	case "postcount":
-		value = strconv.Itoa(cs.LocalPeer.Entry.PostCount)
+		value = strconv.Itoa(entry.PostCount)
 	case "entry":
-		value, _ = cs.LocalPeer.Entry.JsonString()
+		value, _ = entry.JsonString()
 
 	default:
 		return CommandResult{false, nil, errors.New("Unknown key")}
@@ -8,6 +8,7 @@ type Peer interface {
 	EAddress() Encodable
 	Query(string) (Closable, *dht.KeyValue, error)
 	FindClosest(address string) (Closable, dht.Pairs, error)
+	Pex(n int) (Closable, dht.Pairs, error)
 }
 
 type Closable interface {
@@ -1,12 +1,12 @@
 package data
 
 import (
+	"bytes"
 	"errors"
 	"hash"
 	"io/ioutil"
 	"math"
 
-	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/sha3"
 )
 
@@ -17,8 +17,16 @@ type Collection struct {
 	Pieces   []*Piece
 	HashList []byte
 	RootHash hash.Hash
+
+	// The encoding the pieces were hashed with.
+	Encoding int
 }
 
+// Collection files start with this, followed by a byte for the encoding. Files
+// without it are bare hash lists from before encodings were versioned, so use
+// EncodingLegacy. As hashes are 32 bytes the two can never be confused.
+var collectionMagic = []byte("ZCOL")
+
 // Create a new collection, set all it's members to the correct default values.
 func NewCollection() *Collection {
 	col := &Collection{}
@@ -26,6 +34,7 @@ func NewCollection() *Collection {
 	col.RootHash = sha3.New256()
 	col.Pieces = make([]*Piece, 0, 2)
 	col.HashList = make([]byte, 0)
+	col.Encoding = CurrentEncoding
 
 	return col
 }
@@ -63,7 +72,17 @@ func LoadCollection(path string) (col *Collection, err error) {
 		return
 	}
 
-	if len(data)%32 != 0 {
+	header := len(collectionMagic) + 1
+
+	switch {
+	case len(data)%32 == 0:
+		col.Encoding = EncodingLegacy
+
+	case len(data)%32 == header && bytes.Equal(data[:len(collectionMagic)], collectionMagic):
+		col.Encoding = int(data[header-1])
+		data = data[header:]
+
+	default:
 		err = errors.New("Invalid collection data file")
 		return
 	}
@@ -75,14 +94,19 @@ func LoadCollection(path string) (col *Collection, err error) {
 }
 
 // Save the collection hash list to the given path, with permissions 0777.
-func (c *Collection) Save(path string) {
-	ioutil.WriteFile(path, c.HashList, 0777)
+func (c *Collection) Save(path string) error {
+	data := make([]byte, 0, len(collectionMagic)+1+len(c.HashList))
+	data = append(data, collectionMagic...)
+	data = append(data, byte(c.Encoding))
+	data = append(data, c.HashList...)
+
+	return ioutil.WriteFile(path, data, 0777)
 }
 
 // Add a piece to the collection, storing it in c.Pieces and appending it's hash
 // to the hash list.
 func (c *Collection) Add(piece *Piece) {
-	if uint(len(c.HashList)) < piece.Id+1 {
+	if uint(len(c.HashList)/32) < piece.Id+1 {
 		c.HashList = append(c.HashList, piece.Hash()...)
 	} else {
 		copy(c.HashList[piece.Id*32:piece.Id*32+32], piece.Hash())
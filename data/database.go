@@ -80,17 +80,26 @@ func (db *Database) InsertPiece(piece *Piece) (err error) {
 
 // Insert pieces from a channel, good for streaming them from a network or something.
 // The fts bool is whether or not a fts index will be generated on every transaction
-// commit. Transactions contain 100 pieces, or 100,000 posts.
-func (db *Database) InsertPieces(pieces chan *Piece, fts bool) (err error) {
+// commit. Transactions contain 100 pieces, or 100,000 posts. If inserted is not
+// nil, it is passed the id of the last post in the database after each piece.
+func (db *Database) InsertPieces(pieces chan *Piece, fts bool, inserted func(last int64)) (err error) {
 	tx, err := db.conn.Begin()
 
+	if err != nil {
+		return
+	}
+
 	n := 0
 
 	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
 		err = tx.Commit()
 
 		if err != nil {
-			tx.Rollback()
 			log.Error(err.Error())
 		}
 	}()
@@ -127,6 +136,19 @@ func (db *Database) InsertPieces(pieces chan *Piece, fts bool) (err error) {
 			}
 		}
 
+		// Posts already held are ignored, so the ids used are not known
+		// until asked for.
+		if inserted != nil {
+			var last int64
+			err = tx.QueryRow(sql_last_post_id).Scan(&last)
+
+			if err != nil {
+				return
+			}
+
+			inserted(last)
+		}
+
 		n += 1
 	}
 
@@ -153,6 +175,21 @@ func (db *Database) InsertPost(post Post) (int64, error) {
 	return id, nil
 }
 
+// Removes every post with an id after last, for when a mirror has to fetch
+// pieces again. The search index is rebuilt so that it does not point at
+// posts that are gone.
+func (db *Database) TruncatePosts(last int64) error {
+	_, err := db.conn.Exec(sql_delete_post_after, last)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.Exec(sql_rebuild_fts)
+
+	return err
+}
+
 // Generate a full text search index since the given id. This should ideally be
 // done only for new additions, otherwise on a large dataset it can take a bit of
 // time.
@@ -281,6 +318,8 @@ func (db *Database) QueryPiece(id uint, store bool) (*Piece, error) {
 		return nil, err
 	}
 
+	defer rows.Close()
+
 	for rows.Next() {
 
 		var post Post
@@ -310,12 +349,14 @@ func (db *Database) QueryPiecePosts(start, length int, store bool) chan *Post {
 		defer close(ret)
 
 		rows, err := db.conn.Query(sql_query_paged_post, start*page_size,
-			start+page_size*length)
+			page_size*length)
 
 		if err != nil {
 			return
 		}
 
+		defer rows.Close()
+
 		for rows.Next() {
 
 			var post Post
@@ -391,6 +432,6 @@ func (db *Database) Suggest(query string) ([]string, error) {
 }
 
 // Close the database connection.
-func (db *Database) Close() {
-	db.conn.Close()
+func (db *Database) Close() error {
+	return db.conn.Close()
 }
@@ -1,12 +1,15 @@
 package data
 
-import "testing"
+import (
+	"path/filepath"
+	"testing"
+)
 
 const ArchInfoHash = "657c483dc66c1f248fc2eda5f5682ea557233e7a"
 const UbuntuInfoHash = "9f9165d9a281a9b8e782cd5176bbcc8256fd1871"
 
-func ConnectDb(t *testing.T) *zif.Database {
-	db := zif.NewDatabase("file::memory:?cache=shared")
+func ConnectDb(t *testing.T) *Database {
+	db := NewDatabase("file::memory:?cache=shared")
 
 	err := db.Connect()
 
@@ -21,10 +24,9 @@ func TestDatabaseInsert(t *testing.T) {
 	db := ConnectDb(t)
 	defer db.Close()
 
-	source, _ := zif.CryptoRandBytes(20)
-	post := zif.NewPost(ArchInfoHash, "Arch 2016-09-03", 100, 10, 1472860800, source)
+	post := Post{InfoHash: ArchInfoHash, Title: "Arch 2016-09-03", Seeders: 100, Leechers: 10, UploadDate: 1472860800}
 
-	err := db.InsertPost(post)
+	_, err := db.InsertPost(post)
 	test_error(err, t)
 
 	recent, err := db.QueryRecent(0)
@@ -51,21 +53,20 @@ func test_error(err error, t *testing.T) {
 
 func TestDatabaseSearch(t *testing.T) {
 	db := ConnectDb(t)
-	source, _ := zif.CryptoRandBytes(20)
 
-	arch := zif.NewPost(ArchInfoHash, "Arch Linux 2016-09-03", 100, 10, 1472860800, source)
-	ubuntu := zif.NewPost(UbuntuInfoHash, "Ubuntu Linux 16.04.1", 101, 9, 1472860800, source)
+	arch := Post{InfoHash: ArchInfoHash, Title: "Arch Linux 2016-09-03", Seeders: 100, Leechers: 10, UploadDate: 1472860800}
+	ubuntu := Post{InfoHash: UbuntuInfoHash, Title: "Ubuntu Linux 16.04.1", Seeders: 101, Leechers: 9, UploadDate: 1472860800}
 
-	err := db.InsertPost(arch)
+	_, err := db.InsertPost(arch)
 	test_error(err, t)
 
-	err = db.InsertPost(ubuntu)
+	_, err = db.InsertPost(ubuntu)
 	test_error(err, t)
 
 	err = db.GenerateFts(0)
 	test_error(err, t)
 
-	results, err := db.Search("arch", 0)
+	results, err := db.Search("arch", 0, 25)
 	test_error(err, t)
 
 	if len(results) == 0 {
@@ -76,7 +77,7 @@ func TestDatabaseSearch(t *testing.T) {
 		t.Error("Search not correctly performed")
 	}
 
-	results, err = db.Search("ubuntu", 0)
+	results, err = db.Search("ubuntu", 0, 25)
 	test_error(err, t)
 
 	if len(results) == 0 {
@@ -87,7 +88,7 @@ func TestDatabaseSearch(t *testing.T) {
 		t.Error("Search not correctly performed")
 	}
 
-	results, err = db.Search("linux", 0)
+	results, err = db.Search("linux", 0, 25)
 	test_error(err, t)
 
 	if len(results) != 2 {
@@ -99,3 +100,42 @@ func TestDatabaseSearch(t *testing.T) {
 	}
 
 }
+
+// Posts already held are skipped, so a mirror has to be told where each piece
+// ends rather than working it out.
+func TestDatabaseInsertPieces(t *testing.T) {
+	db := NewDatabase(filepath.Join(t.TempDir(), "posts.db"))
+
+	if err := db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer db.Close()
+
+	arch := Post{InfoHash: ArchInfoHash, Title: "Arch Linux 2016-09-03"}
+	ubuntu := Post{InfoHash: UbuntuInfoHash, Title: "Ubuntu Linux 16.04.1"}
+
+	_, err := db.InsertPost(ubuntu)
+	test_error(err, t)
+
+	pieces := make(chan *Piece, 2)
+	pieces <- &Piece{Posts: []Post{ubuntu}}
+	pieces <- &Piece{Posts: []Post{arch}}
+	close(pieces)
+
+	ends := make([]int64, 0)
+	err = db.InsertPieces(pieces, false, func(last int64) {
+		ends = append(ends, last)
+	})
+	test_error(err, t)
+
+	if len(ends) != 2 || ends[0] != 1 || ends[1] != 2 {
+		t.Fatalf("Pieces ended at %v", ends)
+	}
+
+	test_error(db.TruncatePosts(ends[0]), t)
+
+	if db.PostCount() != 1 {
+		t.Error("Posts not truncated")
+	}
+}
@@ -0,0 +1,162 @@
+// Encodings for posts, used both when hashing pieces and when sending them.
+//
+// The legacy encoding joins fields with "|", so a title or tag containing "|"
+// can be read back wrongly, and two different posts can encode the same. The
+// canonical encoding length prefixes everything:
+//
+//	version     byte, PostEncodingVersion
+//	id          int64, little endian
+//	infohash    uint32 length, then bytes
+//	title       uint32 length, then bytes
+//	size        int64
+//	filecount   int64
+//	seeders     int64
+//	leechers    int64
+//	uploaddate  int64
+//	tags        uint32 length, then bytes
+//	meta        uint32 length, then bytes
+
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// Fields joined with "|", still understood for older peers.
+	EncodingLegacy = 0
+
+	// Versioned and length prefixed.
+	EncodingCanonical = 1
+)
+
+// What new pieces and collections are hashed with.
+const CurrentEncoding = EncodingCanonical
+
+// The first byte of every canonically encoded post.
+const PostEncodingVersion byte = 1
+
+// Writes the post in the given encoding.
+func (p *Post) Encode(encoding int, w io.Writer) error {
+	switch encoding {
+	case EncodingLegacy:
+		p.Write("|", "", w)
+		return nil
+	case EncodingCanonical:
+		return p.WriteCanonical(w)
+	}
+
+	return fmt.Errorf("Unknown post encoding: %d", encoding)
+}
+
+func (p *Post) EncodeBytes(encoding int) ([]byte, error) {
+	buf := bytes.Buffer{}
+	err := p.Encode(encoding, &buf)
+
+	return buf.Bytes(), err
+}
+
+func (p *Post) WriteCanonical(w io.Writer) error {
+	buf := bytes.Buffer{}
+
+	buf.WriteByte(PostEncodingVersion)
+	binary.Write(&buf, binary.LittleEndian, int64(p.Id))
+	writeString(&buf, p.InfoHash)
+	writeString(&buf, p.Title)
+
+	for _, i := range []int{p.Size, p.FileCount, p.Seeders, p.Leechers, p.UploadDate} {
+		binary.Write(&buf, binary.LittleEndian, int64(i))
+	}
+
+	writeString(&buf, p.Tags)
+	writeString(&buf, p.Meta)
+
+	_, err := w.Write(buf.Bytes())
+
+	return err
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.LittleEndian, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+// Reads a single canonically encoded post. No string may be longer than
+// MaxPostSize, so a bad length cannot make us allocate a huge buffer.
+func ReadCanonicalPost(r io.Reader) (*Post, error) {
+	var version [1]byte
+
+	if _, err := io.ReadFull(r, version[:]); err != nil {
+		return nil, err
+	}
+
+	if version[0] != PostEncodingVersion {
+		return nil, fmt.Errorf("Unknown post encoding version: %d", version[0])
+	}
+
+	var ints [6]int64
+	var strs [4]string
+	var err error
+
+	read := func(i *int64) {
+		if err == nil {
+			err = binary.Read(r, binary.LittleEndian, i)
+		}
+	}
+
+	readStr := func(s *string) {
+		if err == nil {
+			*s, err = readString(r)
+		}
+	}
+
+	read(&ints[0])
+	readStr(&strs[0])
+	readStr(&strs[1])
+
+	for i := 1; i < len(ints); i++ {
+		read(&ints[i])
+	}
+
+	readStr(&strs[2])
+	readStr(&strs[3])
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Post{
+		Id:         int(ints[0]),
+		InfoHash:   strs[0],
+		Title:      strs[1],
+		Size:       int(ints[1]),
+		FileCount:  int(ints[2]),
+		Seeders:    int(ints[3]),
+		Leechers:   int(ints[4]),
+		UploadDate: int(ints[5]),
+		Tags:       strs[2],
+		Meta:       strs[3],
+	}, nil
+}
+
+func readString(r io.Reader) (string, error) {
+	var length uint32
+	err := binary.Read(r, binary.LittleEndian, &length)
+
+	if err != nil {
+		return "", err
+	}
+
+	if length > MaxPostSize {
+		return "", errors.New("Post field too large")
+	}
+
+	buf := make([]byte, length)
+	_, err = io.ReadFull(r, buf)
+
+	return string(buf), err
+}
@@ -0,0 +1,127 @@
+package data
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestPostCanonical(t *testing.T) {
+	post := Post{
+		Id:         7,
+		InfoHash:   ArchInfoHash,
+		Title:      "Arch | Linux",
+		Size:       100,
+		FileCount:  1,
+		Seeders:    10,
+		Leechers:   2,
+		UploadDate: 1472860800,
+		Tags:       "linux|iso",
+		Meta:       "|",
+	}
+
+	dat, err := post.EncodeBytes(EncodingCanonical)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	decoded, err := ReadCanonicalPost(bytes.NewReader(dat))
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if *decoded != post {
+		t.Error("Decoded post does not match")
+	}
+}
+
+// With the legacy encoding these two posts encode the same, they must not
+// with the canonical one.
+func TestPostCanonicalUnambiguous(t *testing.T) {
+	a := Post{InfoHash: "a|b", Title: "c"}
+	b := Post{InfoHash: "a", Title: "b|c"}
+
+	legacyA, _ := a.EncodeBytes(EncodingLegacy)
+	legacyB, _ := b.EncodeBytes(EncodingLegacy)
+
+	if !bytes.Equal(legacyA, legacyB) {
+		t.Fatal("Legacy encodings expected to collide")
+	}
+
+	canonicalA, _ := a.EncodeBytes(EncodingCanonical)
+	canonicalB, _ := b.EncodeBytes(EncodingCanonical)
+
+	if bytes.Equal(canonicalA, canonicalB) {
+		t.Error("Different posts have the same canonical encoding")
+	}
+
+	var pa, pb Piece
+	pa.Setup()
+	pb.Setup()
+	pa.Add(a, false)
+	pb.Add(b, false)
+
+	if bytes.Equal(pa.Hash(), pb.Hash()) {
+		t.Error("Different pieces have the same hash")
+	}
+}
+
+func TestReadCanonicalPostLimits(t *testing.T) {
+	post := Post{Title: "title"}
+	dat, _ := post.EncodeBytes(EncodingCanonical)
+
+	// Claim an enormous title.
+	dat[1+8+4] = 0xff
+	dat[1+8+4+1] = 0xff
+	dat[1+8+4+2] = 0xff
+
+	if _, err := ReadCanonicalPost(bytes.NewReader(dat)); err == nil {
+		t.Error("Oversized field accepted")
+	}
+
+	if _, err := ReadCanonicalPost(bytes.NewReader(dat[:10])); err == nil {
+		t.Error("Truncated post accepted")
+	}
+}
+
+func TestCollectionSave(t *testing.T) {
+	path := t.TempDir() + "/collection.dat"
+
+	var piece Piece
+	piece.Setup()
+	piece.Add(Post{Title: "a"}, false)
+
+	col := NewCollection()
+	col.Add(&piece)
+
+	if err := col.Save(path); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	loaded, err := LoadCollection(path)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if loaded.Encoding != CurrentEncoding || !bytes.Equal(loaded.HashList, col.HashList) {
+		t.Error("Loaded collection does not match")
+	}
+
+	// Bare hash lists were written before encodings were versioned.
+	if err := ioutil.WriteFile(path, col.HashList, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	loaded, err = LoadCollection(path)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if loaded.Encoding != EncodingLegacy || !bytes.Equal(loaded.HashList, col.HashList) {
+		t.Error("Legacy collection not loaded")
+	}
+}
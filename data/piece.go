@@ -14,10 +14,14 @@ type Piece struct {
 	Id    uint
 	Posts []Post
 	hash  hash.Hash
+
+	// How posts are encoded before they are hashed.
+	Encoding int
 }
 
 func (p *Piece) Setup() {
 	p.hash = sha3.New256()
+	p.Encoding = CurrentEncoding
 }
 
 func (p *Piece) Add(post Post, store bool) error {
@@ -29,8 +33,13 @@ func (p *Piece) Add(post Post, store bool) error {
 		p.Posts = append(p.Posts, post)
 	}
 
-	data := post.String("|", "")
-	p.hash.Write([]byte(data))
+	data, err := post.EncodeBytes(p.Encoding)
+
+	if err != nil {
+		return err
+	}
+
+	p.hash.Write(data)
 
 	return nil
 }
@@ -47,11 +56,16 @@ func (p *Piece) Rehash() ([]byte, error) {
 	p.hash = sha3.New256()
 
 	for _, i := range p.Posts {
-		data := i.Bytes([]byte("|"), []byte(""))
-		p.hash.Write([]byte(data))
+		data, err := i.EncodeBytes(p.Encoding)
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.hash.Write(data)
 	}
 
-	log.Info("Piece rehashed")
+	log.Debug("Piece rehashed")
 
 	return p.hash.Sum(nil), nil
 }
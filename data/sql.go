@@ -50,6 +50,10 @@ const sql_generate_fts string = `INSERT OR IGNORE INTO fts_post(
 							SELECT id, title, seeders, leechers FROM post 
 							WHERE id >= ?`
 
+const sql_delete_post_after string = `DELETE FROM post WHERE id > ?`
+
+const sql_rebuild_fts string = `INSERT INTO fts_post(fts_post) VALUES('rebuild')`
+
 const sql_query_recent_post string = `SELECT 	 * FROM post
 												 ORDER BY upload_date DESC
 												 LIMIT ?,?`
@@ -87,3 +91,5 @@ const sql_suggest_posts string = `SELECT title FROM (
 									LIMIT 0,?`
 
 const sql_count_post = `SELECT MAX(id) FROM post`
+
+const sql_last_post_id = `SELECT IFNULL(MAX(id), 0) FROM post`
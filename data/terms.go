@@ -0,0 +1,98 @@
+// Terms are the words in post titles that peers publish to the DHT, so that
+// they can be found by anyone searching for them.
+
+package data
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// How many of the most common terms in a peer's titles are published.
+const MaxTerms = 32
+
+// Shorter terms are too common to be worth looking up.
+const MinTermLength = 3
+
+var stopWords = map[string]bool{
+	"and":  true,
+	"are":  true,
+	"for":  true,
+	"from": true,
+	"the":  true,
+	"this": true,
+	"that": true,
+	"with": true,
+}
+
+// Splits s into lower case terms, leaving out anything too short, too common,
+// or just a number. Each term is returned once, in the order first seen.
+func Terms(s string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	ret := make([]string, 0, len(fields))
+	seen := make(map[string]bool)
+
+	for _, i := range fields {
+		if len(i) < MinTermLength || stopWords[i] || seen[i] || isNumber(i) {
+			continue
+		}
+
+		seen[i] = true
+		ret = append(ret, i)
+	}
+
+	return ret
+}
+
+func isNumber(s string) bool {
+	for _, i := range s {
+		if !unicode.IsNumber(i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Counts how many titles each term appears in.
+type TermCounter struct {
+	counts map[string]int
+}
+
+func NewTermCounter() *TermCounter {
+	return &TermCounter{make(map[string]int)}
+}
+
+func (tc *TermCounter) Add(title string) {
+	for _, i := range Terms(title) {
+		tc.counts[i]++
+	}
+}
+
+// The n most common terms, most common first. Ties are broken alphabetically,
+// so the same titles always give the same terms.
+func (tc *TermCounter) Top(n int) []string {
+	ret := make([]string, 0, len(tc.counts))
+
+	for i := range tc.counts {
+		ret = append(ret, i)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if tc.counts[ret[i]] != tc.counts[ret[j]] {
+			return tc.counts[ret[i]] > tc.counts[ret[j]]
+		}
+
+		return ret[i] < ret[j]
+	})
+
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+
+	return ret
+}
@@ -0,0 +1,31 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTerms(t *testing.T) {
+	terms := Terms("The Arch Linux 2015.09.03 ISO, with arch-linux GNOME")
+	expected := []string{"arch", "linux", "iso", "gnome"}
+
+	if !reflect.DeepEqual(terms, expected) {
+		t.Errorf("Terms were %v", terms)
+	}
+}
+
+func TestTermCounterTop(t *testing.T) {
+	tc := NewTermCounter()
+
+	tc.Add("Arch Linux")
+	tc.Add("Ubuntu Linux Linux")
+	tc.Add("Ubuntu Server")
+	tc.Add("Debian")
+
+	top := tc.Top(3)
+	expected := []string{"linux", "ubuntu", "arch"}
+
+	if !reflect.DeepEqual(top, expected) {
+		t.Errorf("Top terms were %v", top)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"strings"
 
 	"github.com/prettymuchbryce/hellobitcoin/base58check"
 	"github.com/zif/zif/util"
@@ -50,6 +51,27 @@ func (a *Address) JsonString() (string, error) {
 	return string(dat), err
 }
 
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// Every address encodes to the same length, as the prefix fixes the first byte.
+var encodedAddressSize = len(base58check.Encode("51", make([]byte, AddressBinarySize)))
+
+// Whether value is an encoded address. Worth checking before DecodeAddress on
+// anything untrusted, as decoding exits on invalid input.
+func IsAddress(value string) bool {
+	if len(value) != encodedAddressSize {
+		return false
+	}
+
+	for _, i := range value {
+		if !strings.ContainsRune(base58Alphabet, i) {
+			return false
+		}
+	}
+
+	return len(DecodeAddress(value).Raw) == AddressBinarySize
+}
+
 // Decodes a string address into address bytes.
 func DecodeAddress(value string) Address {
 	var addr Address
@@ -1,14 +1,23 @@
 package dht
 
+import (
+	"context"
+	"time"
+)
+
 type DHT struct {
-	db *NetDB
+	db        *NetDB
+	providers *ProviderStore
 }
 
 func NewDHT(addr Address, path string) *DHT {
 	ret := &DHT{
-		db: NewNetDB(addr, path),
+		db:        NewNetDB(addr, path),
+		providers: NewProviderStore(),
 	}
 
+	ret.providers.self = addr
+
 	return ret
 }
 
@@ -29,14 +38,161 @@ func (dht *DHT) FindClosest(addr Address) (Pairs, error) {
 	return dht.db.FindClosest(addr)
 }
 
-func (dht *DHT) SaveTable(path string) {
-	dht.db.SaveTable(path)
+func (dht *DHT) FindClosestN(addr Address, k int) (Pairs, error) {
+	return dht.db.FindClosestN(addr, k)
+}
+
+// Finds the value stored under target, asking the network if we do not have
+// it ourselves.
+func (dht *DHT) Lookup(ctx context.Context, network Network, target Address) (*KeyValue, error) {
+	kv, err := dht.Query(target)
+
+	if err != nil || kv != nil {
+		return kv, err
+	}
+
+	closest, err := dht.FindClosest(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := Lookup{Network: network, Grouper: dht.grouper()}
+	kv, _, err = lookup.Find(ctx, dht.Address(), target, closest)
+
+	return kv, err
+}
+
+// Finds the value stored under target along paths disjoint paths, see
+// Lookup.FindDisjoint. A value we have ourselves is returned along with the
+// others, not instead of them, as it may be older than what the network has.
+func (dht *DHT) LookupDisjoint(ctx context.Context, network Network, target Address, paths int) (Pairs, error) {
+	local, err := dht.Query(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	closest, err := dht.FindClosest(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := Lookup{Network: network, Grouper: dht.grouper()}
+	found, err := lookup.FindDisjoint(ctx, dht.Address(), target, closest, paths)
+
+	if local == nil {
+		return found, err
+	}
+
+	return append(found, local), nil
+}
+
+// Finds the closest nodes to target that answer, asking the network.
+func (dht *DHT) FindNodes(ctx context.Context, network Network, target Address) (Pairs, error) {
+	closest, err := dht.FindClosest(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := Lookup{Network: network, Grouper: dht.grouper()}
+
+	return lookup.FindNodes(ctx, dht.Address(), target, closest)
+}
+
+// Removes entries not seen for ttl, and expired provider records, returning
+// how many were.
+func (dht *DHT) Cull(ttl time.Duration) int {
+	return dht.db.Cull(ttl) + dht.providers.Cull()
+}
+
+// Whether we are one of the BucketSize closest peers we know of to key, and so
+// one of those who should hold what is stored under it.
+func (dht *DHT) Closest(key Address) bool {
+	closest, err := dht.db.FindClosestN(key, BucketSize)
+
+	if err != nil {
+		return false
+	}
+
+	if len(closest) < BucketSize {
+		return true
+	}
+
+	return dht.db.addr.Xor(&key).Less(&closest[len(closest)-1].distance)
+}
+
+func (dht *DHT) AddProvider(key Address, p *Provider) error {
+	return dht.providers.Add(key, p)
+}
+
+func (dht *DHT) Providers(key Address) []*Provider {
+	return dht.providers.Get(key)
+}
+
+func (dht *DHT) SaveProviders(path string) error {
+	return dht.providers.Save(path)
+}
+
+func (dht *DHT) LoadProviders(path string) error {
+	return dht.providers.Load(path)
+}
+
+func (dht *DHT) Recent(n int) Pairs {
+	return dht.db.Recent(n)
+}
+
+func (dht *DHT) SaveTable(path string) error {
+	return dht.db.SaveTable(path)
 }
 
 func (dht *DHT) LoadTable(path string) {
 	dht.db.LoadTable(path)
 }
 
+// Entries are checked before being evicted from full buckets with c.
+func (dht *DHT) SetChecker(c LivenessChecker) {
+	dht.db.lock.Lock()
+	defer dht.db.lock.Unlock()
+
+	dht.db.Checker = c
+}
+
+// Values are checked with v before they are inserted.
+func (dht *DHT) SetValidator(v Validator) {
+	dht.db.lock.Lock()
+	defer dht.db.lock.Unlock()
+
+	dht.db.Validator = v
+}
+
+func (dht *DHT) grouper() Grouper {
+	dht.db.lock.Lock()
+	defer dht.db.lock.Unlock()
+
+	return dht.db.Grouper
+}
+
+// Only so many entries from one group, as given by g, are let into the table.
+func (dht *DHT) SetGrouper(g Grouper, limits DiversityLimits) {
+	dht.db.lock.Lock()
+	defer dht.db.lock.Unlock()
+
+	dht.db.Grouper = g
+	dht.db.Diversity = limits
+	dht.db.regroup()
+}
+
+func (dht *DHT) Failed(addr Address) {
+	dht.db.Failed(addr)
+}
+
+func (dht *DHT) Unanswered(addr Address) int {
+	return dht.db.Unanswered(addr)
+}
+
 func (dht *DHT) Has(addr Address) bool {
 	return dht.db.Has(addr)
 }
@@ -0,0 +1,259 @@
+// Keeping the routing table diverse. Entries are put in groups of those likely
+// to be run by the same operator, for instance those on the same /24, and only
+// so many from one group are let into a bucket or the table. Otherwise one
+// operator with a block of addresses could fill our table, and every lookup we
+// make would go through them.
+//
+// Names cost nothing, so entries that can only be grouped by hostname are also
+// limited all together, however many different names they have.
+
+package dht
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// How many entries from one group may be in a single bucket.
+	DefaultMaxPerBucket = 2
+
+	// How many entries from one group may be in the whole table.
+	DefaultMaxPerTable = 10
+
+	// How many entries grouped by hostname may be in a single bucket, and in
+	// the whole table.
+	DefaultMaxHostnamesPerBucket = BucketSize / 2
+	DefaultMaxHostnamesPerTable  = 64
+
+	// The start of every group for a hostname.
+	HostGroupPrefix = "host:"
+)
+
+type Grouper interface {
+	// The group the node kv is for belongs to, "" if it belongs to none.
+	Group(kv *KeyValue) string
+}
+
+type DiversityLimits struct {
+	// Default to DefaultMaxPerBucket and DefaultMaxPerTable.
+	MaxPerBucket int
+	MaxPerTable  int
+
+	// Limits for every hostname group together. Default to
+	// DefaultMaxHostnamesPerBucket and DefaultMaxHostnamesPerTable.
+	MaxHostnamesPerBucket int
+	MaxHostnamesPerTable  int
+}
+
+// Returns an error if any of the limits are negative, as then every entry
+// would be turned away.
+func (dl DiversityLimits) Check() error {
+	if dl.MaxPerBucket < 0 || dl.MaxPerTable < 0 ||
+		dl.MaxHostnamesPerBucket < 0 || dl.MaxHostnamesPerTable < 0 {
+		return &InvalidValue{"diversity limits cannot be negative"}
+	}
+
+	return nil
+}
+
+func (dl DiversityLimits) maxPerBucket() int {
+	if dl.MaxPerBucket == 0 {
+		return DefaultMaxPerBucket
+	}
+
+	return dl.MaxPerBucket
+}
+
+func (dl DiversityLimits) maxPerTable() int {
+	if dl.MaxPerTable == 0 {
+		return DefaultMaxPerTable
+	}
+
+	return dl.MaxPerTable
+}
+
+// Returned when an entry is turned away as too many from its group are already
+// in its bucket, or the table.
+type DiversityError struct {
+	Group string
+	Scope string
+	Max   int
+}
+
+func (de *DiversityError) Error() string {
+	return fmt.Sprintf("Already %d entries from %s in the %s", de.Max, de.Group, de.Scope)
+}
+
+func (dl DiversityLimits) maxHostnamesPerBucket() int {
+	if dl.MaxHostnamesPerBucket == 0 {
+		return DefaultMaxHostnamesPerBucket
+	}
+
+	return dl.MaxHostnamesPerBucket
+}
+
+func (dl DiversityLimits) maxHostnamesPerTable() int {
+	if dl.MaxHostnamesPerTable == 0 {
+		return DefaultMaxHostnamesPerTable
+	}
+
+	return dl.MaxHostnamesPerTable
+}
+
+// The group for a host: its /24 for IPv4, its /48 for IPv6, otherwise the host
+// itself, for instance an onion service. Any port is ignored.
+func AddressGroup(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if host == "" {
+		return ""
+	}
+
+	ip := net.ParseIP(host)
+
+	switch {
+	case ip == nil:
+		return HostGroupPrefix + strings.ToLower(host)
+
+	case ip.To4() != nil:
+		return "ip4:" + ip.Mask(net.CIDRMask(24, 32)).String()
+
+	default:
+		return "ip6:" + ip.Mask(net.CIDRMask(48, 128)).String()
+	}
+}
+
+// Returns an error if adding s, in group, to bucket index would break the
+// limits. s is not counted against itself if it is already there. Must be
+// called with the lock held.
+func (ndb *NetDB) diverse(index int, s, group string) error {
+	if ndb.Grouper == nil || group == "" {
+		return nil
+	}
+
+	hostname := isHostname(group)
+	inBucket, hostnamesInBucket := 0, 0
+
+	for _, i := range ndb.table[index] {
+		is, _ := i.String()
+
+		if is == s {
+			continue
+		}
+
+		if ndb.groups[is] == group {
+			inBucket++
+		}
+
+		if isHostname(ndb.groups[is]) {
+			hostnamesInBucket++
+		}
+	}
+
+	if max := ndb.Diversity.maxPerBucket(); inBucket >= max {
+		return &DiversityError{group, "bucket", max}
+	}
+
+	if max := ndb.Diversity.maxHostnamesPerBucket(); hostname && hostnamesInBucket >= max {
+		return &DiversityError{"hostnames", "bucket", max}
+	}
+
+	inTable, hostnames := ndb.groupSizes[group], ndb.hostnames
+
+	if ndb.groups[s] == group {
+		inTable--
+	}
+
+	if isHostname(ndb.groups[s]) {
+		hostnames--
+	}
+
+	if max := ndb.Diversity.maxPerTable(); inTable >= max {
+		return &DiversityError{group, "table", max}
+	}
+
+	if max := ndb.Diversity.maxHostnamesPerTable(); hostname && hostnames >= max {
+		return &DiversityError{"hostnames", "table", max}
+	}
+
+	return nil
+}
+
+func isHostname(group string) bool {
+	return strings.HasPrefix(group, HostGroupPrefix)
+}
+
+// Must be called with the lock held.
+func (ndb *NetDB) setGroup(s, group string) {
+	ndb.removeGroup(s)
+
+	if group == "" {
+		return
+	}
+
+	ndb.groups[s] = group
+	ndb.groupSizes[group]++
+
+	if isHostname(group) {
+		ndb.hostnames++
+	}
+}
+
+// Must be called with the lock held.
+func (ndb *NetDB) removeGroup(s string) {
+	group, ok := ndb.groups[s]
+
+	if !ok {
+		return
+	}
+
+	delete(ndb.groups, s)
+	ndb.groupSizes[group]--
+
+	if isHostname(group) {
+		ndb.hostnames--
+	}
+
+	if ndb.groupSizes[group] <= 0 {
+		delete(ndb.groupSizes, group)
+	}
+}
+
+// Must be called with the lock held.
+func (ndb *NetDB) group(kv *KeyValue) string {
+	if ndb.Grouper == nil {
+		return ""
+	}
+
+	return ndb.Grouper.Group(kv)
+}
+
+// Works out the group of everything in the table again, for when the table or
+// Grouper has changed. Tables already over the limits are left as they are,
+// they even out as entries come and go. Must be called with the lock held.
+func (ndb *NetDB) regroup() {
+	ndb.groups = make(map[string]string)
+	ndb.groupSizes = make(map[string]int)
+	ndb.hostnames = 0
+
+	if ndb.Grouper == nil {
+		return
+	}
+
+	for _, bucket := range ndb.table {
+		for _, i := range bucket {
+			s, _ := i.String()
+			value, err := ndb.database.Read(s)
+
+			if err != nil {
+				continue
+			}
+
+			ndb.setGroup(s, ndb.group(NewKeyValue(i, value)))
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package dht_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/zif/zif/dht"
+)
+
+// Groups by value, so that tests can choose the group of each entry.
+type valueGrouper struct{}
+
+func (valueGrouper) Group(kv *dht.KeyValue) string {
+	return string(kv.Value())
+}
+
+func TestAddressGroup(t *testing.T) {
+	same := [][2]string{
+		{"192.168.1.1", "192.168.1.254"},
+		{"192.168.1.1:5050", "192.168.1.2"},
+		{"2001:db8:1::1", "2001:db8:1:ffff::1"},
+		{"[2001:db8:1::1]:5050", "2001:db8:1::2"},
+		{"abcdef.onion", "ABCDEF.onion"},
+	}
+
+	for _, i := range same {
+		if dht.AddressGroup(i[0]) != dht.AddressGroup(i[1]) {
+			t.Errorf("%s and %s in different groups", i[0], i[1])
+		}
+	}
+
+	different := [][2]string{
+		{"192.168.1.1", "192.168.2.1"},
+		{"2001:db8:1::1", "2001:db8:2::1"},
+		{"abcdef.onion", "abcdeg.onion"},
+	}
+
+	for _, i := range different {
+		if dht.AddressGroup(i[0]) == dht.AddressGroup(i[1]) {
+			t.Errorf("%s and %s in the same group", i[0], i[1])
+		}
+	}
+
+	if dht.AddressGroup("") != "" {
+		t.Error("Empty address given a group")
+	}
+}
+
+func TestNetDBDiversity(t *testing.T) {
+	db, cl := newDB()
+	defer cl()
+
+	db.Grouper = valueGrouper{}
+	db.Diversity = dht.DiversityLimits{MaxPerBucket: 2, MaxPerTable: 3}
+
+	r := rand.New(rand.NewSource(1))
+	as := furthestBucket(r, 4)
+
+	for _, i := range as[:2] {
+		if err := db.Insert(dht.NewKeyValue(i, []byte("a"))); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	err := db.Insert(dht.NewKeyValue(as[2], []byte("a")))
+
+	if de, ok := err.(*dht.DiversityError); !ok || de.Scope != "bucket" {
+		t.Fatalf("Expected the bucket to be full for a, got %v", err)
+	}
+
+	// Another bucket still has room, until the table is full.
+	near := dht.Address{Raw: append([]byte{}, addr.Raw...)}
+	near.Raw[dht.AddressBinarySize-1] ^= 1
+
+	if err = db.Insert(dht.NewKeyValue(near, []byte("a"))); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	near.Raw[dht.AddressBinarySize-1] ^= 3
+	err = db.Insert(dht.NewKeyValue(near, []byte("a")))
+
+	if de, ok := err.(*dht.DiversityError); !ok || de.Scope != "table" {
+		t.Fatalf("Expected the table to be full for a, got %v", err)
+	}
+
+	// Entries already in the table are not counted against themselves, and
+	// moving one to another group makes room.
+	if err = db.Insert(dht.NewKeyValue(as[0], []byte("a"))); err != nil {
+		t.Error(err.Error())
+	}
+
+	if err = db.Insert(dht.NewKeyValue(as[1], []byte("b"))); err != nil {
+		t.Error(err.Error())
+	}
+
+	if err = db.Insert(dht.NewKeyValue(as[2], []byte("a"))); err != nil {
+		t.Error(err.Error())
+	}
+
+	// Entries with no group are never limited.
+	if err = db.Insert(dht.NewKeyValue(as[3], []byte{})); err != nil {
+		t.Error(err.Error())
+	}
+
+	if db.TableLen() != 5 {
+		t.Errorf("TableLen not correct: %d, expected: 5", db.TableLen())
+	}
+}
+
+// However many names there are, only so many entries grouped by hostname are
+// let in.
+func TestNetDBHostnames(t *testing.T) {
+	db, cl := newDB()
+	defer cl()
+
+	db.Grouper = valueGrouper{}
+	db.Diversity = dht.DiversityLimits{MaxHostnamesPerBucket: 2, MaxHostnamesPerTable: 3}
+
+	r := rand.New(rand.NewSource(2))
+	as := furthestBucket(r, 4)
+
+	for n, i := range as[:2] {
+		if err := db.Insert(dht.NewKeyValue(i, []byte(fmt.Sprintf("host:%d", n)))); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	err := db.Insert(dht.NewKeyValue(as[2], []byte("host:2")))
+
+	if de, ok := err.(*dht.DiversityError); !ok || de.Scope != "bucket" {
+		t.Fatalf("Expected the bucket to be full of hostnames, got %v", err)
+	}
+
+	// Entries grouped by IP are not counted.
+	if err = db.Insert(dht.NewKeyValue(as[2], []byte("ip4:10.0.0.0"))); err != nil {
+		t.Error(err.Error())
+	}
+
+	near := dht.Address{Raw: append([]byte{}, addr.Raw...)}
+	near.Raw[dht.AddressBinarySize-1] ^= 1
+
+	if err = db.Insert(dht.NewKeyValue(near, []byte("host:3"))); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	near.Raw[dht.AddressBinarySize-1] ^= 3
+	err = db.Insert(dht.NewKeyValue(near, []byte("host:4")))
+
+	if de, ok := err.(*dht.DiversityError); !ok || de.Scope != "table" {
+		t.Fatalf("Expected the table to be full of hostnames, got %v", err)
+	}
+}
+
+func TestDiversityLimitsCheck(t *testing.T) {
+	if err := (dht.DiversityLimits{}).Check(); err != nil {
+		t.Error(err.Error())
+	}
+
+	for _, i := range []dht.DiversityLimits{
+		{MaxPerBucket: -1},
+		{MaxPerTable: -1},
+		{MaxHostnamesPerBucket: -1},
+		{MaxHostnamesPerTable: -1},
+	} {
+		if i.Check() == nil {
+			t.Errorf("Negative limits accepted: %+v", i)
+		}
+	}
+}
+
+// Answers with nothing, recording who was asked in order.
+type recordingNetwork struct {
+	lock  sync.Mutex
+	asked []string
+}
+
+func (rn *recordingNetwork) FindValue(ctx context.Context, node *dht.KeyValue, target dht.Address) (*dht.KeyValue, dht.Pairs, error) {
+	rn.lock.Lock()
+	defer rn.lock.Unlock()
+
+	rn.asked = append(rn.asked, string(node.Value()))
+
+	return nil, nil, nil
+}
+
+func TestLookupDiversity(t *testing.T) {
+	target := addr
+	start := make(dht.Pairs, 0)
+
+	// The closest nodes to the target are all from one group.
+	for i := 0; i < 12; i++ {
+		raw := append([]byte{}, target.Raw...)
+		raw[dht.AddressBinarySize-1] ^= byte(i + 1)
+
+		group := "sybil"
+
+		if i >= 6 {
+			group = fmt.Sprintf("honest%d", i)
+		}
+
+		start = append(start, dht.NewKeyValue(dht.Address{Raw: raw}, []byte(group)))
+	}
+
+	rn := &recordingNetwork{}
+	lookup := dht.Lookup{Network: rn, Alpha: 1, Grouper: valueGrouper{}, MaxPerGroup: 2}
+
+	if _, _, err := lookup.Find(context.Background(), addr2, target, start); err != dht.ErrNotFound {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+
+	if len(rn.asked) != 12 {
+		t.Fatalf("Asked %d nodes, expected 12", len(rn.asked))
+	}
+
+	sybils := 0
+
+	for _, i := range rn.asked[:8] {
+		if i == "sybil" {
+			sybils++
+		}
+	}
+
+	if sybils != 2 {
+		t.Errorf("Asked %d of one group before anyone else: %v", sybils, rn.asked)
+	}
+}
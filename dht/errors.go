@@ -17,3 +17,13 @@ type NoCapacity struct {
 func (nc *NoCapacity) Error() string {
 	return fmt.Sprintf("Out of capacity, max: %d", nc.Max)
 }
+
+// Returned when the Validator turns a value away.
+type Rejected struct {
+	Key    string
+	Reason error
+}
+
+func (r *Rejected) Error() string {
+	return fmt.Sprintf("Rejected value for %s: %s", r.Key, r.Reason.Error())
+}
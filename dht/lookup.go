@@ -0,0 +1,348 @@
+// Iterative Kademlia lookups. A shortlist of the closest nodes seen so far is
+// kept sorted by distance to the target, and up to Alpha of the closest that
+// have not yet been asked are queried at once. Each answers with the value if
+// it has it, otherwise the closest nodes it knows of, which go back into the
+// shortlist. The lookup ends once the closest nodes have all been asked, as
+// then asking anyone else cannot get any closer.
+//
+// Given a Grouper, only so many nodes from one group are asked while there are
+// others to ask. A group of nodes run by one operator can then only answer a
+// few of our queries, unless there is no one else.
+//
+// Values can also be looked for along several disjoint paths at once, as in
+// S/Kademlia. Each path has its own shortlist, and a node is only ever asked
+// by one of them, so a single bad node can only mislead one path.
+
+package dht
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+const (
+	// How many nodes are queried at once.
+	Alpha = 3
+
+	// How many disjoint paths FindDisjoint takes if not told otherwise.
+	DefaultPaths = 3
+)
+
+// How a lookup talks to other nodes, so that it can be run without a real
+// network. Nodes are given as the pairs held for them in the routing table.
+type Network interface {
+	// Asks node for the value stored under target. If it does not have it,
+	// it should return the closest pairs to target that it knows of instead.
+	FindValue(ctx context.Context, node *KeyValue, target Address) (*KeyValue, Pairs, error)
+}
+
+// Returned when every node that could be asked has been, without the value
+// being found.
+var ErrNotFound = errors.New("Address could not be found")
+
+type Lookup struct {
+	Network Network
+
+	// How many nodes to query at once, defaults to Alpha.
+	Alpha int
+
+	// How many of the closest nodes must have answered before the lookup
+	// ends, defaults to BucketSize.
+	Size int
+
+	// If set, at most MaxPerGroup nodes from a group are asked before nodes
+	// from other groups. MaxPerGroup defaults to DefaultMaxPerBucket.
+	Grouper     Grouper
+	MaxPerGroup int
+}
+
+// The state of a node in the shortlist.
+const (
+	unqueried = iota
+	inflight
+	queried
+	failed
+)
+
+type candidate struct {
+	kv    *KeyValue
+	group string
+	state int
+}
+
+type lookupResult struct {
+	c     *candidate
+	value *KeyValue
+	pairs Pairs
+	err   error
+}
+
+// Looks for target starting from the pairs given, never querying self. The
+// value is returned if a node had it, along with the closest nodes that
+// answered, closest first. If the value was not found err is ErrNotFound, but
+// the closest nodes are still returned.
+func (l *Lookup) Find(ctx context.Context, self, target Address, start Pairs) (*KeyValue, Pairs, error) {
+	return l.find(ctx, self, target, start, true, nil)
+}
+
+// Looks for target along paths disjoint paths, DefaultPaths if not positive.
+// The start pairs are shared between the paths, closest first, and from then
+// on no node is asked by more than one path, other than target itself. Every
+// value found is returned, at most one per path, for the caller to check
+// against each other. err is ErrNotFound only if no path found a value.
+func (l *Lookup) FindDisjoint(ctx context.Context, self, target Address, start Pairs, paths int) (Pairs, error) {
+	if paths <= 0 {
+		paths = DefaultPaths
+	}
+
+	sorted := make(Pairs, 0, len(start))
+
+	for _, i := range start {
+		if i != nil && i.Valid() {
+			sorted = append(sorted, i)
+		}
+	}
+
+	sort.SliceStable(sorted, func(a, b int) bool {
+		return sorted[a].Key().Xor(&target).Less(sorted[b].Key().Xor(&target))
+	})
+
+	var lock sync.Mutex
+	owners := make(map[string]int)
+	starts := make([]Pairs, paths)
+
+	for n, i := range sorted {
+		s, _ := i.Key().String()
+
+		if _, ok := owners[s]; !ok {
+			owners[s] = n % paths
+			starts[n%paths] = append(starts[n%paths], i)
+		}
+	}
+
+	values := make(chan *KeyValue, paths)
+
+	for path := range starts {
+		// A path may only add nodes no other path has.
+		claim := func(path int) func(*KeyValue) bool {
+			return func(kv *KeyValue) bool {
+				if kv.Key().Equals(&target) {
+					return true
+				}
+
+				s, _ := kv.Key().String()
+
+				lock.Lock()
+				defer lock.Unlock()
+
+				owner, ok := owners[s]
+
+				if !ok {
+					owners[s] = path
+				}
+
+				return !ok || owner == path
+			}
+		}(path)
+
+		go func(start Pairs) {
+			value, _, _ := l.find(ctx, self, target, start, true, claim)
+			values <- value
+		}(starts[path])
+	}
+
+	ret := make(Pairs, 0, paths)
+
+	for range starts {
+		if value := <-values; value != nil {
+			ret = append(ret, value)
+		}
+	}
+
+	if len(ret) == 0 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, ErrNotFound
+	}
+
+	return ret, nil
+}
+
+// Finds the closest nodes to target that answer, whether or not any of them
+// hold a value for it. Used to find who to store a value with.
+func (l *Lookup) FindNodes(ctx context.Context, self, target Address, start Pairs) (Pairs, error) {
+	_, closest, err := l.find(ctx, self, target, start, false, nil)
+
+	if err == ErrNotFound {
+		err = nil
+	}
+
+	return closest, err
+}
+
+// Nodes are only added to the shortlist if claim, when given, returns true.
+func (l *Lookup) find(ctx context.Context, self, target Address, start Pairs, value bool, claim func(*KeyValue) bool) (*KeyValue, Pairs, error) {
+	alpha, size, perGroup := l.Alpha, l.Size, l.MaxPerGroup
+
+	if alpha <= 0 {
+		alpha = Alpha
+	}
+
+	if size <= 0 {
+		size = BucketSize
+	}
+
+	if perGroup <= 0 {
+		perGroup = DefaultMaxPerBucket
+	}
+
+	shortlist := make([]*candidate, 0, size*2)
+	seen := make(map[string]bool)
+
+	// How many nodes from each group have been asked.
+	asked := make(map[string]int)
+
+	add := func(pairs Pairs) {
+		for _, i := range pairs {
+			if i == nil || !i.Valid() || i.Key().Equals(&self) {
+				continue
+			}
+
+			s, _ := i.Key().String()
+
+			if seen[s] || (claim != nil && !claim(i)) {
+				continue
+			}
+
+			seen[s] = true
+
+			kv := NewKeyValue(*i.Key(), i.Value())
+			kv.distance = *kv.Key().Xor(&target)
+
+			c := &candidate{kv: kv}
+
+			if l.Grouper != nil {
+				c.group = l.Grouper.Group(kv)
+			}
+
+			shortlist = append(shortlist, c)
+		}
+
+		sort.SliceStable(shortlist, func(a, b int) bool {
+			return shortlist[a].kv.distance.Less(&shortlist[b].kv.distance)
+		})
+	}
+
+	// The closest nodes yet to be asked, only looking as far as the closest
+	// size that have not failed. Unless any is set, nodes from groups that
+	// have had perGroup asked are passed over.
+	next := func(n int, any bool) []*candidate {
+		ret := make([]*candidate, 0, n)
+		taken := make(map[string]int)
+		count := 0
+
+		for _, i := range shortlist {
+			if count >= size || len(ret) >= n {
+				break
+			}
+
+			if i.state == failed {
+				continue
+			}
+
+			count++
+
+			if i.state != unqueried {
+				continue
+			}
+
+			if !any && i.group != "" && asked[i.group]+taken[i.group] >= perGroup {
+				continue
+			}
+
+			taken[i.group]++
+			ret = append(ret, i)
+		}
+
+		return ret
+	}
+
+	add(start)
+
+	// Never more than alpha in flight, so those still running when we return
+	// can always send their result.
+	results := make(chan lookupResult, alpha)
+	running := 0
+
+	for {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+
+		batch := next(alpha-running, false)
+
+		// Only nodes from groups already asked are left.
+		if len(batch) == 0 && running == 0 {
+			batch = next(alpha, true)
+		}
+
+		for _, i := range batch {
+			i.state = inflight
+			asked[i.group]++
+			running++
+
+			go func(c *candidate) {
+				value, pairs, err := l.Network.FindValue(ctx, c.kv, target)
+				results <- lookupResult{c, value, pairs, err}
+			}(i)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		select {
+		case res := <-results:
+			running--
+
+			if res.err != nil {
+				res.c.state = failed
+				continue
+			}
+
+			res.c.state = queried
+
+			if value && res.value != nil && res.value.Key().Equals(&target) {
+				return res.value, closest(shortlist, size), nil
+			}
+
+			add(res.pairs)
+
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	return nil, closest(shortlist, size), ErrNotFound
+}
+
+// Up to n of the closest nodes that answered.
+func closest(shortlist []*candidate, n int) Pairs {
+	ret := make(Pairs, 0, n)
+
+	for _, i := range shortlist {
+		if len(ret) >= n {
+			break
+		}
+
+		if i.state == queried {
+			ret = append(ret, i.kv)
+		}
+	}
+
+	return ret
+}
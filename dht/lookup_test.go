@@ -0,0 +1,348 @@
+package dht_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zif/zif/dht"
+)
+
+// A network held in memory. Every node has a routing table of up to k nodes
+// per bucket, and holds its own value.
+type testNetwork struct {
+	nodes map[string]*testNode
+
+	// Nodes that fail every query.
+	down map[string]bool
+
+	running, maxRunning, queries int32
+}
+
+type testNode struct {
+	kv    *dht.KeyValue
+	known dht.Pairs
+}
+
+func newTestNetwork(n, k int, r *rand.Rand) (*testNetwork, dht.Pairs) {
+	tn := &testNetwork{nodes: make(map[string]*testNode), down: make(map[string]bool)}
+	all := make(dht.Pairs, n)
+
+	for i := range all {
+		raw := make([]byte, dht.AddressBinarySize)
+		r.Read(raw)
+
+		addr := dht.Address{Raw: raw}
+		all[i] = dht.NewKeyValue(addr, raw)
+
+		s, _ := addr.String()
+		tn.nodes[s] = &testNode{kv: all[i]}
+	}
+
+	for _, i := range tn.nodes {
+		buckets := make(map[int]int)
+
+		for _, j := range r.Perm(n) {
+			if all[j] == i.kv {
+				continue
+			}
+
+			bucket := all[j].Key().Xor(i.kv.Key()).LeadingZeroes()
+
+			if buckets[bucket] < k {
+				buckets[bucket]++
+				i.known = append(i.known, all[j])
+			}
+		}
+	}
+
+	return tn, all
+}
+
+func (tn *testNetwork) FindValue(ctx context.Context, node *dht.KeyValue, target dht.Address) (*dht.KeyValue, dht.Pairs, error) {
+	running := atomic.AddInt32(&tn.running, 1)
+	defer atomic.AddInt32(&tn.running, -1)
+	atomic.AddInt32(&tn.queries, 1)
+
+	for {
+		max := atomic.LoadInt32(&tn.maxRunning)
+
+		if running <= max || atomic.CompareAndSwapInt32(&tn.maxRunning, max, running) {
+			break
+		}
+	}
+
+	// Long enough that queries overlap.
+	time.Sleep(time.Millisecond)
+
+	s, _ := node.Key().String()
+
+	if tn.down[s] {
+		return nil, nil, errors.New("Node down")
+	}
+
+	n := tn.nodes[s]
+
+	if node.Key().Equals(&target) {
+		return n.kv, nil, nil
+	}
+
+	return nil, bruteClosest(n.known, target, dht.BucketSize), nil
+}
+
+func bruteClosest(pairs dht.Pairs, target dht.Address, k int) dht.Pairs {
+	ret := make(dht.Pairs, len(pairs))
+	copy(ret, pairs)
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Key().Xor(&target).Less(ret[j].Key().Xor(&target))
+	})
+
+	if len(ret) > k {
+		ret = ret[:k]
+	}
+
+	return ret
+}
+
+func TestLookupFind(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tn, all := newTestNetwork(500, 4, r)
+
+	for i := 0; i < 20; i++ {
+		target := all[r.Intn(len(all))]
+		start := dht.Pairs{all[r.Intn(len(all))]}
+
+		lookup := dht.Lookup{Network: tn}
+		kv, _, err := lookup.Find(context.Background(), addr, *target.Key(), start)
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if !kv.Key().Equals(target.Key()) {
+			t.Fatal("Lookup returned the wrong value")
+		}
+	}
+
+	if tn.maxRunning > dht.Alpha {
+		t.Errorf("%d queries ran at once", tn.maxRunning)
+	}
+
+	if tn.maxRunning < 2 {
+		t.Error("Queries did not run in parallel")
+	}
+}
+
+func TestLookupNotFound(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	tn, all := newTestNetwork(500, 4, r)
+
+	raw := make([]byte, dht.AddressBinarySize)
+	r.Read(raw)
+	target := dht.Address{Raw: raw}
+
+	lookup := dht.Lookup{Network: tn, Alpha: 5, Size: 8}
+	kv, closest, err := lookup.Find(context.Background(), addr, target, all[:3])
+
+	if err != dht.ErrNotFound || kv != nil {
+		t.Fatal("Lookup for a missing value did not fail")
+	}
+
+	if tn.maxRunning > 5 {
+		t.Errorf("%d queries ran at once", tn.maxRunning)
+	}
+
+	// It should stop once the closest stop improving, well before it has
+	// asked everyone.
+	if int(tn.queries) >= len(all)/2 {
+		t.Errorf("Lookup made %d queries", tn.queries)
+	}
+
+	if len(closest) != 8 {
+		t.Fatalf("Lookup returned %d closest", len(closest))
+	}
+
+	if !sort.SliceIsSorted(closest, func(i, j int) bool {
+		return closest[i].Key().Xor(&target).Less(closest[j].Key().Xor(&target))
+	}) {
+		t.Error("Closest not sorted by distance")
+	}
+
+	// Tables are full near each node, so the lookup ought to find the very
+	// closest node in the network.
+	if !closest[0].Key().Equals(bruteClosest(all, target, 1)[0].Key()) {
+		t.Error("Lookup did not find the closest node")
+	}
+}
+
+func TestLookupFailures(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	tn, all := newTestNetwork(300, 4, r)
+	target := all[0]
+
+	// A third of the network is unreachable, but not the target.
+	for _, i := range all[1:100] {
+		s, _ := i.Key().String()
+		tn.down[s] = true
+	}
+
+	lookup := dht.Lookup{Network: tn}
+	kv, _, err := lookup.Find(context.Background(), addr, *target.Key(), all[95:105])
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !kv.Key().Equals(target.Key()) {
+		t.Error("Lookup returned the wrong value")
+	}
+}
+
+type blockingNetwork struct {
+	once sync.Once
+	in   chan struct{}
+}
+
+func (bn *blockingNetwork) FindValue(ctx context.Context, node *dht.KeyValue, target dht.Address) (*dht.KeyValue, dht.Pairs, error) {
+	bn.once.Do(func() { close(bn.in) })
+	<-ctx.Done()
+
+	return nil, nil, ctx.Err()
+}
+
+func TestLookupCancel(t *testing.T) {
+	bn := &blockingNetwork{in: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		<-bn.in
+		cancel()
+	}()
+
+	lookup := dht.Lookup{Network: bn}
+	_, _, err := lookup.Find(ctx, addr, addr2, dht.Pairs{dht.NewKeyValue(addr2, addr2.Raw)})
+
+	if err != context.Canceled {
+		t.Errorf("Lookup returned %v once cancelled", err)
+	}
+}
+
+// Counts how many times each node is asked.
+type countingNetwork struct {
+	*testNetwork
+
+	lock  sync.Mutex
+	asked map[string]int
+}
+
+func (cn *countingNetwork) FindValue(ctx context.Context, node *dht.KeyValue, target dht.Address) (*dht.KeyValue, dht.Pairs, error) {
+	s, _ := node.Key().String()
+
+	cn.lock.Lock()
+	cn.asked[s]++
+	cn.lock.Unlock()
+
+	return cn.testNetwork.FindValue(ctx, node, target)
+}
+
+func TestLookupFindDisjoint(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	tn, all := newTestNetwork(500, 4, r)
+
+	for i := 0; i < 10; i++ {
+		cn := &countingNetwork{testNetwork: tn, asked: make(map[string]int)}
+		target := all[r.Intn(len(all))]
+		start := make(dht.Pairs, 0)
+
+		for _, j := range r.Perm(len(all))[:9] {
+			start = append(start, all[j])
+		}
+
+		lookup := dht.Lookup{Network: cn}
+		values, err := lookup.FindDisjoint(context.Background(), addr, *target.Key(), start, 3)
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if len(values) < 2 || len(values) > 3 {
+			t.Errorf("Found %d values along 3 paths", len(values))
+		}
+
+		for _, v := range values {
+			if !v.Key().Equals(target.Key()) {
+				t.Fatal("Lookup returned the wrong value")
+			}
+		}
+
+		ts, _ := target.Key().String()
+
+		// Queries may still be running once the value is found.
+		cn.lock.Lock()
+
+		for s, n := range cn.asked {
+			if s != ts && n > 1 {
+				t.Errorf("%s was asked by %d paths", s, n)
+			}
+		}
+
+		cn.lock.Unlock()
+	}
+}
+
+// What we hold ourselves may be out of date, so the network is still asked.
+func TestDHTLookupDisjoint(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "zif")
+	defer os.RemoveAll(dir)
+
+	r := rand.New(rand.NewSource(6))
+	tn, all := newTestNetwork(200, 4, r)
+	d := dht.NewDHT(addr, dir)
+	target := all[r.Intn(len(all))]
+
+	values, err := d.LookupDisjoint(context.Background(), tn, *target.Key(), 3)
+
+	if err == nil {
+		t.Errorf("Found %d values in an empty table", len(values))
+	}
+
+	local := dht.NewKeyValue(*target.Key(), []byte("local"))
+
+	if err = d.Insert(local); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	values, err = d.LookupDisjoint(context.Background(), tn, *target.Key(), 3)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(values) != 2 || string(values[1].Value()) != "local" {
+		t.Fatalf("Expected the network's value and our own, got %d values", len(values))
+	}
+
+	for _, i := range r.Perm(len(all))[:20] {
+		if all[i] != target {
+			d.Insert(all[i])
+		}
+	}
+
+	values, err = d.LookupDisjoint(context.Background(), tn, *target.Key(), 3)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(values) < 3 || string(values[len(values)-1].Value()) != "local" {
+		t.Errorf("Expected values from the network and our own, got %d values", len(values))
+	}
+}
@@ -0,0 +1,255 @@
+// Keeping buckets healthy. A full bucket does not turn new entries away, they
+// wait in a replacement cache. The entry in the bucket least likely to still
+// be around is then checked, and replaced by the most recently seen
+// replacement if it does not answer. Entries that have answered before are
+// preferred, as those that have been up a while tend to stay up.
+
+package dht
+
+import "time"
+
+const (
+	// How many entries can wait for room in each bucket.
+	ReplacementCacheSize = BucketSize
+
+	// An entry that has not answered this many times in a row is replaced
+	// as soon as there is something to replace it with.
+	MaxUnanswered = 3
+
+	// How long an entry is kept without being seen again. Peers republish
+	// their entries well within this.
+	EntryTTL = time.Hour * 24
+)
+
+type LivenessChecker interface {
+	// Returns an error if the node kv belongs to could not be reached.
+	CheckLiveness(kv *KeyValue) error
+}
+
+// How many entries are waiting for room, across every bucket.
+func (ndb *NetDB) ReplacementLen() int {
+	ndb.lock.Lock()
+	defer ndb.lock.Unlock()
+
+	size := 0
+
+	for _, i := range ndb.replacements {
+		size += len(i)
+	}
+
+	return size
+}
+
+// How many times in a row addr has not answered.
+func (ndb *NetDB) Unanswered(addr Address) int {
+	ndb.lock.Lock()
+	defer ndb.lock.Unlock()
+
+	s, _ := addr.String()
+
+	return ndb.unanswered[s]
+}
+
+// Records that addr did not answer, outside of a liveness check. Once it has
+// failed MaxUnanswered times it is replaced, if there is a replacement.
+func (ndb *NetDB) Failed(addr Address) {
+	ndb.lock.Lock()
+	defer ndb.lock.Unlock()
+
+	s, _ := addr.String()
+	index := addr.Xor(&ndb.addr).LeadingZeroes()
+
+	if ndb.find(index, addr) == -1 {
+		return
+	}
+
+	ndb.unanswered[s]++
+
+	if ndb.unanswered[s] >= MaxUnanswered && len(ndb.replacements[index]) > 0 {
+		ndb.evict(index, addr)
+	}
+}
+
+func (ndb *NetDB) find(index int, addr Address) int {
+	for n, i := range ndb.table[index] {
+		if i.Equals(&addr) {
+			return n
+		}
+	}
+
+	return -1
+}
+
+// Most recently seen first, anything already waiting is moved to the front.
+func (ndb *NetDB) addReplacement(index int, kv *KeyValue) {
+	cache := ndb.replacements[index]
+
+	for n, i := range cache {
+		if i.Key().Equals(kv.Key()) {
+			cache = append(cache[:n], cache[n+1:]...)
+			break
+		}
+	}
+
+	cache = append([]*KeyValue{NewKeyValue(*kv.Key(), kv.Value())}, cache...)
+
+	if len(cache) > ReplacementCacheSize {
+		cache = cache[:ReplacementCacheSize]
+	}
+
+	ndb.replacements[index] = cache
+}
+
+// Checks the entry in a bucket that has gone unanswered most, or failing that
+// the one seen least recently. Only one entry per bucket is checked at a time.
+// Must be called with the lock held.
+func (ndb *NetDB) check(index int) {
+	bucket := ndb.table[index]
+
+	if ndb.checking[index] || len(bucket) == 0 {
+		return
+	}
+
+	oldest := bucket[len(bucket)-1]
+	s, _ := oldest.String()
+	worst := ndb.unanswered[s]
+
+	for i := len(bucket) - 2; i >= 0; i-- {
+		is, _ := bucket[i].String()
+
+		if ndb.unanswered[is] > worst {
+			oldest, s, worst = bucket[i], is, ndb.unanswered[is]
+		}
+	}
+
+	value, err := ndb.database.Read(s)
+
+	if err != nil {
+		// Nothing to check it with, it may as well go.
+		ndb.evict(index, oldest)
+		return
+	}
+
+	ndb.checking[index] = true
+	kv := NewKeyValue(oldest, value)
+
+	go func(checker LivenessChecker) {
+		err := checker.CheckLiveness(kv)
+
+		ndb.lock.Lock()
+		defer ndb.lock.Unlock()
+
+		delete(ndb.checking, index)
+
+		// It may have gone while we were checking.
+		if ndb.find(index, oldest) == -1 {
+			return
+		}
+
+		if err == nil {
+			ndb.seen[s] = time.Now()
+			ndb.insert(kv)
+			return
+		}
+
+		// Kept, though less healthy, if nothing is waiting to replace it.
+		ndb.unanswered[s]++
+
+		if len(ndb.replacements[index]) > 0 {
+			ndb.evict(index, oldest)
+		}
+	}(ndb.Checker)
+}
+
+// Removes addr from its bucket, and fills the space with the most recently
+// seen replacement. Must be called with the lock held.
+func (ndb *NetDB) evict(index int, addr Address) {
+	n := ndb.find(index, addr)
+
+	if n == -1 {
+		return
+	}
+
+	bucket := ndb.table[index]
+	ndb.table[index] = append(bucket[:n], bucket[n+1:]...)
+
+	s, _ := addr.String()
+	delete(ndb.unanswered, s)
+	delete(ndb.seen, s)
+	ndb.removeGroup(s)
+	ndb.database.Erase(s)
+
+	if cache := ndb.replacements[index]; len(cache) > 0 {
+		ndb.replacements[index] = cache[1:]
+		ndb.insert(cache[0])
+	}
+}
+
+// Removes every entry that has not been seen for ttl, filling the space with
+// replacements where there are any. Values stored for addresses that are no
+// longer in the table are removed too. Returns how many entries were culled.
+func (ndb *NetDB) Cull(ttl time.Duration) int {
+	ndb.lock.Lock()
+	defer ndb.lock.Unlock()
+
+	expired := func(s string) bool {
+		seen, ok := ndb.seen[s]
+		return !ok || time.Since(seen) > ttl
+	}
+
+	culled := 0
+	keep := make(map[string]bool)
+
+	for index := range ndb.replacements {
+		cache := ndb.replacements[index][:0]
+
+		for _, i := range ndb.replacements[index] {
+			s, _ := i.Key().String()
+
+			if !expired(s) {
+				cache = append(cache, i)
+				keep[s] = true
+			}
+		}
+
+		ndb.replacements[index] = cache
+	}
+
+	for index, bucket := range ndb.table {
+		for _, i := range append([]Address{}, bucket...) {
+			s, _ := i.String()
+
+			if expired(s) {
+				ndb.evict(index, i)
+				culled++
+			}
+		}
+
+		for _, i := range ndb.table[index] {
+			s, _ := i.String()
+			keep[s] = true
+		}
+	}
+
+	for s := range ndb.seen {
+		if !keep[s] {
+			delete(ndb.seen, s)
+		}
+	}
+
+	// Collected first, erasing while walking the keys is not safe. Anything
+	// that is not an address, like the saved table, is left alone.
+	orphans := make([]string, 0)
+
+	for s := range ndb.database.Keys(nil) {
+		if !keep[s] && IsAddress(s) {
+			orphans = append(orphans, s)
+		}
+	}
+
+	for _, s := range orphans {
+		ndb.database.Erase(s)
+	}
+
+	return culled
+}
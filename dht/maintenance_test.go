@@ -0,0 +1,305 @@
+package dht_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zif/zif/dht"
+)
+
+// Answers for every address except those marked down.
+type testChecker struct {
+	lock    sync.Mutex
+	down    map[string]bool
+	checked []dht.Address
+}
+
+func (tc *testChecker) CheckLiveness(kv *dht.KeyValue) error {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	tc.checked = append(tc.checked, *kv.Key())
+	s, _ := kv.Key().String()
+
+	if tc.down[s] {
+		return errors.New("No answer")
+	}
+
+	return nil
+}
+
+func (tc *testChecker) checks() []dht.Address {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	return append([]dht.Address{}, tc.checked...)
+}
+
+func (tc *testChecker) setDown(a dht.Address) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	s, _ := a.String()
+	tc.down[s] = true
+}
+
+// Random addresses that all go into the furthest bucket.
+func furthestBucket(r *rand.Rand, n int) []dht.Address {
+	ret := make([]dht.Address, n)
+
+	for i := range ret {
+		raw := make([]byte, dht.AddressBinarySize)
+		r.Read(raw)
+		raw[0] = raw[0]&0x7f | ^addr.Raw[0]&0x80
+
+		ret[i] = dht.Address{Raw: raw}
+	}
+
+	return ret
+}
+
+// Fills the furthest bucket, the first address is the least recently seen.
+func fullBucket(t *testing.T, db *dht.NetDB, r *rand.Rand) []dht.Address {
+	as := furthestBucket(r, dht.BucketSize)
+
+	for n, i := range as {
+		insert(t, db, i, n+1)
+	}
+
+	return as
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second * 5)
+
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNetDBReplacementCache(t *testing.T) {
+	db, cl := newDB()
+	defer cl()
+
+	r := rand.New(rand.NewSource(1))
+	fullBucket(t, db, r)
+
+	extra := furthestBucket(r, 1)[0]
+	err := db.Insert(dht.NewKeyValue(extra, extra.Raw))
+
+	if _, ok := err.(*dht.NoCapacity); !ok {
+		t.Error("Full bucket without a checker did not return NoCapacity")
+	}
+
+	if db.ReplacementLen() != 1 || db.Has(extra) {
+		t.Error("Entry not held as a replacement")
+	}
+
+	// The same entry again should not take up more room.
+	db.Insert(dht.NewKeyValue(extra, extra.Raw))
+
+	if db.ReplacementLen() != 1 {
+		t.Error("Replacement cached twice")
+	}
+}
+
+func TestNetDBEvictDead(t *testing.T) {
+	db, cl := newDB()
+	defer cl()
+
+	checker := &testChecker{down: make(map[string]bool)}
+	db.Checker = checker
+
+	r := rand.New(rand.NewSource(2))
+	as := fullBucket(t, db, r)
+	checker.setDown(as[0])
+
+	extra := furthestBucket(r, 1)[0]
+
+	if err := db.Insert(dht.NewKeyValue(extra, extra.Raw)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	waitFor(t, func() bool { return db.Has(extra) })
+
+	if db.Has(as[0]) {
+		t.Error("Dead entry not evicted")
+	}
+
+	if db.TableLen() != dht.BucketSize || db.ReplacementLen() != 0 {
+		t.Error("Replacement not moved into the bucket")
+	}
+
+	if !checker.checks()[0].Equals(&as[0]) {
+		t.Error("Least recently seen entry was not the one checked")
+	}
+}
+
+func TestNetDBKeepLive(t *testing.T) {
+	db, cl := newDB()
+	defer cl()
+
+	checker := &testChecker{down: make(map[string]bool)}
+	db.Checker = checker
+
+	r := rand.New(rand.NewSource(3))
+	as := fullBucket(t, db, r)
+
+	extra := furthestBucket(r, 1)[0]
+	db.Insert(dht.NewKeyValue(extra, extra.Raw))
+
+	waitFor(t, func() bool { return len(checker.checks()) == 1 })
+
+	// Having answered, it is now the most recently seen, so checked last.
+	waitFor(t, func() bool {
+		return db.Recent(1)[0].Key().Equals(&as[0])
+	})
+
+	if db.Has(extra) || db.ReplacementLen() != 1 {
+		t.Error("Live entry replaced")
+	}
+}
+
+func TestNetDBUnanswered(t *testing.T) {
+	db, cl := newDB()
+	defer cl()
+
+	r := rand.New(rand.NewSource(4))
+	as := fullBucket(t, db, r)
+
+	// Nothing to replace it with, so it stays however unhealthy.
+	for i := 0; i < dht.MaxUnanswered; i++ {
+		db.Failed(as[5])
+	}
+
+	if !db.Has(as[5]) || db.Unanswered(as[5]) != dht.MaxUnanswered {
+		t.Fatal("Unanswered entry not kept")
+	}
+
+	extra := furthestBucket(r, 1)[0]
+	db.Insert(dht.NewKeyValue(extra, extra.Raw))
+	db.Failed(as[5])
+
+	if db.Has(as[5]) || !db.Has(extra) {
+		t.Error("Unhealthy entry not replaced")
+	}
+
+	// The least healthy entry is checked first, not the oldest.
+	checker := &testChecker{down: make(map[string]bool)}
+	db.Checker = checker
+	db.Failed(as[7])
+
+	another := furthestBucket(r, 1)[0]
+	db.Insert(dht.NewKeyValue(another, another.Raw))
+
+	waitFor(t, func() bool { return len(checker.checks()) == 1 })
+
+	if !checker.checks()[0].Equals(&as[7]) {
+		t.Error("Least healthy entry was not the one checked")
+	}
+
+	// Seeing it again makes it healthy.
+	waitFor(t, func() bool { return db.Unanswered(as[7]) == 0 })
+}
+
+func TestNetDBCull(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "zif")
+	defer os.RemoveAll(dir)
+
+	db := dht.NewNetDB(addr, dir)
+	r := rand.New(rand.NewSource(5))
+	as := furthestBucket(r, 3)
+
+	insert(t, db, as[0], 1)
+	time.Sleep(time.Millisecond * 50)
+	insert(t, db, as[1], 2)
+
+	if culled := db.Cull(time.Millisecond * 25); culled != 1 {
+		t.Errorf("Culled %d entries", culled)
+	}
+
+	if db.Has(as[0]) || !db.Has(as[1]) {
+		t.Error("Wrong entry culled")
+	}
+
+	// Values left behind by an old table are culled too, but not the table.
+	insert(t, db, as[2], 2)
+	table := filepath.Join(dir, "table.dat")
+	db.SaveTable(table)
+
+	db = dht.NewNetDB(addr, dir)
+	db.Cull(time.Hour)
+
+	if db.Has(as[1]) || db.Has(as[2]) {
+		t.Error("Values not in the table were kept")
+	}
+
+	if _, err := os.Stat(table); err != nil {
+		t.Error("Saved table culled")
+	}
+}
+
+func TestNetDBLoadTable(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "zif")
+	defer os.RemoveAll(dir)
+
+	db := dht.NewNetDB(addr, dir)
+	r := rand.New(rand.NewSource(6))
+	as := furthestBucket(r, 2)
+	table := filepath.Join(dir, "table.dat")
+
+	insert(t, db, as[0], 1)
+	time.Sleep(time.Millisecond * 50)
+	db.SaveTable(table)
+
+	// When entries were seen is kept.
+	db = dht.NewNetDB(addr, dir)
+	db.LoadTable(table)
+
+	if db.TableLen() != 1 || db.Cull(time.Millisecond*25) != 1 {
+		t.Error("Seen time not loaded")
+	}
+
+	// Old tables were just the buckets, and are given a full TTL.
+	buckets := make([][]dht.Address, dht.AddressBinarySize*8)
+	buckets[0] = as
+
+	dat, _ := json.Marshal(buckets)
+	ioutil.WriteFile(table, dat, 0644)
+
+	db = dht.NewNetDB(addr, dir)
+	db.LoadTable(table)
+
+	if db.TableLen() != 2 || db.Cull(time.Millisecond*25) != 0 {
+		t.Error("Old table not loaded")
+	}
+}
+
+func TestIsAddress(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+
+	for _, i := range furthestBucket(r, 100) {
+		s, _ := i.String()
+
+		if !dht.IsAddress(s) {
+			t.Fatalf("%s is an address", s)
+		}
+	}
+
+	for _, i := range []string{"", "table.dat", "11111111111111111111111111111111"} {
+		if dht.IsAddress(i) {
+			t.Errorf("%q is not an address", i)
+		}
+	}
+}
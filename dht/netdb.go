@@ -3,9 +3,11 @@ package dht
 import (
 	"encoding/json"
 	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/peterbourgon/diskv"
-	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -13,9 +15,47 @@ const (
 )
 
 type NetDB struct {
+	lock     sync.Mutex
 	table    [][]Address
 	addr     Address
 	database *diskv.Diskv
+
+	// Entries waiting for room in a full bucket, most recently seen first.
+	replacements [][]*KeyValue
+
+	// How many pings in a row each address has not answered.
+	unanswered map[string]int
+
+	// Buckets that are having their oldest entry checked.
+	checking map[int]bool
+
+	// When each entry was last inserted, or answered a liveness check.
+	// Entries not seen for a while are culled.
+	seen map[string]time.Time
+
+	// The group of each entry in the table, and how many entries are in each
+	// group. Also how many are in a hostname group, whichever it is.
+	groups     map[string]string
+	groupSizes map[string]int
+	hostnames  int
+
+	// Used to check entries before they are evicted from a full bucket. If
+	// nil, entries are never evicted this way.
+	Checker LivenessChecker
+
+	// Every value inserted must pass this first. If nil, anything goes.
+	Validator Validator
+
+	// Used to limit how many entries from one group are in the table, see
+	// diversity.go. If nil, there are no limits.
+	Grouper   Grouper
+	Diversity DiversityLimits
+}
+
+type Validator interface {
+	// Returns an error if kv should not be stored. old is the value already
+	// held under the same key, nil if there is none.
+	Validate(kv *KeyValue, old []byte) error
 }
 
 func NewNetDB(addr Address, path string) *NetDB {
@@ -26,6 +66,13 @@ func NewNetDB(addr Address, path string) *NetDB {
 	// At the time of writing, uses roughly 64KB of memory
 	ret.table = make([][]Address, AddressBinarySize*8)
 
+	ret.replacements = make([][]*KeyValue, len(ret.table))
+	ret.unanswered = make(map[string]int)
+	ret.checking = make(map[int]bool)
+	ret.seen = make(map[string]time.Time)
+	ret.groups = make(map[string]string)
+	ret.groupSizes = make(map[string]int)
+
 	// allocate each bucket
 	for n, _ := range ret.table {
 		ret.table[n] = make([]Address, 0, BucketSize)
@@ -46,6 +93,9 @@ func NewNetDB(addr Address, path string) *NetDB {
 }
 
 func (ndb *NetDB) TableLen() int {
+	ndb.lock.Lock()
+	defer ndb.lock.Unlock()
+
 	size := 0
 
 	for _, i := range ndb.table {
@@ -55,17 +105,52 @@ func (ndb *NetDB) TableLen() int {
 	return size
 }
 
+// Adds kv to the front of its bucket, as the most recently seen. If the bucket
+// is full kv goes into its replacement cache instead, and the least healthy
+// entry in the bucket is checked. Should it not answer, it is replaced. Without
+// a Checker, NoCapacity is returned. Values the Validator refuses are not
+// stored at all, and Rejected is returned. Neither are values from a group
+// with too many entries already, DiversityError is returned for those.
 func (ndb *NetDB) Insert(kv *KeyValue) error {
+	s, _ := kv.Key().String()
+
 	if !kv.Valid() {
-		s, _ := kv.Key().String()
 		return &InvalidValue{s}
 	}
 
+	ndb.lock.Lock()
+	defer ndb.lock.Unlock()
+
+	if ndb.Validator != nil {
+		old, err := ndb.database.Read(s)
+
+		if err != nil {
+			old = nil
+		}
+
+		if err = ndb.Validator.Validate(kv, old); err != nil {
+			return &Rejected{s, err}
+		}
+	}
+
+	ndb.seen[s] = time.Now()
+
+	return ndb.insert(kv)
+}
+
+func (ndb *NetDB) insert(kv *KeyValue) error {
 	// Find the distance between the kv address and our own address, this is the
 	// index in the table
 	index := kv.Key().Xor(&ndb.addr).LeadingZeroes()
 	bucket := ndb.table[index]
 
+	s, _ := kv.Key().String()
+	group := ndb.group(kv)
+
+	if err := ndb.diverse(index, s, group); err != nil {
+		return err
+	}
+
 	// there is capacity, insert at the front
 	// search to see if it is already inserted
 
@@ -82,16 +167,26 @@ func (ndb *NetDB) Insert(kv *KeyValue) error {
 	if found != -1 {
 		bucket = append(bucket[:found], bucket[found+1:]...)
 	} else if len(bucket) == BucketSize {
-		// TODO: Ping all peers, remove any inactive
-		return &NoCapacity{BucketSize}
+		ndb.addReplacement(index, kv)
+
+		if ndb.Checker == nil {
+			return &NoCapacity{BucketSize}
+		}
+
+		ndb.check(index)
+
+		return nil
 	}
 
 	bucket = append([]Address{*kv.Key()}, bucket...)
 
 	ndb.table[index] = bucket
+	ndb.setGroup(s, group)
+
+	// Having been seen, it is healthy again.
+	delete(ndb.unanswered, s)
 
 	// key has been added to the routing table, now store the entry!
-	s, _ := kv.Key().String()
 	ndb.database.Write(s, kv.Value())
 
 	return nil
@@ -99,6 +194,9 @@ func (ndb *NetDB) Insert(kv *KeyValue) error {
 
 // Returns the KeyValue if this node has the address, nil and err otherwise.
 func (ndb *NetDB) Query(addr Address) (*KeyValue, error) {
+	ndb.lock.Lock()
+	defer ndb.lock.Unlock()
+
 	s, _ := addr.String()
 	if !ndb.database.Has(s) {
 		return nil, nil
@@ -113,7 +211,7 @@ func (ndb *NetDB) Query(addr Address) (*KeyValue, error) {
 	kv := NewKeyValue(addr, value)
 
 	// reinsert the kv, popular things will stay near the top
-	return kv, ndb.Insert(kv)
+	return kv, ndb.insert(kv)
 }
 
 func (ndb *NetDB) Has(addr Address) bool {
@@ -121,93 +219,151 @@ func (ndb *NetDB) Has(addr Address) bool {
 	return ndb.database.Has(s)
 }
 
-func (ndb *NetDB) queryAddresses(as []Address) Pairs {
-	ret := make(Pairs, 0, len(as))
+// Up to n of the most recently seen entries. Every bucket keeps its most
+// recently seen address at the front, so the front of each bucket is taken
+// first, then the next along, and so on. This spreads the sample across the
+// whole table rather than one corner of it.
+func (ndb *NetDB) Recent(n int) Pairs {
+	ndb.lock.Lock()
+	defer ndb.lock.Unlock()
 
-	for _, i := range as {
-		kv, err := ndb.Query(i)
+	ret := make(Pairs, 0, n)
 
-		if err != nil {
-			continue
-		}
+	for depth := 0; depth < BucketSize && len(ret) < n; depth++ {
+		for _, bucket := range ndb.table {
+			if len(ret) >= n {
+				break
+			}
 
-		ret = append(ret, kv)
+			if depth >= len(bucket) {
+				continue
+			}
+
+			// Read directly, querying would move the entry to the front.
+			s, _ := bucket[depth].String()
+			value, err := ndb.database.Read(s)
+
+			if err != nil {
+				continue
+			}
+
+			ret = append(ret, NewKeyValue(bucket[depth], value))
+		}
 	}
 
 	return ret
 }
 
+// The BucketSize closest entries to addr.
 func (ndb *NetDB) FindClosest(addr Address) (Pairs, error) {
-	// Find the distance between the kv address and our own address, this is the
-	// index in the table
-	index := addr.Xor(&ndb.addr).LeadingZeroes()
-	bucket := ndb.table[index]
+	return ndb.FindClosestN(addr, BucketSize)
+}
 
-	if len(bucket) == BucketSize {
-		return ndb.queryAddresses(bucket), nil
+// The k closest entries to addr, closest first.
+//
+// Where an address is in the table only depends on how far it is from us, so
+// the buckets can be taken in order of distance to addr. Entries in the bucket
+// addr would go in are closest. Entries in any bucket after that are all
+// equally far in the first bit they differ from addr, so come next together.
+// Then the buckets before it, each further away than the last.
+func (ndb *NetDB) FindClosestN(addr Address, k int) (Pairs, error) {
+	if k < 0 {
+		return nil, &InvalidValue{"k cannot be negative"}
 	}
 
-	ret := make(Pairs, 0, BucketSize)
+	ndb.lock.Lock()
+	defer ndb.lock.Unlock()
 
-	// Start with bucket, copy all across, then move left outwards checking all
-	// other buckets.
-	for i := 0; (index-i >= 0 || index+i <= len(addr.Raw)*8) &&
-		len(ret) < BucketSize; i++ {
+	index := addr.Xor(&ndb.addr).LeadingZeroes()
+	ret := make(Pairs, 0, k)
 
-		if index-i >= 0 {
-			bucket = ndb.table[index-i]
+	take := func(buckets [][]Address) {
+		group := make(Pairs, 0)
 
+		for _, bucket := range buckets {
 			for _, i := range bucket {
-				if len(bucket) >= BucketSize {
-					break
-				}
-
-				kv, err := ndb.Query(i)
+				// Read directly, querying would move the entry to the front.
+				s, _ := i.String()
+				value, err := ndb.database.Read(s)
 
 				if err != nil {
 					continue
 				}
 
-				ret = append(ret, kv)
+				kv := NewKeyValue(i, value)
+				kv.distance = *i.Xor(&addr)
+				group = append(group, kv)
 			}
 		}
 
-		if index+i < len(addr.Raw)*8 {
-			bucket = ndb.table[index+i]
-
-			for _, i := range bucket {
-				if len(bucket) >= BucketSize {
-					break
-				}
+		sort.Sort(group)
+		ret = append(ret, group...)
+	}
 
-				kv, err := ndb.Query(i)
+	take(ndb.table[index : index+1])
 
-				if err != nil {
-					continue
-				}
+	if len(ret) < k {
+		take(ndb.table[index+1:])
+	}
 
-				ret = append(ret, kv)
-			}
-		}
+	for i := index - 1; i >= 0 && len(ret) < k; i-- {
+		take(ndb.table[i : i+1])
+	}
 
+	if len(ret) > k {
+		ret = ret[:k]
 	}
 
 	return ret, nil
 }
 
-func (ndb *NetDB) SaveTable(path string) {
-	data, err := json.Marshal(ndb.table)
+// What SaveTable writes. Older tables were just the buckets.
+type savedTable struct {
+	Table [][]Address
+	Seen  map[string]time.Time
+}
+
+func (ndb *NetDB) SaveTable(path string) error {
+	ndb.lock.Lock()
+	data, err := json.Marshal(savedTable{ndb.table, ndb.seen})
+	ndb.lock.Unlock()
 
 	if err != nil {
-		log.Error(err.Error())
+		return err
 	}
 
-	ioutil.WriteFile(path, data, 0644)
-
+	return ioutil.WriteFile(path, data, 0644)
 }
 
 func (ndb *NetDB) LoadTable(path string) {
 	raw, _ := ioutil.ReadFile(path)
 
-	json.Unmarshal(raw, &ndb.table)
+	ndb.lock.Lock()
+	defer ndb.lock.Unlock()
+
+	saved := savedTable{}
+
+	if json.Unmarshal(raw, &saved) == nil && saved.Table != nil {
+		ndb.table = saved.Table
+	} else {
+		json.Unmarshal(raw, &ndb.table)
+	}
+
+	// Entries we have no time for are given a full TTL from now, rather than
+	// all being culled at once.
+	now := time.Now()
+
+	for _, bucket := range ndb.table {
+		for _, i := range bucket {
+			s, _ := i.String()
+
+			if seen, ok := saved.Seen[s]; ok {
+				ndb.seen[s] = seen
+			} else {
+				ndb.seen[s] = now
+			}
+		}
+	}
+
+	ndb.regroup()
 }
@@ -2,13 +2,16 @@ package dht_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"sort"
 	"testing"
 
-	"github.com/zif/zif/libzif/dht"
-	"github.com/zif/zif/libzif/util"
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/util"
 )
 
 // would be so cool if you had that public key for real :O
@@ -76,7 +79,7 @@ func TestNetDBQuery(t *testing.T) {
 		t.Error(err.Error())
 	}
 
-	if !kv.Key.Equals(&addr) || !bytes.Equal(kv.Value, addr.Raw) {
+	if !kv.Key().Equals(&addr) || !bytes.Equal(kv.Value(), addr.Raw) {
 		t.Error("Query returned invalid data")
 	}
 
@@ -85,8 +88,8 @@ func TestNetDBQuery(t *testing.T) {
 
 	kv, err = db.Query(randAddr)
 
-	if err == nil {
-		t.Error("Random query did not error as expected")
+	if kv != nil || err != nil {
+		t.Error("Random query did not return nothing as expected")
 	}
 }
 
@@ -108,21 +111,133 @@ func TestNetDBFindClosest(t *testing.T) {
 	insert(t, db, addr, 1)
 	insert(t, db, addr2, 2)
 
-	pairs, err := db.FindClosest(addr)
+	pairs, err := db.FindClosest(addr2)
 
 	if err != nil {
 		t.Error(err.Error())
 	}
 
-	if len(pairs) != 1 {
+	if len(pairs) != 2 {
 		t.Error(fmt.Sprintf("Incorrect length returned: %d", len(pairs)))
 	}
 
-	if !pairs[0].Key.Equals(&addr2) {
+	if !pairs[0].Key().Equals(&addr2) || !pairs[1].Key().Equals(&addr) {
 		t.Error("Incorrect address returned")
 	}
 }
 
+// Fills a table with random addresses, returning those that were inserted.
+func randomTable(db *dht.NetDB, n int, r *rand.Rand) []dht.Address {
+	ret := make([]dht.Address, 0, n)
+
+	for i := 0; i < n; i++ {
+		raw := make([]byte, dht.AddressBinarySize)
+		r.Read(raw)
+
+		// Most addresses are far from us, so some buckets will be nearer
+		// than random ones would be.
+		if i%2 == 0 {
+			copy(raw, addr.Raw[:r.Intn(4)])
+		}
+
+		a := dht.Address{Raw: raw}
+
+		if db.Insert(dht.NewKeyValue(a, a.Raw)) == nil {
+			ret = append(ret, a)
+		}
+	}
+
+	return ret
+}
+
+func TestNetDBFindClosestN(t *testing.T) {
+	db, cl := newDB()
+	defer cl()
+
+	r := rand.New(rand.NewSource(1))
+	all := randomTable(db, dht.BucketSize*40, r)
+
+	for i := 0; i < 200; i++ {
+		raw := make([]byte, dht.AddressBinarySize)
+		r.Read(raw)
+
+		// Sometimes look for addresses in the table, or near us.
+		switch i % 4 {
+		case 1:
+			raw = all[r.Intn(len(all))].Raw
+		case 2:
+			copy(raw, addr.Raw[:r.Intn(dht.AddressBinarySize)])
+		}
+
+		target := dht.Address{Raw: raw}
+		k := []int{1, 5, dht.BucketSize, 100}[i%4]
+
+		pairs, err := db.FindClosestN(target, k)
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// Brute force, over the whole table.
+		expected := make([]dht.Address, len(all))
+		copy(expected, all)
+
+		sort.Slice(expected, func(i, j int) bool {
+			return expected[i].Xor(&target).Less(expected[j].Xor(&target))
+		})
+
+		if len(expected) > k {
+			expected = expected[:k]
+		}
+
+		if len(pairs) != len(expected) {
+			t.Fatalf("Returned %d, expected %d", len(pairs), len(expected))
+		}
+
+		for n, kv := range pairs {
+			if !kv.Key().Equals(&expected[n]) {
+				t.Fatalf("Entry %d of %d closest is wrong", n, k)
+			}
+
+			if !bytes.Equal(kv.Value(), expected[n].Raw) {
+				t.Fatal("Entry has the wrong value")
+			}
+		}
+
+		if !sort.IsSorted(pairs) {
+			t.Error("Pairs do not sort by distance")
+		}
+	}
+
+	if pairs, err := db.FindClosestN(addr2, 0); err != nil || len(pairs) != 0 {
+		t.Errorf("Returned %d for none", len(pairs))
+	}
+
+	if _, err := db.FindClosestN(addr2, -1); err == nil {
+		t.Error("Negative k accepted")
+	}
+}
+
+func TestNetDBFindClosestSmall(t *testing.T) {
+	db, cl := newDB()
+	defer cl()
+
+	pairs, err := db.FindClosestN(addr2, dht.BucketSize)
+
+	if err != nil || len(pairs) != 0 {
+		t.Error("Empty table returned entries")
+	}
+
+	r := rand.New(rand.NewSource(2))
+	all := randomTable(db, 5, r)
+
+	pairs, _ = db.FindClosestN(addr2, dht.BucketSize)
+
+	if len(pairs) != len(all) {
+		t.Errorf("Returned %d of %d entries", len(pairs), len(all))
+	}
+}
+
 func BenchmarkNetDBFindClosest(b *testing.B) {
 	db, cl := newDB()
 	defer cl()
@@ -143,3 +258,39 @@ func BenchmarkNetDBFindClosest(b *testing.B) {
 		db.FindClosest(addr)
 	}
 }
+
+// Only accepts values that are larger than the one already held.
+type growingValidator struct{}
+
+func (growingValidator) Validate(kv *dht.KeyValue, old []byte) error {
+	if len(kv.Value()) <= len(old) {
+		return errors.New("Value did not grow")
+	}
+
+	return nil
+}
+
+func TestNetDBValidator(t *testing.T) {
+	db, cl := newDB()
+	defer cl()
+
+	db.Validator = growingValidator{}
+
+	insert(t, db, addr, 1)
+
+	err := db.Insert(dht.NewKeyValue(addr, addr.Raw[:1]))
+
+	if _, ok := err.(*dht.Rejected); !ok {
+		t.Fatal("Invalid value not rejected")
+	}
+
+	kv, _ := db.Query(addr)
+
+	if !bytes.Equal(kv.Value(), addr.Raw) {
+		t.Error("Rejected value replaced the one held")
+	}
+
+	if err = db.Insert(dht.NewKeyValue(addr, append(addr.Raw, 1))); err != nil {
+		t.Error(err.Error())
+	}
+}
@@ -0,0 +1,226 @@
+// Provider records say which peers have something, for instance which peers
+// index a given infohash. They are stored under a key, the hash of whatever
+// they are for, with the nodes closest to it. Records are kept as opaque
+// values, checking them is left to whoever adds them.
+
+package dht
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// How many providers are kept for a single key.
+	MaxProviders = BucketSize
+
+	// How many keys providers are kept for, in total.
+	MaxProviderKeys = 1 << 16
+
+	// How many keys one provider can have records under, so that it would
+	// take many providers to fill the store. Our own records are not limited.
+	MaxKeysPerProvider = 1 << 10
+
+	// How long a record lasts from when it was made, providers republish well
+	// within this.
+	ProviderTTL = time.Hour * 24
+)
+
+type Provider struct {
+	Provider Address
+	Value    []byte
+	Expires  time.Time
+}
+
+type ProviderStore struct {
+	lock      sync.Mutex
+	providers map[string][]*Provider
+
+	// How many keys each provider has a record under.
+	counts map[string]int
+
+	self Address
+}
+
+func NewProviderStore() *ProviderStore {
+	return &ProviderStore{
+		providers: make(map[string][]*Provider),
+		counts:    make(map[string]int),
+	}
+}
+
+// Adds p under key, replacing any record from the same provider that expires
+// sooner. Once a key has MaxProviders, the record expiring soonest is dropped
+// to make room, unless p would expire sooner still.
+func (ps *ProviderStore) Add(key Address, p *Provider) error {
+	if time.Now().After(p.Expires) {
+		return &InvalidValue{"expired provider record"}
+	}
+
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	s, _ := key.String()
+	list, ok := ps.providers[s]
+
+	if !ok && len(ps.providers) >= MaxProviderKeys {
+		return &NoCapacity{MaxProviderKeys}
+	}
+
+	found := -1
+
+	for n, i := range list {
+		if i.Provider.Equals(&p.Provider) {
+			found = n
+			break
+		}
+	}
+
+	if found == -1 && ps.full(p) {
+		return &NoCapacity{MaxKeysPerProvider}
+	}
+
+	switch {
+	case found != -1:
+		if !p.Expires.After(list[found].Expires) {
+			return nil
+		}
+
+		list[found] = p
+
+	case len(list) >= MaxProviders:
+		// Kept soonest to expire last.
+		if !p.Expires.After(list[len(list)-1].Expires) {
+			return &NoCapacity{MaxProviders}
+		}
+
+		ps.count(list[len(list)-1], -1)
+		ps.count(p, 1)
+		list[len(list)-1] = p
+
+	default:
+		ps.count(p, 1)
+		list = append(list, p)
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Expires.After(list[j].Expires)
+	})
+
+	ps.providers[s] = list
+
+	return nil
+}
+
+// The providers held for key that have not expired, latest to expire first.
+func (ps *ProviderStore) Get(key Address) []*Provider {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	s, _ := key.String()
+	now := time.Now()
+	ret := make([]*Provider, 0, len(ps.providers[s]))
+
+	for _, i := range ps.providers[s] {
+		if now.Before(i.Expires) {
+			ret = append(ret, i)
+		}
+	}
+
+	return ret
+}
+
+// Removes every expired record, returning how many there were.
+func (ps *ProviderStore) Cull() int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	now := time.Now()
+	culled := 0
+
+	for s, list := range ps.providers {
+		kept := list[:0]
+
+		for _, i := range list {
+			if now.Before(i.Expires) {
+				kept = append(kept, i)
+			} else {
+				ps.count(i, -1)
+			}
+		}
+
+		culled += len(list) - len(kept)
+
+		if len(kept) == 0 {
+			delete(ps.providers, s)
+		} else {
+			ps.providers[s] = kept
+		}
+	}
+
+	return culled
+}
+
+func (ps *ProviderStore) Save(path string) error {
+	ps.lock.Lock()
+	data, err := json.Marshal(ps.providers)
+	ps.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Records that expired while saved are culled as soon as the store is.
+func (ps *ProviderStore) Load(path string) error {
+	raw, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	err = json.Unmarshal(raw, &ps.providers)
+
+	if err != nil {
+		return err
+	}
+
+	ps.counts = make(map[string]int)
+
+	for _, list := range ps.providers {
+		for _, i := range list {
+			ps.count(i, 1)
+		}
+	}
+
+	return nil
+}
+
+// Whether p's provider already has records under as many keys as it can.
+func (ps *ProviderStore) full(p *Provider) bool {
+	if p.Provider.Equals(&ps.self) {
+		return false
+	}
+
+	s, _ := p.Provider.String()
+
+	return ps.counts[s] >= MaxKeysPerProvider
+}
+
+// Adds delta to the number of keys p's provider has records under.
+func (ps *ProviderStore) count(p *Provider, delta int) {
+	s, _ := p.Provider.String()
+	ps.counts[s] += delta
+
+	if ps.counts[s] <= 0 {
+		delete(ps.counts, s)
+	}
+}
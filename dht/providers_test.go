@@ -0,0 +1,151 @@
+package dht_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zif/zif/dht"
+)
+
+func provider(a dht.Address, expires time.Duration) *dht.Provider {
+	return &dht.Provider{Provider: a, Value: a.Raw, Expires: time.Now().Add(expires)}
+}
+
+func TestProviderStoreAdd(t *testing.T) {
+	ps := dht.NewProviderStore()
+	r := rand.New(rand.NewSource(1))
+	as := furthestBucket(r, dht.MaxProviders+2)
+
+	for n, i := range as[:dht.MaxProviders] {
+		if err := ps.Add(addr, provider(i, time.Hour+time.Duration(n)*time.Minute)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// The same provider again replaces its record, rather than adding one.
+	ps.Add(addr, provider(as[0], time.Hour*2))
+
+	if len(ps.Get(addr)) != dht.MaxProviders {
+		t.Errorf("%d providers held", len(ps.Get(addr)))
+	}
+
+	// Once full, only records that last longer than one held get in.
+	if _, ok := ps.Add(addr, provider(as[dht.MaxProviders], time.Minute)).(*dht.NoCapacity); !ok {
+		t.Error("Short lived record added to a full key")
+	}
+
+	if err := ps.Add(addr, provider(as[dht.MaxProviders+1], time.Hour*3)); err != nil {
+		t.Error(err.Error())
+	}
+
+	held := ps.Get(addr)
+
+	if len(held) != dht.MaxProviders || !held[0].Provider.Equals(&as[dht.MaxProviders+1]) {
+		t.Error("Longest lasting record not first")
+	}
+
+	for _, i := range held {
+		if i.Provider.Equals(&as[1]) {
+			t.Error("Record expiring soonest not dropped")
+		}
+	}
+
+	if ps.Add(addr2, provider(as[0], -time.Minute)) == nil {
+		t.Error("Expired record added")
+	}
+
+	if len(ps.Get(addr2)) != 0 {
+		t.Error("Providers returned for another key")
+	}
+}
+
+func TestProviderStoreCull(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "zif")
+	defer os.RemoveAll(dir)
+
+	ps := dht.NewProviderStore()
+	r := rand.New(rand.NewSource(2))
+	as := furthestBucket(r, 2)
+
+	ps.Add(addr, provider(as[0], time.Millisecond*25))
+	ps.Add(addr, provider(as[1], time.Hour))
+
+	path := filepath.Join(dir, "providers.dat")
+
+	if err := ps.Save(path); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ps = dht.NewProviderStore()
+
+	if err := ps.Load(path); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	// Expired records are never returned, even before being culled.
+	if held := ps.Get(addr); len(held) != 1 || !held[0].Provider.Equals(&as[1]) {
+		t.Fatal("Expired record returned")
+	}
+
+	if ps.Cull() != 1 {
+		t.Error("Expired record not culled")
+	}
+}
+
+func TestProviderStoreQuota(t *testing.T) {
+	ps := dht.NewProviderStore()
+	r := rand.New(rand.NewSource(3))
+	as := furthestBucket(r, 2)
+	keys := furthestBucket(r, dht.MaxKeysPerProvider+1)
+
+	for _, i := range keys[:dht.MaxKeysPerProvider] {
+		if err := ps.Add(i, provider(as[0], time.Hour)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// One provider cannot take any more keys, but can still refresh its
+	// records, and others are unaffected.
+	if _, ok := ps.Add(keys[dht.MaxKeysPerProvider], provider(as[0], time.Hour)).(*dht.NoCapacity); !ok {
+		t.Error("Provider added records beyond its quota")
+	}
+
+	if err := ps.Add(keys[0], provider(as[0], time.Hour*2)); err != nil {
+		t.Error(err.Error())
+	}
+
+	if err := ps.Add(keys[dht.MaxKeysPerProvider], provider(as[1], time.Hour)); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestDHTClosest(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "zif")
+	defer os.RemoveAll(dir)
+
+	d := dht.NewDHT(addr, dir)
+	r := rand.New(rand.NewSource(4))
+	far := furthestBucket(r, dht.BucketSize)
+
+	if !d.Closest(far[0]) {
+		t.Error("Not closest with an empty table")
+	}
+
+	for _, i := range far {
+		d.Insert(dht.NewKeyValue(i, i.Raw))
+	}
+
+	if !d.Closest(addr2) {
+		t.Error("Not closest to a key near our address")
+	}
+
+	if d.Closest(far[0]) {
+		t.Error("Closest to a key with a full bucket of closer peers")
+	}
+}
@@ -0,0 +1,123 @@
+// Proof of work for addresses. Making an address is cheap, so without this
+// anyone could make as many as they like and surround any key in the DHT with
+// their own. A nonce is found for a public key such that hashing the two has
+// a number of leading zero bits, the difficulty, and each extra bit doubles
+// the work needed.
+
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	// About a million hashes, only a second or so of work.
+	DefaultDifficulty = 20
+
+	// What peers ask of each other unless told otherwise. Lower than
+	// DefaultDifficulty, so that peers who chose a little less still get in,
+	// but far too much work to make thousands of addresses.
+	DefaultMinDifficulty = 16
+
+	// Higher than anyone could reach, anything claiming more is nonsense.
+	MaxDifficulty = 64
+
+	// How often Grind reports how many nonces it has tried.
+	GrindProgressInterval = time.Second
+)
+
+// The difficulty nonce meets for key, how many leading zero bits there are in
+// their hash.
+func Work(key []byte, nonce uint64) int {
+	buf := make([]byte, len(key)+8)
+	copy(buf, key)
+	binary.BigEndian.PutUint64(buf[len(key):], nonce)
+
+	hash := sha3.Sum256(buf)
+	work := 0
+
+	for _, i := range hash {
+		work += bits.LeadingZeros8(i)
+
+		if i != 0 {
+			break
+		}
+	}
+
+	return work
+}
+
+// Tries nonces for key on every CPU until one meets difficulty. If progress
+// is not nil, it is passed how many nonces have been tried so far every
+// GrindProgressInterval.
+func Grind(ctx context.Context, key []byte, difficulty int, progress func(tries uint64)) (uint64, error) {
+	if difficulty > MaxDifficulty {
+		return 0, &InvalidValue{"difficulty too high"}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	workers := runtime.NumCPU()
+	found := make(chan uint64, workers)
+
+	var tries uint64
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+
+		go func(nonce uint64) {
+			defer wg.Done()
+
+			for n := 1; ; n++ {
+				if Work(key, nonce) >= difficulty {
+					found <- nonce
+					return
+				}
+
+				nonce += uint64(workers)
+
+				// Checking for cancellation on every try slows things down.
+				if n%1024 == 0 {
+					atomic.AddUint64(&tries, 1024)
+
+					if ctx.Err() != nil {
+						return
+					}
+				}
+			}
+		}(uint64(w))
+	}
+
+	ticker := time.NewTicker(GrindProgressInterval)
+	defer ticker.Stop()
+
+	// Whichever way this returns, the workers are stopped first.
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	for {
+		select {
+		case nonce := <-found:
+			return nonce, nil
+
+		case <-ticker.C:
+			if progress != nil {
+				progress(atomic.LoadUint64(&tries))
+			}
+
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
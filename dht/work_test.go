@@ -0,0 +1,39 @@
+package dht_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zif/zif/dht"
+)
+
+func TestGrind(t *testing.T) {
+	key := []byte("a public key, or close enough")
+	nonce, err := dht.Grind(context.Background(), key, 12, nil)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if dht.Work(key, nonce) < 12 {
+		t.Errorf("Nonce %d only meets difficulty %d", nonce, dht.Work(key, nonce))
+	}
+
+	if dht.Work([]byte("another key"), nonce) >= 12 && dht.Work([]byte("yet another"), nonce) >= 12 {
+		t.Error("Work not bound to the key")
+	}
+}
+
+func TestGrindCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if _, err := dht.Grind(ctx, []byte("key"), dht.MaxDifficulty, nil); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline to be exceeded, got %v", err)
+	}
+
+	if _, err := dht.Grind(ctx, []byte("key"), dht.MaxDifficulty+1, nil); err == nil {
+		t.Error("Ground for an impossible difficulty")
+	}
+}
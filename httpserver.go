@@ -10,6 +10,7 @@ import (
 	"github.com/gorilla/mux"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/zif/zif/proto"
 )
 
 type HttpServer struct {
@@ -37,7 +38,9 @@ func (hs *HttpServer) ListenHttp(addr string) {
 	router.HandleFunc("/self/index/{since}/", hs.FtsIndex)
 	router.HandleFunc("/self/resolve/{address}/", hs.Resolve)
 	router.HandleFunc("/self/bootstrap/{address}/", hs.Bootstrap)
+	router.HandleFunc("/self/providers/{infohash}/", hs.FindProviders)
 	router.HandleFunc("/self/search/", hs.SelfSearch).Methods("POST")
+	router.HandleFunc("/self/networksearch/", hs.NetworkSearch).Methods("POST")
 	router.HandleFunc("/self/suggest/", hs.SelfSuggest).Methods("POST")
 	router.HandleFunc("/self/recent/{page}/", hs.SelfRecent)
 	router.HandleFunc("/self/popular/{page}/", hs.SelfPopular)
@@ -45,6 +48,7 @@ func (hs *HttpServer) ListenHttp(addr string) {
 	router.HandleFunc("/self/savecollection/", hs.SaveCollection)
 	router.HandleFunc("/self/rebuildcollection/", hs.RebuildCollection)
 	router.HandleFunc("/self/peers/", hs.Peers)
+	router.HandleFunc("/self/metrics/", hs.Metrics)
 	router.HandleFunc("/self/requestaddpeer/{remote}/{peer}/", hs.RequestAddPeer)
 	router.HandleFunc("/self/set/{key}/", hs.SelfSet).Methods("POST")
 	router.HandleFunc("/self/get/{key}/", hs.SelfGet)
@@ -63,6 +67,8 @@ func write_http_response(w http.ResponseWriter, cr CommandResult) {
 
 	if cr.IsOK {
 		err = http.StatusOK
+	} else if pe, ok := cr.Error.(*proto.ProtocolError); ok {
+		err = protocol_error_status(pe)
 	} else {
 		err = http.StatusInternalServerError
 	}
@@ -73,15 +79,33 @@ func write_http_response(w http.ResponseWriter, cr CommandResult) {
 	cr.WriteJSON(w)
 }
 
+// Errors from remote peers are mapped to the closest HTTP status.
+func protocol_error_status(pe *proto.ProtocolError) int {
+	switch pe.Code {
+	case proto.ErrorRateLimited:
+		return http.StatusTooManyRequests
+	case proto.ErrorNotFound:
+		return http.StatusNotFound
+	case proto.ErrorTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case proto.ErrorUnsupported:
+		return http.StatusNotImplemented
+	case proto.ErrorInvalid:
+		return http.StatusBadRequest
+	}
+
+	return http.StatusBadGateway
+}
+
 func (hs *HttpServer) Ping(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	write_http_response(w, hs.CommandServer.Ping(CommandPing{vars["address"]}))
+	write_http_response(w, hs.CommandServer.Ping(r.Context(), CommandPing{vars["address"]}))
 }
 func (hs *HttpServer) Announce(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	write_http_response(w, hs.CommandServer.Announce(CommandAnnounce{vars["address"]}))
+	write_http_response(w, hs.CommandServer.Announce(r.Context(), CommandAnnounce{vars["address"]}))
 }
 func (hs *HttpServer) PeerRSearch(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -97,7 +121,7 @@ func (hs *HttpServer) PeerRSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	write_http_response(w, hs.CommandServer.RSearch(
+	write_http_response(w, hs.CommandServer.RSearch(r.Context(),
 		CommandRSearch{CommandPeer{addr}, query, pagei}))
 }
 func (hs *HttpServer) PeerSearch(w http.ResponseWriter, r *http.Request) {
@@ -114,7 +138,7 @@ func (hs *HttpServer) PeerSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	write_http_response(w, hs.CommandServer.PeerSearch(
+	write_http_response(w, hs.CommandServer.PeerSearch(r.Context(),
 		CommandPeerSearch{CommandPeer{addr}, query, pagei}))
 }
 func (hs *HttpServer) Recent(w http.ResponseWriter, r *http.Request) {
@@ -129,7 +153,7 @@ func (hs *HttpServer) Recent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	write_http_response(w, hs.CommandServer.PeerRecent(
+	write_http_response(w, hs.CommandServer.PeerRecent(r.Context(),
 		CommandPeerRecent{CommandPeer{addr}, pagei}))
 }
 func (hs *HttpServer) Popular(w http.ResponseWriter, r *http.Request) {
@@ -144,13 +168,13 @@ func (hs *HttpServer) Popular(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	write_http_response(w, hs.CommandServer.PeerPopular(
+	write_http_response(w, hs.CommandServer.PeerPopular(r.Context(),
 		CommandPeerPopular{CommandPeer{addr}, pagei}))
 }
 func (hs *HttpServer) Mirror(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	write_http_response(w, hs.CommandServer.Mirror(CommandMirror{vars["address"]}))
+	write_http_response(w, hs.CommandServer.Mirror(r.Context(), CommandMirror{vars["address"]}))
 }
 
 func (hs *HttpServer) MirrorProgress(w http.ResponseWriter, r *http.Request) {
@@ -205,13 +229,29 @@ func (hs *HttpServer) FtsIndex(w http.ResponseWriter, r *http.Request) {
 }
 func (hs *HttpServer) Resolve(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
+	paths := 0
+
+	if p := r.FormValue("paths"); p != "" {
+		var err error
+		paths, err = strconv.Atoi(p)
 
-	write_http_response(w, hs.CommandServer.Resolve(CommandResolve{vars["address"]}))
+		if err != nil {
+			write_http_response(w, CommandResult{false, nil, err})
+			return
+		}
+	}
+
+	write_http_response(w, hs.CommandServer.Resolve(r.Context(), CommandResolve{CommandPeer{vars["address"]}, paths}))
 }
 func (hs *HttpServer) Bootstrap(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	write_http_response(w, hs.CommandServer.Bootstrap(CommandBootstrap{vars["address"]}))
+	write_http_response(w, hs.CommandServer.Bootstrap(r.Context(), CommandBootstrap{vars["address"]}))
+}
+func (hs *HttpServer) FindProviders(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	write_http_response(w, hs.CommandServer.FindProviders(r.Context(), CommandFindProviders{vars["infohash"]}))
 }
 func (hs *HttpServer) SelfSearch(w http.ResponseWriter, r *http.Request) {
 	query := r.FormValue("query")
@@ -225,6 +265,19 @@ func (hs *HttpServer) SelfSearch(w http.ResponseWriter, r *http.Request) {
 
 	write_http_response(w, hs.CommandServer.SelfSearch(CommandSelfSearch{CommandSuggest{query}, pagei}))
 }
+func (hs *HttpServer) NetworkSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+	page := r.FormValue("page")
+
+	pagei, err := strconv.Atoi(page)
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	write_http_response(w, hs.CommandServer.NetworkSearch(r.Context(),
+		CommandNetworkSearch{CommandSuggest{query}, pagei}))
+}
 
 func (hs *HttpServer) SelfSuggest(w http.ResponseWriter, r *http.Request) {
 	log.Info("HTTP: Self Suggest request")
@@ -281,10 +334,14 @@ func (hs *HttpServer) Peers(w http.ResponseWriter, r *http.Request) {
 	write_http_response(w, hs.CommandServer.Peers(nil))
 }
 
+func (hs *HttpServer) Metrics(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.Metrics(nil))
+}
+
 func (hs *HttpServer) RequestAddPeer(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	write_http_response(w, hs.CommandServer.RequestAddPeer(CommandRequestAddPeer{
+	write_http_response(w, hs.CommandServer.RequestAddPeer(r.Context(), CommandRequestAddPeer{
 		vars["remote"], vars["peer"],
 	}))
 }
@@ -11,6 +11,9 @@ import (
 const ExploreSleepTime = time.Minute * 2
 const ExploreBufferSize = 100
 
+// How many recently seen entries to ask each peer for.
+const ExplorePexSize = 32
+
 // This job runs every two minutes, and tries to build the netdb with as many
 // entries as it possibly can
 func ExploreJob(in chan dht.KeyValue, data ...interface{}) <-chan dht.KeyValue {
@@ -83,5 +86,23 @@ func explorePeer(addr dht.Address, me dht.Address, ret chan<- dht.KeyValue, conn
 		}
 	}
 
+	// Not every peer supports exchanging entries, that is fine.
+	client, recent, err := p.Pex(ExplorePexSize)
+
+	if client != nil {
+		client.Close()
+	}
+
+	if err != nil {
+		log.Debug(err.Error())
+		return nil
+	}
+
+	for _, i := range recent {
+		if !i.Key().Equals(&me) {
+			ret <- *i
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,74 @@
+package jobs
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zif/zif/dht"
+)
+
+const CullInterval = time.Minute * 10
+
+// How often our own entry is republished, well within dht.EntryTTL so that it
+// is never culled while we are up.
+const RepublishInterval = time.Hour
+
+// Changes to our entry are gathered for this long before it is republished, so
+// that adding a lot of posts only republishes once.
+const RepublishDelay = time.Minute
+
+// Removes entries from the DHT that have not been seen for ttl, every
+// interval, until stop is closed.
+func CullJob(d *dht.DHT, ttl, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if culled := d.Cull(ttl); culled > 0 {
+				log.WithField("culled", culled).Info("Culled expired entries")
+			}
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Publishes straight away, then every interval, and delay after anything is
+// sent on changed. Runs until stop is closed.
+func RepublishJob(publish func() error, changed <-chan struct{}, interval, delay time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Only set while waiting to publish a change.
+	var pending <-chan time.Time
+
+	run := func() {
+		if err := publish(); err != nil {
+			log.WithField("reason", err.Error()).Warn("Failed to publish")
+		}
+	}
+
+	run()
+
+	for {
+		select {
+		case <-ticker.C:
+			run()
+
+		case <-changed:
+			if pending == nil {
+				pending = time.After(delay)
+			}
+
+		case <-pending:
+			pending = nil
+			run()
+
+		case <-stop:
+			return
+		}
+	}
+}
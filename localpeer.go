@@ -4,14 +4,16 @@
 package libzif
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"math"
+	"net"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strconv"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/streamrail/concurrent-map"
@@ -25,11 +27,27 @@ import (
 
 const ResolveListSize = 1
 
+// How long a peer has to answer a ping before the DHT counts it as gone.
+const LivenessTimeout = time.Second * 10
+
+// How long publishing our entry to the closest peers may take.
+const PublishTimeout = time.Minute * 2
+
+// How long looking up the IP of a hostname in an entry may take, how many
+// answers are remembered, and how many lookups may run at once.
+const (
+	HostLookupTimeout     = time.Second * 2
+	MaxHostLookups        = 4096
+	MaxHostLookupsRunning = 16
+)
+
 type LocalPeer struct {
 	Peer
+	// Set up before Listen, after which UpdateEntry and CopyEntry are used.
 	Entry         *proto.Entry
 	DHT           *dht.DHT
 	Server        proto.Server
+	Metrics       *proto.Metrics
 	Collection    *data.Collection
 	Database      *data.Database
 	PublicAddress string
@@ -45,10 +63,69 @@ type LocalPeer struct {
 	// A map of public address to Zif address
 	PublicToZif cmap.ConcurrentMap
 
+	// The IP each peer was seen at, and what hostnames resolved to. Used to
+	// group entries in the DHT.
+	observed cmap.ConcurrentMap
+
+	// Hostnames are looked up in the background, as they are needed with the
+	// DHT locked. The oldest answer goes once there are MaxHostLookups.
+	hostsLock sync.Mutex
+	hosts     map[string]net.IP
+	hostOrder []string
+	resolving map[string]bool
+
 	privateKey ed25519.PrivateKey
 
 	Socks     bool
 	SocksPort int
+
+	// Where everything is stored, ./data if not set before Setup.
+	DataDir string
+
+	// How connections to other peers are made, TCP if nil.
+	Transport proto.Transport
+
+	// How long Close waits for requests being handled to finish, defaults to
+	// proto.DefaultDrainTimeout.
+	DrainTimeout time.Duration
+
+	// How long entries are kept without being seen, how often our own is
+	// republished, and how long after a change it is republished. Default to
+	// dht.EntryTTL, jobs.RepublishInterval and jobs.RepublishDelay.
+	EntryTTL          time.Duration
+	RepublishInterval time.Duration
+	RepublishDelay    time.Duration
+
+	// Entries with less proof of work than this are not accepted into the
+	// DHT, and their peers are not connected to. Set before Setup.
+	MinDifficulty int
+
+	// Whether to talk to peers that predate negotiation. Their connections
+	// are not encrypted. Set before Listen.
+	AllowLegacy bool
+
+	// How many entries from one subnet or host are let into each bucket of
+	// the routing table, and the whole table. Set before Setup.
+	Diversity dht.DiversityLimits
+
+	// Guards Entry once the local peer is listening, see UpdateEntry.
+	entryLock    sync.RWMutex
+	entryChanged chan struct{}
+
+	// Posts added, waiting to be provided.
+	newPosts chan data.Post
+
+	// Terms provided since they were last republished.
+	termsLock sync.Mutex
+	terms     map[string]bool
+
+	// Closed when the local peer is, stopping background jobs.
+	stop chan struct{}
+}
+
+// Joins elem onto the data directory.
+func (lp *LocalPeer) dataPath(elem ...string) string {
+	return filepath.Join(append([]string{lp.DataDir}, elem...)...)
 }
 
 func (lp *LocalPeer) Setup() {
@@ -56,67 +133,97 @@ func (lp *LocalPeer) Setup() {
 
 	lp.Entry = &proto.Entry{}
 	lp.Entry.Signature = make([]byte, ed25519.SignatureSize)
+	lp.entryChanged = make(chan struct{}, 1)
+	lp.newPosts = make(chan data.Post, ProvideQueueSize)
+	lp.stop = make(chan struct{})
 
 	lp.Databases = cmap.New()
 	lp.Collections = cmap.New()
 	lp.Peers = cmap.New()
 	lp.PublicToZif = cmap.New()
+	lp.observed = cmap.New()
+	lp.hosts = make(map[string]net.IP)
+	lp.resolving = make(map[string]bool)
 
 	lp.Address().Generate(lp.PublicKey())
 
-	lp.DHT = dht.NewDHT(lp.address, "./data/dht")
-	lp.DHT.LoadTable("./data/dht/table.dat")
+	if lp.DataDir == "" {
+		lp.DataDir = "./data"
+	}
+
+	err = os.MkdirAll(lp.DataDir, 0777)
 
 	if err != nil {
 		panic(err)
 	}
 
-	lp.Collection, err = data.LoadCollection("./data/collection.dat")
+	lp.DHT = dht.NewDHT(lp.address, lp.dataPath("dht"))
+	lp.DHT.SetGrouper(proto.EntryGrouper{Observed: lp.observedIP, Resolve: lp.resolve}, lp.Diversity)
+	lp.DHT.LoadTable(lp.dataPath("dht", "table.dat"))
+	lp.DHT.SetChecker(lp)
+	lp.DHT.SetValidator(proto.EntryValidator{MinDifficulty: lp.MinDifficulty})
+	lp.DHT.LoadProviders(lp.dataPath("dht", "providers.dat"))
+
+	lp.Collection, err = data.LoadCollection(lp.dataPath("collection.dat"))
 
 	if err != nil {
 		lp.Collection = data.NewCollection()
 		log.Info("Created new collection")
 	}
 
-	// Loop through all the databases of other peers in ./data, load them.
+	// Loop through all the databases of other peers in the data directory,
+	// these are stored as <address>/posts.db, with <address>/collection.json
 	handler := func(path string, info os.FileInfo, err error) error {
-		if path != "data/posts.db" && info.Name() == "posts.db" {
-			r, err := regexp.Compile("data/(\\w+)/.+")
+		if err != nil {
+			return err
+		}
 
-			if err != nil {
-				return err
-			}
+		rel, err := filepath.Rel(lp.DataDir, path)
 
-			addr := r.FindStringSubmatch(path)
+		if err != nil {
+			return err
+		}
 
-			db := data.NewDatabase(path)
+		addr, name := filepath.Split(rel)
 
-			err = db.Connect()
+		if name != "posts.db" || addr == "" {
+			return nil
+		}
 
-			if err != nil {
-				return err
-			}
+		db := data.NewDatabase(path)
 
-			if len(addr) < 2 {
-				return nil
-			}
+		err = db.Connect()
 
-			lp.Databases.Set(addr[1], db)
+		if err != nil {
+			return err
 		}
+
+		lp.Databases.Set(filepath.Clean(addr), db)
+
+		// The hash list as signed by the peer, so that we can seed it.
+		mcol, err := loadSignedCollection(filepath.Join(filepath.Dir(path), "collection.json"))
+
+		if err == nil {
+			lp.Collections.Set(filepath.Clean(addr), mcol)
+		}
+
 		return nil
 	}
 
-	filepath.Walk("./data", handler)
+	filepath.Walk(lp.DataDir, handler)
 
 	// TODO: This does not work without internet xD
 	/*if lp.Entry.PublicAddress == "" {
 		log.Debug("Local peer public address is nil, attempting to fetch")
-		ip := external_ip()
+		ip := ExternalIP()
 		log.Debug("External IP is ", ip)
 		lp.Entry.PublicAddress = ip
 	}*/
 
 	lp.SearchProvider = data.NewSearchProvider()
+
+	lp.Metrics = proto.NewMetrics()
+	lp.registerHandlers()
 }
 
 // Given a direct address, for instance an IP or domain, connect to the peer there.
@@ -126,15 +233,16 @@ func (lp *LocalPeer) ConnectPeerDirect(addr string) (*Peer, error) {
 	var peer *Peer
 	var err error
 
-	if peer = lp.GetPeer(addr); peer != nil {
-		return peer, nil
+	if s, ok := lp.PublicToZif.Get(addr); ok {
+		if peer = lp.GetPeer(s.(string)); peer != nil {
+			return peer, nil
+		}
 	}
 
 	peer = &Peer{}
-
-	if err != nil {
-		return nil, err
-	}
+	peer.streams.Transport = lp.Transport
+	peer.streams.MinDifficulty = lp.MinDifficulty
+	peer.streams.AllowLegacy = lp.AllowLegacy
 
 	if lp.Socks {
 		peer.streams.Socks = true
@@ -166,16 +274,110 @@ func (lp *LocalPeer) GetPeer(addr string) *Peer {
 	return peer.(*Peer)
 }
 
+// Penalises the peer at addr, if we are still connected to it.
+func (lp *LocalPeer) penalise(addr *dht.Address, reason error) {
+	if addr == nil {
+		return
+	}
+
+	s, _ := addr.String()
+
+	if peer := lp.GetPeer(s); peer != nil {
+		peer.Penalise(reason)
+	}
+}
+
+// Records the IP the peer with addr was seen at.
+func (lp *LocalPeer) observe(addr dht.Address, remote net.Addr) {
+	if remote == nil {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(remote.String())
+
+	if err != nil {
+		return
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		s, _ := addr.String()
+		lp.observed.Set(s, ip)
+	}
+}
+
+func (lp *LocalPeer) observedIP(addr dht.Address) net.IP {
+	s, _ := addr.String()
+
+	if ip, ok := lp.observed.Get(s); ok {
+		return ip.(net.IP)
+	}
+
+	return nil
+}
+
+// The IP host was last found at, nil if it has not been looked up yet, in which
+// case a lookup is started. Names are only looked up when connecting over TCP,
+// through Tor that would give away who we talk to.
+func (lp *LocalPeer) resolve(host string) net.IP {
+	if _, tcp := lp.Transport.(proto.TCPTransport); lp.Socks || (lp.Transport != nil && !tcp) {
+		return nil
+	}
+
+	lp.hostsLock.Lock()
+	defer lp.hostsLock.Unlock()
+
+	if ip, ok := lp.hosts[host]; ok {
+		return ip
+	}
+
+	if !lp.resolving[host] && len(lp.resolving) < MaxHostLookupsRunning {
+		lp.resolving[host] = true
+		go lp.lookupHost(host)
+	}
+
+	return nil
+}
+
+// Remembers what host resolves to, nil if it does not.
+func (lp *LocalPeer) lookupHost(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), HostLookupTimeout)
+	defer cancel()
+
+	var ip net.IP
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+
+	if err == nil && len(addrs) > 0 {
+		ip = addrs[0].IP
+	}
+
+	lp.hostsLock.Lock()
+	defer lp.hostsLock.Unlock()
+
+	delete(lp.resolving, host)
+
+	if len(lp.hostOrder) >= MaxHostLookups {
+		delete(lp.hosts, lp.hostOrder[0])
+		lp.hostOrder = lp.hostOrder[1:]
+	}
+
+	lp.hosts[host] = ip
+	lp.hostOrder = append(lp.hostOrder, host)
+}
+
 // Resolved a Zif address into an entry, connects to the peer at the
 // PublicAddress in the Entry, then return it. The peer is also stored in a map.
 func (lp *LocalPeer) ConnectPeer(addr string) (*Peer, error) {
+	return lp.ConnectPeerContext(context.Background(), addr)
+}
+
+func (lp *LocalPeer) ConnectPeerContext(ctx context.Context, addr string) (*Peer, error) {
 	var peer *Peer
 
 	if peer = lp.GetPeer(addr); peer != nil {
 		return peer, nil
 	}
 
-	entry, err := lp.Resolve(addr)
+	entry, err := lp.ResolveContext(ctx, addr)
 
 	if err != nil {
 		log.Error(err.Error())
@@ -203,20 +405,116 @@ func (lp *LocalPeer) ConnectPeer(addr string) (*Peer, error) {
 	return peer, nil
 }
 
+// The sequence number is raised each time, and kept ahead of the clock so that
+// it still rises if entry.json is lost.
 func (lp *LocalPeer) SignEntry() {
+	lp.entryLock.Lock()
+	defer lp.entryLock.Unlock()
+
+	lp.signEntry()
+}
+
+// As SignEntry, with entryLock held.
+func (lp *LocalPeer) signEntry() {
+	seq := time.Now().Unix()
+
+	if seq <= lp.Entry.Seq {
+		seq = lp.Entry.Seq + 1
+	}
+
+	lp.Entry.Seq = seq
+
 	data, _ := lp.Entry.Bytes()
 	copy(lp.Entry.Signature, ed25519.Sign(lp.privateKey, data))
 }
 
+// Changes the entry with update, then signs it straight away and has it
+// republished shortly after. Once listening, the entry must only be changed
+// through this, as it is read by background jobs.
+func (lp *LocalPeer) UpdateEntry(update func(e *proto.Entry)) {
+	lp.entryLock.Lock()
+	update(lp.Entry)
+	lp.signEntry()
+	lp.entryLock.Unlock()
+
+	select {
+	case lp.entryChanged <- struct{}{}:
+	default:
+	}
+}
+
+// A copy of the entry as it is now, signed, that is safe to read while the
+// entry changes.
+func (lp *LocalPeer) CopyEntry() *proto.Entry {
+	lp.entryLock.RLock()
+	defer lp.entryLock.RUnlock()
+
+	e := *lp.Entry
+	e.Signature = append([]byte(nil), lp.Entry.Signature...)
+	e.Seeds = append([][]byte(nil), lp.Entry.Seeds...)
+
+	return &e
+}
+
+// Encodes the entry as it is when a handshake needs it, not as it was when
+// we started listening.
+type currentEntry struct {
+	lp *LocalPeer
+}
+
+func (c currentEntry) Bytes() ([]byte, error) {
+	return c.lp.CopyEntry().Bytes()
+}
+
+func (c currentEntry) String() (string, error) {
+	return c.lp.CopyEntry().String()
+}
+
+func (c currentEntry) Json() ([]byte, error) {
+	return c.lp.CopyEntry().Json()
+}
+
+func (c currentEntry) JsonString() (string, error) {
+	return c.lp.CopyEntry().JsonString()
+}
+
+// Finds a nonce for our public key meeting difficulty, unless the entry already
+// has one, then signs the entry. See dht.Grind for progress.
+func (lp *LocalPeer) Work(ctx context.Context, difficulty int, progress func(tries uint64)) error {
+	nonce := lp.CopyEntry().Nonce
+
+	if dht.Work(lp.PublicKey(), nonce) < difficulty {
+		var err error
+		nonce, err = dht.Grind(ctx, lp.PublicKey(), difficulty, progress)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	lp.entryLock.Lock()
+	defer lp.entryLock.Unlock()
+
+	lp.Entry.Nonce = nonce
+	lp.Entry.Difficulty = difficulty
+	lp.signEntry()
+
+	return nil
+}
+
 // Sign any bytes.
 func (lp *LocalPeer) Sign(msg []byte) []byte {
 	return ed25519.Sign(lp.privateKey, msg)
 }
 
 // Pass the address to listen on. This is for the Zif connection.
-func (lp *LocalPeer) Listen(addr string) {
+func (lp *LocalPeer) Listen(addr string) error {
 	lp.SignEntry()
-	go lp.Server.Listen(addr, lp, lp.Entry)
+	lp.Server.Transport = lp.Transport
+	lp.Server.MinDifficulty = lp.MinDifficulty
+	lp.Server.AllowLegacy = lp.AllowLegacy
+
+	return lp.Server.Listen(addr, lp, currentEntry{lp})
 }
 
 // Generate a ed25519 keypair.
@@ -271,120 +569,139 @@ func (lp *LocalPeer) ReadKey() error {
 // May well change, I'm unsure really. Pretty happy with it at the moment though.
 // TODO: Somehow move this to the DHT package.
 func (lp *LocalPeer) Resolve(addr string) (*proto.Entry, error) {
-	log.Debug("Resolving ", addr)
+	return lp.ResolveContext(context.Background(), addr)
+}
+
+func (lp *LocalPeer) ResolveContext(ctx context.Context, addr string) (*proto.Entry, error) {
+	return lp.ResolvePaths(ctx, addr, dht.DefaultPaths)
+}
+
+// Resolves addr along paths disjoint lookup paths, dht.DefaultPaths if not
+// positive, returning the newest entry that verifies out of those the paths
+// found and any we already hold.
+func (lp *LocalPeer) ResolvePaths(ctx context.Context, addr string, paths int) (*proto.Entry, error) {
+	log.WithFields(log.Fields{"address": addr, "paths": paths}).Debug("Resolving")
 
 	lps, _ := lp.Address().String()
 	if addr == lps {
-		return lp.Entry, nil
+		return lp.CopyEntry(), nil
 	}
 
 	address := dht.DecodeAddress(addr)
 
-	kv, err := lp.DHT.Query(address)
+	found, err := lp.DHT.LookupDisjoint(ctx, lp, address, paths)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if kv != nil {
-		return proto.JsonToEntry(kv.Value())
-	}
+	return proto.Freshest(found)
+}
 
-	closest, err := lp.DHT.FindClosest(address)
+// Asks the peer an entry belongs to for target, as one step of a DHT lookup.
+// Peers we are already connected to are reused. A value is only returned if
+// it verifies, otherwise the peer is treated as having failed.
+func (lp *LocalPeer) FindValue(ctx context.Context, node *dht.KeyValue, target dht.Address) (*dht.KeyValue, dht.Pairs, error) {
+	peer, err := lp.connectPair(node)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	for _, i := range closest {
-		e, err := proto.JsonToEntry(i.Value())
+	s, _ := target.String()
+	client, kv, err := peer.QueryContext(ctx, s)
 
-		if err == nil {
-			// TODO: Goroutine this.
-			entry, err := lp.resolveStep(e, address)
+	if err != nil {
+		return nil, nil, err
+	}
 
-			if err != nil {
-				log.Error(err.Error())
-				continue
-			}
+	client.Close()
 
-			if entry.Address.Equals(&address) {
-				return entry, nil
-			}
+	if kv != nil {
+		if _, err = proto.VerifyPair(kv); err != nil {
+			peer.Penalise(err)
+			return nil, nil, err
 		}
+
+		return kv, nil, nil
 	}
 
-	return nil, errors.New("Address could not be resolved")
-}
+	client, closest, err := peer.FindClosestContext(ctx, s)
 
-// Will return the entry itself, or an error.
-func (lp *LocalPeer) resolveStep(e *proto.Entry, addr dht.Address) (*proto.Entry, error) {
-	// connect to the peer
-	var peer *Peer
-	var err error
+	if err != nil {
+		return nil, nil, err
+	}
 
-	es, _ := e.Address.String()
-	peer = lp.GetPeer(es)
+	client.Close()
 
-	if peer == nil {
-		peer, err = lp.ConnectPeerDirect(fmt.Sprintf("%s:%d", e.PublicAddress, e.Port))
+	return nil, closest, nil
+}
 
-		if err != nil {
-			return nil, err
-		}
+// Pings the peer an entry belongs to, so that the DHT can tell whether to keep
+// it. The DHT counts a failed check itself, so is not told of it here.
+func (lp *LocalPeer) CheckLiveness(kv *dht.KeyValue) error {
+	e, err := proto.JsonToEntry(kv.Value())
+
+	if err != nil {
+		return err
 	}
 
-	s, _ := addr.String()
-	client, kv, err := peer.Query(s)
+	peer, err := lp.connectEntry(e)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
-	client.Close()
 
-	if kv != nil {
-		entry, err := proto.JsonToEntry(kv.Value())
-		return entry, err
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), LivenessTimeout)
+	defer cancel()
 
-	client, closest, err := peer.FindClosest(s)
+	_, err = peer.PingContext(ctx)
+
+	return err
+}
+
+// Connects to the peer whose entry is held in kv, unless we already are. The
+// DHT is told if it cannot be reached.
+func (lp *LocalPeer) connectPair(kv *dht.KeyValue) (*Peer, error) {
+	e, err := proto.JsonToEntry(kv.Value())
 
 	if err != nil {
 		return nil, err
 	}
-	client.Close()
 
-	for _, i := range closest {
-		entry, err := proto.JsonToEntry(i.Value())
+	peer, err := lp.connectEntry(e)
 
-		if err != nil {
-			continue
-		}
+	if err != nil {
+		lp.DHT.Failed(*kv.Key())
+		return nil, err
+	}
 
-		result, err := lp.resolveStep(entry, addr)
+	return peer, nil
+}
 
-		if result != nil {
-			ret, _ := proto.JsonToEntry(i.Value())
+// Connects to the peer e belongs to, unless we already are.
+func (lp *LocalPeer) connectEntry(e *proto.Entry) (*Peer, error) {
+	es, _ := e.Address.String()
 
-			return ret, nil
-		}
+	if peer := lp.GetPeer(es); peer != nil {
+		return peer, nil
 	}
 
-	return nil, errors.New("No entries could be found")
+	return lp.ConnectPeerDirect(fmt.Sprintf("%s:%d", e.PublicAddress, e.Port))
 }
 
 func (lp *LocalPeer) SaveEntry() error {
-	dat, err := lp.Entry.Json()
+	dat, err := lp.CopyEntry().Json()
 
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile("./data/entry.json", dat, 0644)
+	return ioutil.WriteFile(lp.dataPath("entry.json"), dat, 0644)
 }
 
 func (lp *LocalPeer) LoadEntry() error {
-	dat, err := ioutil.ReadFile("./data/entry.json")
+	dat, err := ioutil.ReadFile(lp.dataPath("entry.json"))
 
 	if err != nil {
 		return err
@@ -401,11 +718,78 @@ func (lp *LocalPeer) LoadEntry() error {
 	return nil
 }
 
-func (lp *LocalPeer) Close() {
+// Shuts down in order: stops accepting connections and requests, gives those
+// in progress DrainTimeout to finish, disconnects from every peer, then saves
+// the routing table, collection and entry before closing the database.
+// Everything is attempted even if something fails, the first error is
+// returned.
+func (lp *LocalPeer) Close() error {
+	var ret error
+
+	keep := func(err error) {
+		if err != nil {
+			log.Error(err.Error())
+
+			if ret == nil {
+				ret = err
+			}
+		}
+	}
+
+	timeout := lp.DrainTimeout
+
+	if timeout == 0 {
+		timeout = proto.DefaultDrainTimeout
+	}
+
+	close(lp.stop)
+
+	keep(lp.Server.Shutdown(timeout))
+
+	for item := range lp.Peers.IterBuffered() {
+		item.Val.(*Peer).Terminate()
+	}
+
 	lp.CloseStreams()
-	lp.DHT.SaveTable("./data/dht/table.dat")
-	lp.Server.Close()
-	lp.Database.Close()
+
+	keep(lp.DHT.SaveTable(lp.dataPath("dht", "table.dat")))
+	keep(lp.DHT.SaveProviders(lp.dataPath("dht", "providers.dat")))
+
+	if lp.Collection != nil {
+		keep(lp.Collection.Save(lp.dataPath("collection.dat")))
+	}
+
+	if lp.Entry != nil {
+		keep(lp.SaveEntry())
+	}
+
+	if lp.Database != nil {
+		keep(lp.Database.Close())
+	}
+
+	return ret
+}
+
+// Collections hashed with an older post encoding are rebuilt from the database
+// with the current one, then saved. The hash list is signed whenever it is
+// requested, so peers see the new signature straight away. Needs the Database
+// to be connected.
+func (lp *LocalPeer) MigrateCollection() error {
+	if lp.Collection != nil && lp.Collection.Encoding == data.CurrentEncoding {
+		return nil
+	}
+
+	log.Info("Rehashing collection with the current post encoding")
+
+	col, err := data.CreateCollection(lp.Database, 0, data.PieceSize)
+
+	if err != nil {
+		return err
+	}
+
+	lp.Collection = col
+
+	return lp.Collection.Save(lp.dataPath("collection.dat"))
 }
 
 func (lp *LocalPeer) AddPost(p data.Post, store bool) (int64, error) {
@@ -417,22 +801,35 @@ func (lp *LocalPeer) AddPost(p data.Post, store bool) (int64, error) {
 		return -1, valid
 	}
 
-	lp.Entry.PostCount += 1
-
 	id, err := lp.Database.InsertPost(p)
 
-	pieceIndex := int(math.Floor(float64(id) / float64(data.PieceSize)))
+	if err != nil {
+		return id, err
+	}
+
+	lp.UpdateEntry(func(e *proto.Entry) {
+		e.PostCount += 1
+	})
+
+	// Ids start from 1, so post 1000 is the last of piece 0.
+	pieceIndex := (id - 1) / data.PieceSize
 	piece, err := lp.Database.QueryPiece(uint(pieceIndex), false)
 
+	if err != nil {
+		return id, err
+	}
+
 	lp.Collection.Add(piece)
 	lp.Collection.Rehash()
-	lp.Collection.Save("./data/collection.dat")
+	lp.Collection.Save(lp.dataPath("collection.dat"))
 
-	if err != nil {
-		return id, err
+	// Provided in the background, if there is no room now it will be when
+	// records are next republished.
+	select {
+	case lp.newPosts <- p:
+	default:
 	}
 
-	lp.SignEntry()
 	err = lp.SaveEntry()
 
 	return id, err
@@ -469,6 +866,99 @@ func (lp *LocalPeer) StartExploring() {
 	}()
 }
 
+// Starts culling expired entries from the DHT, republishing our own entry to
+// the peers closest to it, and providing our posts and the terms in their
+// titles. All stop once the local peer is closed.
+func (lp *LocalPeer) StartMaintenance() {
+	ttl, interval, delay := lp.EntryTTL, lp.RepublishInterval, lp.RepublishDelay
+
+	if ttl == 0 {
+		ttl = dht.EntryTTL
+	}
+
+	if interval == 0 {
+		interval = jobs.RepublishInterval
+	}
+
+	if delay == 0 {
+		delay = jobs.RepublishDelay
+	}
+
+	go jobs.CullJob(lp.DHT, ttl, jobs.CullInterval, lp.stop)
+
+	go jobs.RepublishJob(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+		defer cancel()
+
+		return lp.Publish(ctx)
+	}, lp.entryChanged, interval, delay, lp.stop)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		<-lp.stop
+		cancel()
+	}()
+
+	go lp.provideNew(ctx)
+
+	go jobs.RepublishJob(func() error {
+		pctx, cancel := context.WithTimeout(ctx, TermRepublishInterval)
+		defer cancel()
+
+		return lp.ProvideTerms(pctx)
+	}, nil, TermRepublishInterval, 0, lp.stop)
+
+	go jobs.RepublishJob(func() error {
+		pctx, cancel := context.WithTimeout(ctx, ProvideAllTimeout)
+		defer cancel()
+
+		return lp.ProvidePosts(pctx)
+	}, nil, ProviderRepublishInterval, 0, lp.stop)
+}
+
+// Announces our entry to the closest peers to our address that answer, as
+// they are who will be asked for it.
+func (lp *LocalPeer) Publish(ctx context.Context) error {
+	closest, err := lp.DHT.FindNodes(ctx, lp, *lp.Address())
+
+	if err != nil {
+		return err
+	}
+
+	if len(closest) == 0 {
+		return errors.New("No peers to publish to")
+	}
+
+	published := 0
+
+	for _, i := range closest {
+		peer, err := lp.connectPair(i)
+
+		if err != nil {
+			continue
+		}
+
+		err = peer.AnnounceContext(ctx, lp)
+
+		if err != nil {
+			s, _ := i.Key().String()
+			log.WithFields(log.Fields{"peer": s, "reason": err.Error()}).Info("Failed to announce")
+			continue
+		}
+
+		published++
+	}
+
+	log.WithField("peers", published).Info("Published entry")
+
+	if published == 0 {
+		return errors.New("Entry was not published to any peer")
+	}
+
+	return nil
+}
+
 func (lp *LocalPeer) seedExplore(in chan dht.KeyValue) {
 	closest, err := lp.DHT.FindClosest(*lp.Address())
 
@@ -1,190 +1,631 @@
 package libzif_test
 
 import (
+	"context"
 	"fmt"
-	"strconv"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	zif "github.com/zif/zif"
+	"github.com/zif/zif/data"
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/proto"
+	"github.com/zif/zif/sim"
 )
 
-func CreateLocalPeer(name string, port int) zif.LocalPeer {
-	var lp zif.LocalPeer
+const ArchInfoHash = "657c483dc66c1f248fc2eda5f5682ea557233e7a"
+const UbuntuInfoHash = "9f9165d9a281a9b8e782cd5176bbcc8256fd1871"
 
-	lp.GenerateKey()
-	lp.Setup()
-	lp.RoutingTable.Setup(lp.ZifAddress)
+var arch = data.Post{
+	InfoHash:   ArchInfoHash,
+	Title:      "Arch Linux 2015-09-03",
+	Size:       100,
+	FileCount:  1,
+	Seeders:    10,
+	UploadDate: 1472860800,
+}
 
-	lp.Entry.Name = name
-	lp.Entry.Port = port
-	lp.Entry.PublicAddress = "127.0.0.1"
-	lp.Entry.Desc = "Decentralize all the things!"
-	lp.Entry.PublicKey = lp.PublicKey
-	lp.Entry.ZifAddress = lp.ZifAddress
+var ubuntu = data.Post{
+	InfoHash:   UbuntuInfoHash,
+	Title:      "Ubuntu Linux 16.04.1",
+	Size:       101,
+	FileCount:  1,
+	Seeders:    9,
+	UploadDate: 1472860800,
+}
 
-	lp.Database = zif.NewDatabase(fmt.Sprintf("test-%s.db", name))
-	lp.Database.Connect()
+func CreateNetwork(n int, t *testing.T) *sim.Network {
+	network, err := sim.NewNetwork(n)
 
-	lp.SignEntry()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
 
-	lp.Listen("0.0.0.0:" + strconv.Itoa(port))
+	err = network.Bootstrap()
 
-	return lp
+	if err != nil {
+		network.Close()
+		t.Fatal(err.Error())
+	}
+
+	return network
 }
 
-func BootstrapLocalPeer(lp *zif.LocalPeer, peer *zif.LocalPeer, t *testing.T) {
-	p, err := lp.ConnectPeerDirect(peer.Entry.PublicAddress + ":" +
-		strconv.Itoa(peer.Entry.Port))
+// Does a *simple* test of announcing.
+// Further testig with a much larger number of networked peers (over the internet)
+// is definitely needed.
+func TestLocalPeerAnnounce(t *testing.T) {
+	network := CreateNetwork(3, t)
+	defer network.Close()
+
+	// Both peers announced to the initial peer when bootstrapping.
+	for i := 1; i < 3; i++ {
+		addr := network.Peers[i].Address()
+
+		if !network.Peers[0].DHT.Has(*addr) {
+			t.Errorf("Announce from peer %d not stored", i)
+		}
+	}
+
+	// After bootstrapping, the last peer should be able to resolve the first
+	// peer that announced.
+	entry, err := network.Peers[2].Resolve(network.Address(1))
 
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
-	p.ConnectClient(lp)
+	if !entry.Address.Equals(network.Peers[1].Address()) {
+		t.Error("Resolved incorrect entry")
+	}
+}
+
+func TestLocalPeerPosts(t *testing.T) {
+	network := CreateNetwork(2, t)
+	defer network.Close()
+
+	network.AddPost(0, arch)
+	network.AddPost(0, ubuntu)
 
-	stream, err := p.Bootstrap(&lp.RoutingTable)
+	posts, err := network.Search(1, 0, "linux")
 
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
-	stream.Close()
+	if len(posts) != 2 {
+		t.Fatal("Incorrect post count returned")
+	}
+
+	posts, err = network.Search(1, 0, "ubuntu")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
 
+	if len(posts) != 1 || posts[0].InfoHash != UbuntuInfoHash {
+		t.Error("Remote post search failed")
+	}
 }
 
-// Does a *simple* test of announcing.
-// Further testig with a much larger number of networked peers (over the internet)
-// is definitely needed.
-func TestLocalPeerAnnounce(t *testing.T) {
-	log.SetLevel(log.DebugLevel)
-	// both peers know this one
-	lp_initial := CreateLocalPeer("initial", 5050)
+func TestLocalPeerAddPostCount(t *testing.T) {
+	network := CreateNetwork(1, t)
+	defer network.Close()
+
+	lp := network.Peers[0]
+
+	if err := network.AddPost(0, arch); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The insert fails, so nothing about the entry should change.
+	lp.Database.Close()
+
+	if _, err := lp.AddPost(ubuntu, false); err == nil {
+		t.Fatal("Post added to a closed database")
+	}
+
+	entry := lp.CopyEntry()
+
+	if entry.PostCount != 1 {
+		t.Errorf("Post count is %d, want 1", entry.PostCount)
+	}
+
+	if err := entry.Verify(); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestLocalPeerRecent(t *testing.T) {
+	network := CreateNetwork(2, t)
+	defer network.Close()
+
+	network.AddPost(0, arch)
+	network.AddPost(0, ubuntu)
+
+	peer, err := network.Peers[1].ConnectPeer(network.Address(0))
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	posts, stream, err := peer.Recent(0)
 
-	// this peers announces itself
-	lp_announcer := CreateLocalPeer("announcer", 5051)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
 
-	// This peer should be able to resolve the announcers address after it announces
-	lp_test := CreateLocalPeer("test", 5052)
+	stream.Close()
 
-	defer lp_initial.Close()
-	defer lp_announcer.Close()
-	defer lp_test.Close()
+	if len(posts) != 2 {
+		t.Fatal("Incorrect post count returned")
+	}
+}
 
-	BootstrapLocalPeer(&lp_announcer, &lp_initial, t)
-	BootstrapLocalPeer(&lp_test, &lp_initial, t)
+func TestLocalPeerMirror(t *testing.T) {
+	network := CreateNetwork(2, t)
+	defer network.Close()
 
-	// announce the test to the initial peer
-	peer, err := lp_test.ConnectPeer(lp_initial.ZifAddress.Encode())
+	network.AddPost(0, arch)
+	network.AddPost(0, ubuntu)
+
+	err := network.Mirror(1, 0)
 
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
-	peer.Announce(&lp_test)
-	////////////////////////////////////////////
+	if !network.Peers[1].Databases.Has(network.Address(0)) {
+		t.Fatal("Mirrored database not stored")
+	}
+
+	db, _ := network.Peers[1].Databases.Get(network.Address(0))
+
+	if db.(*data.Database).PostCount() != 2 {
+		t.Error("Incorrect number of posts mirrored")
+	}
+}
+
+func TestLocalPeerMirrorSeeds(t *testing.T) {
+	network := CreateNetwork(3, t)
+	defer network.Close()
+
+	// Enough for a few pieces, the last only partly full.
+	count := data.PieceSize*2 + 10
+
+	if err := network.AddPosts(0, manyPosts(0, count)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Peer 1 then becomes a seed of peer 0.
+	if err := network.Mirror(1, 0); err != nil {
+		t.Fatal(err.Error())
+	}
 
-	if lp_initial.RoutingTable.NumPeers() != 2 {
-		t.Fatal("Failed to store announcements properly")
+	if len(network.Peers[0].CopyEntry().Seeds) != 1 {
+		t.Fatal("Mirroring peer not registered as a seed")
 	}
 
-	// announce the announcer to the initial peer
-	peer, err = lp_announcer.ConnectPeer(lp_initial.ZifAddress.Encode())
+	if !network.Peers[1].Collections.Has(network.Address(0)) {
+		t.Error("Signed collection not kept")
+	}
+
+	// Peer 2 mirrors from both, a piece at a time so that both are used.
+	peer, err := network.Connect(2, 0)
 
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
-	peer.Announce(&lp_announcer)
-	////////////////////////////////////////////
+	dir := t.TempDir()
+	db := data.NewDatabase(filepath.Join(dir, "posts.db"))
+
+	if err = db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
 
-	if lp_initial.RoutingTable.NumPeers() <= 1 {
-		t.Fatal("Failed to store announcements properly")
+	defer db.Close()
+
+	mirror := zif.NewMirror(peer, db, dir)
+	mirror.RangeSize = 1
+	mirror.Connect = network.Peers[2].ConnectPeerContext
+
+	if err = mirror.Run(context.Background(), nil); err != nil {
+		t.Fatal(err.Error())
 	}
 
-	// block until the test peer recieved a msg (should be an announce forward)
-	<-lp_test.MsgChan
+	seeded, _ := network.Peers[1].Databases.Get(network.Address(0))
 
-	if !lp_test.RoutingTable.FindClosest(lp_initial.ZifAddress, 1)[0].
-		ZifAddress.Equals(&lp_initial.ZifAddress) {
-		t.Fatal("Announce forwarding failed")
+	for _, i := range []*data.Database{seeded.(*data.Database), db} {
+		if i.PostCount() != uint(count) {
+			t.Fatalf("Mirrored %d posts", i.PostCount())
+		}
+
+		// Ids must match the origin, or pieces would not hash the same.
+		post, err := i.QueryPostId(uint(count))
+
+		if err != nil || post.InfoHash != fmt.Sprintf("f%039x", count-1) {
+			t.Error("Posts mirrored out of order")
+		}
 	}
 }
 
-func TestLocalPeerPosts(t *testing.T) {
-	source, _ := zif.CryptoRandBytes(20)
-	// the remote we are requesting posts from
-	lp_remote := CreateLocalPeer("remote", 5053)
-	lp_requester := CreateLocalPeer("requester", 5054)
+func TestLocalPeerMirrorResume(t *testing.T) {
+	network := CreateNetwork(2, t)
+	defer network.Close()
+
+	count := data.PieceSize*2 + 10
+
+	if err := network.AddPosts(0, manyPosts(0, count)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	peer, err := network.Connect(1, 0)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	dir := t.TempDir()
+	db := data.NewDatabase(filepath.Join(dir, "posts.db"))
+
+	if err = db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer db.Close()
+
+	// Mirrors, returning the first piece that had to be fetched.
+	mirror := func() int {
+		onPiece := make(chan int, data.PieceSize)
+
+		if err := zif.NewMirror(peer, db, dir).Run(context.Background(), onPiece); err != nil {
+			t.Fatal(err.Error())
+		}
 
-	defer lp_remote.Close()
-	defer lp_requester.Close()
+		first := -1
 
-	BootstrapLocalPeer(&lp_requester, &lp_remote, t)
+		for i := range onPiece {
+			if first == -1 {
+				first = i
+			}
+		}
 
-	arch := zif.NewPost(ArchInfoHash, "Arch Linux 2015-09-03", 100, 10, 1472860800, source)
-	ubuntu := zif.NewPost(UbuntuInfoHash, "Ubuntu Linux 16.04.1", 101, 9, 1472860800, source)
+		if db.PostCount() != network.Peers[0].Database.PostCount() {
+			t.Fatalf("Mirrored %d posts", db.PostCount())
+		}
 
-	lp_remote.AddPost(arch, false)
-	lp_remote.AddPost(ubuntu, false)
-	lp_remote.Database.GenerateFts(0)
+		return first
+	}
+
+	if first := mirror(); first != 0 {
+		t.Fatalf("First mirror started from piece %d", first)
+	}
 
-	peer, err := lp_requester.ConnectPeer(lp_remote.ZifAddress.Encode())
+	if first := mirror(); first != -1 {
+		t.Errorf("Mirror of an unchanged collection fetched piece %d", first)
+	}
+
+	// As if stopped after the first piece.
+	path := filepath.Join(dir, "mirror.json")
+	state, err := zif.LoadMirrorState(path)
 
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
-	posts, stream, err := peer.Search("linux", 0)
-	defer stream.Close()
+	state.Verified = 1
+	state.Ends = state.Ends[:1]
+	state.Save(path)
+
+	if first := mirror(); first != 1 {
+		t.Errorf("Interrupted mirror resumed from piece %d", first)
+	}
+
+	// The partly full last piece changes, so it is fetched again.
+	if err = network.AddPosts(0, manyPosts(count, data.PieceSize)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if first := mirror(); first != 2 {
+		t.Errorf("Changed collection resumed from piece %d", first)
+	}
+}
+
+// Posts that differ only by infohash, numbered from start.
+func manyPosts(start, count int) []data.Post {
+	posts := make([]data.Post, count)
+
+	for i := range posts {
+		posts[i] = arch
+		// Not all digits, or sqlite will store it as a number.
+		posts[i].InfoHash = fmt.Sprintf("f%039x", start+i)
+	}
+
+	return posts
+}
+
+func TestLocalPeerPex(t *testing.T) {
+	network := CreateNetwork(4, t)
+	defer network.Close()
+
+	peer, err := network.Connect(3, 0)
 
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
-	if len(posts) != 2 {
-		t.Fatal("Incorrect post count returned")
+	stream, pairs, err := peer.Pex(proto.MaxPexEntries)
+
+	if stream != nil {
+		stream.Close()
 	}
 
-	if posts[0].InfoHash != UbuntuInfoHash || posts[1].InfoHash != ArchInfoHash {
-		t.Error("Remote post search failed")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	found := make(map[string]bool)
+
+	for _, i := range pairs {
+		s, _ := i.Key().String()
+		found[s] = true
+	}
+
+	if found[network.Address(3)] {
+		t.Error("Peer exchange returned the peer asking")
+	}
+
+	for i := 1; i < 3; i++ {
+		if !found[network.Address(i)] {
+			t.Errorf("Peer exchange did not return peer %d", i)
+		}
 	}
 }
 
-func TestLocalPeerRecent(t *testing.T) {
-	source, _ := zif.CryptoRandBytes(20)
-	lp_remote := CreateLocalPeer("remote", 5055)
-	lp_requester := CreateLocalPeer("requester", 5056)
+func TestLocalPeerPublish(t *testing.T) {
+	network := CreateNetwork(4, t)
+	defer network.Close()
 
-	defer lp_remote.Close()
-	defer lp_requester.Close()
+	lp := network.Peers[3]
+	lp.RepublishInterval = time.Hour
+	lp.RepublishDelay = time.Millisecond * 10
+	lp.StartMaintenance()
 
-	BootstrapLocalPeer(&lp_requester, &lp_remote, t)
+	// The others only see the new name once the change is republished.
+	lp.UpdateEntry(func(e *proto.Entry) {
+		e.Name = "renamed"
+	})
 
-	arch := zif.NewPost(ArchInfoHash, "Arch Linux 2015-09-03", 100, 10, 1472860800, source)
-	ubuntu := zif.NewPost(UbuntuInfoHash, "Ubuntu Linux 16.04.1", 101, 9, 1472860800, source)
+	deadline := time.Now().Add(time.Second * 10)
 
-	lp_remote.AddPost(arch, false)
-	lp_remote.AddPost(ubuntu, false)
-	lp_remote.Database.GenerateFts(0)
+	for i := 0; i < 3; i++ {
+		for {
+			kv, _ := network.Peers[i].DHT.Query(*lp.Address())
 
-	peer, err := lp_requester.ConnectPeer(lp_remote.ZifAddress.Encode())
+			if kv != nil {
+				entry, err := proto.JsonToEntry(kv.Value())
+
+				if err == nil && entry.Name == "renamed" {
+					break
+				}
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("Changed entry not published to peer %d", i)
+			}
+
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+// A failed liveness check is counted by the DHT once, not again for failing
+// to connect.
+func TestLocalPeerCheckLiveness(t *testing.T) {
+	network, err := sim.NewNetwork(2)
 
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
-	posts, stream, err := peer.Recent(0)
-	defer stream.Close()
+	defer network.Close()
+
+	lp := network.Peers[0]
+	dat, _ := network.Peers[1].CopyEntry().Json()
+	kv := dht.NewKeyValue(*network.Peers[1].Address(), dat)
+
+	if err = lp.DHT.Insert(kv); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	network.Peers[1].Server.Close()
+
+	if lp.CheckLiveness(kv) == nil {
+		t.Fatal("Closed peer is live")
+	}
+
+	if n := lp.DHT.Unanswered(*kv.Key()); n != 0 {
+		t.Errorf("Liveness check counted %d times outside the DHT", n)
+	}
+
+	// Anything else that fails to connect is counted.
+	if _, _, err = lp.FindValue(context.Background(), kv, *kv.Key()); err == nil {
+		t.Fatal("Found a value on a closed peer")
+	}
+
+	if n := lp.DHT.Unanswered(*kv.Key()); n != 1 {
+		t.Errorf("Failed lookup counted %d times", n)
+	}
+}
+
+func TestLocalPeerProviders(t *testing.T) {
+	network := CreateNetwork(5, t)
+	defer network.Close()
+
+	key := proto.ProviderKey(ArchInfoHash)
+	ctx := context.Background()
+
+	for _, i := range []int{1, 2} {
+		if err := network.AddPost(i, arch); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if err := network.Peers[i].Provide(ctx, key); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// Found from a magnet link, by a peer without the post.
+	cs := zif.NewCommandServer(network.Peers[4])
+	magnet := "magnet:?xt=urn:btih:" + strings.ToUpper(ArchInfoHash) + "&dn=arch"
+	res := cs.FindProviders(ctx, zif.CommandFindProviders{InfoHash: magnet})
+
+	if !res.IsOK {
+		t.Fatal(res.Error.Error())
+	}
+
+	found := make(map[string]bool)
+
+	for _, i := range res.Result.([]string) {
+		found[i] = true
+	}
+
+	if len(found) != 2 || !found[network.Address(1)] || !found[network.Address(2)] {
+		t.Errorf("Found providers %v", res.Result)
+	}
+
+	records, err := network.Peers[4].FindProviders(ctx, proto.ProviderKey(UbuntuInfoHash))
+
+	if err != nil || len(records) != 0 {
+		t.Error("Found providers for a post no one has")
+	}
+}
+
+func TestLocalPeerNetworkSearch(t *testing.T) {
+	network := CreateNetwork(5, t)
+	defer network.Close()
+
+	ctx := context.Background()
+
+	if err := network.AddPost(1, arch); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := network.AddPost(1, ubuntu); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := network.AddPost(2, arch); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, i := range []int{1, 2} {
+		if err := network.Peers[i].ProvideAll(ctx); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	cs := zif.NewCommandServer(network.Peers[4])
+	res := cs.NetworkSearch(ctx, zif.CommandNetworkSearch{zif.CommandSuggest{"linux"}, 0})
+
+	if !res.IsOK {
+		t.Fatal(res.Error.Error())
+	}
+
+	results := res.Result.([]*zif.NetworkResult)
+
+	if len(results) != 2 {
+		t.Fatalf("Found %d results, expected 2", len(results))
+	}
+
+	if results[0].InfoHash != ArchInfoHash || len(results[0].Sources) != 2 {
+		t.Errorf("Expected arch from both peers first, got %s from %v", results[0].Title, results[0].Sources)
+	}
+
+	if results[1].InfoHash != UbuntuInfoHash || len(results[1].Sources) != 1 ||
+		results[1].Sources[0] != network.Address(1) {
+		t.Errorf("Expected ubuntu from peer 1, got %s from %v", results[1].Title, results[1].Sources)
+	}
+
+	if _, err := network.Peers[4].NetworkSearch(ctx, "a of", 0); err == nil {
+		t.Error("Searched without any terms")
+	}
+}
+
+// Posts added after terms are provided can be searched for straight away,
+// rather than once terms are next republished.
+func TestLocalPeerProvideNew(t *testing.T) {
+	network := CreateNetwork(5, t)
+	defer network.Close()
+
+	if err := network.AddPost(1, arch); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	network.Peers[1].StartMaintenance()
+
+	// Waits for a term to be provided by peer 1.
+	found := func(term string) {
+		deadline := time.Now().Add(time.Second * 10)
+
+		for {
+			records, _ := network.Peers[4].FindProviders(context.Background(), proto.TermKey(term))
+
+			if len(records) != 0 {
+				return
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("Term %s not provided", term)
+			}
+
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	found("arch")
+
+	if err := network.AddPost(1, ubuntu); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	found("ubuntu")
+}
+
+func TestLocalPeerMinDifficulty(t *testing.T) {
+	network, err := sim.NewNetwork(3)
 
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
-	if len(posts) != 2 {
-		t.Fatal("Incorrect post count returned")
+	defer network.Close()
+
+	network.Peers[0].Server.MinDifficulty = 8
+
+	if _, err := network.Connect(1, 0); err == nil {
+		t.Fatal("Connected without enough work")
 	}
 
-	if posts[0].InfoHash != UbuntuInfoHash || posts[1].InfoHash != ArchInfoHash {
-		t.Error("Remote post search failed")
+	if err := network.Peers[1].Work(context.Background(), 8, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := network.Connect(1, 0); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Nor do we connect to peers without enough work.
+	network.Peers[2].MinDifficulty = 8
+
+	if _, err := network.Connect(2, 0); err == nil {
+		t.Error("Connected to a peer without enough work")
+	}
+
+	if _, err := network.Connect(2, 1); err != nil {
+		t.Error(err.Error())
 	}
 }
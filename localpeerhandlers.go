@@ -2,10 +2,12 @@ package libzif
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"encoding/json"
-	"errors"
+	"io"
 	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -16,6 +18,46 @@ import (
 
 const MaxSearchLength = 256
 
+// How often a peer may send each type of message, and how many it may send in
+// a burst.
+const (
+	MessageRate  = time.Second / 10
+	MessageBurst = 20
+)
+
+// Peer exchange replies are larger, and a peer has no reason to ask often.
+const (
+	PexRate  = time.Second * 10
+	PexBurst = 3
+)
+
+// Registers the handlers for the core message types, and the middleware that
+// runs around every message.
+func (lp *LocalPeer) registerHandlers() {
+	router := &lp.Server.Router
+
+	router.Use(
+		proto.Logging,
+		lp.Metrics.Middleware,
+		proto.RequirePeer,
+		proto.RateLimit(MessageRate, MessageBurst),
+	)
+
+	router.Register(proto.ProtoDhtAnnounce, lp.HandleAnnounce)
+	router.Register(proto.ProtoDhtQuery, lp.HandleQuery)
+	router.Register(proto.ProtoDhtFindClosest, lp.HandleFindClosest)
+	router.Register(proto.ProtoSearch, lp.HandleSearch)
+	router.Register(proto.ProtoRecent, lp.HandleRecent)
+	router.Register(proto.ProtoPopular, lp.HandlePopular)
+	router.Register(proto.ProtoRequestHashList, lp.HandleHashList)
+	router.Register(proto.ProtoRequestPiece, lp.HandlePiece)
+	router.Register(proto.ProtoRequestAddPeer, lp.HandleAddPeer)
+	router.Register(proto.ProtoPing, lp.HandlePing)
+	router.Register(proto.ProtoDhtAddProvider, lp.HandleAddProvider)
+	router.Register(proto.ProtoDhtGetProviders, lp.HandleGetProviders)
+	router.Register(proto.ProtoPex, proto.RateLimit(PexRate, PexBurst)(proto.ProtoPex, lp.HandlePex))
+}
+
 // TODO: Move this into some sort of handler object, can handle general requests.
 
 // TODO: While I think about it, move all these TODOs to issues or a separate
@@ -42,16 +84,17 @@ func (lp *LocalPeer) HandleQuery(msg *proto.Message) error {
 	}
 
 	if address.Equals(lp.Address()) {
-		log.WithField("name", lp.Entry.Name).Debug("Query for local peer")
+		entry := lp.CopyEntry()
+		log.WithField("name", entry.Name).Debug("Query for local peer")
 
 		var dat []byte
-		dat, err = lp.Entry.Json()
+		dat, err = entry.Json()
 
 		if err != nil {
 			return err
 		}
 
-		kv := dht.NewKeyValue(lp.Entry.Address, dat)
+		kv := dht.NewKeyValue(entry.Address, dat)
 		encoded, _ := json.Marshal(kv)
 		err = cl.WriteMessage(&proto.Message{Header: proto.ProtoDhtQuery, Content: encoded})
 
@@ -63,8 +106,10 @@ func (lp *LocalPeer) HandleQuery(msg *proto.Message) error {
 			return err
 		}
 
+		// The query was already accepted, so not having it is part of the
+		// reply rather than a failed request.
 		if kv == nil {
-			cl.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+			return cl.WriteError(proto.NewProtocolError(proto.ErrorNotFound, "No entry for %s", s))
 		}
 
 		encoded, _ := json.Marshal(kv)
@@ -95,9 +140,10 @@ func (lp *LocalPeer) HandleFindClosest(msg *proto.Message) error {
 	}
 
 	if address.Equals(lp.Address()) {
-		log.WithField("name", lp.Entry.Name).Debug("Query for local peer")
+		entry := lp.CopyEntry()
+		log.WithField("name", entry.Name).Debug("Query for local peer")
 
-		json, err := lp.Entry.Json()
+		json, err := entry.Json()
 
 		if err != nil {
 			return err
@@ -111,7 +157,7 @@ func (lp *LocalPeer) HandleFindClosest(msg *proto.Message) error {
 			return err
 		}
 
-		kv := dht.NewKeyValue(lp.Entry.Address, json)
+		kv := dht.NewKeyValue(entry.Address, json)
 
 		err = cl.WriteMessage(kv)
 
@@ -139,7 +185,7 @@ func (lp *LocalPeer) HandleFindClosest(msg *proto.Message) error {
 }
 
 func (lp *LocalPeer) HandleAnnounce(msg *proto.Message) error {
-	cl := proto.NewClient(msg.Stream)
+	cl := msg.Client
 
 	defer msg.Stream.Close()
 
@@ -156,29 +202,118 @@ func (lp *LocalPeer) HandleAnnounce(msg *proto.Message) error {
 	json, _ := entry.Json()
 	err = lp.DHT.Insert(dht.NewKeyValue(entry.Address, json))
 
-	if err == nil {
-		cl.WriteMessage(&proto.Message{Header: proto.ProtoOk})
-		log.WithField("peer", es).Info("Saved new peer")
+	if proto.IsInvalidEntry(err) {
+		lp.penalise(msg.From, err)
+	}
 
-	} else {
-		cl.WriteMessage(&proto.Message{Header: proto.ProtoNo})
-		return errors.New("Failed to save entry")
+	if err != nil {
+		return proto.NewProtocolError(proto.ErrorInvalid, "Failed to save entry: %s", err.Error())
 	}
 
-	return nil
+	log.WithField("peer", es).Info("Saved new peer")
+
+	return cl.WriteMessage(&proto.Message{Header: proto.ProtoOk})
+
+}
+
+// Stores a provider record sent by a peer, so long as it verifies and we are
+// one of the closest peers to its key.
+func (lp *LocalPeer) HandleAddProvider(msg *proto.Message) error {
+	pr := proto.ProviderRecord{}
+
+	if err := msg.Decode(&pr); err != nil {
+		return proto.NewProtocolError(proto.ErrorInvalid, "Invalid provider record")
+	}
+
+	if err := pr.Verify(); err != nil {
+		lp.penalise(msg.From, err)
+		return proto.NewProtocolError(proto.ErrorInvalid, "Invalid provider record: %s", err.Error())
+	}
+
+	// Otherwise anyone could fill our store with records for keys that are
+	// nothing to do with us.
+	if !lp.DHT.Closest(pr.Key) {
+		return proto.NewProtocolError(proto.ErrorInvalid, "Not one of the closest peers to key")
+	}
+
+	dat, err := pr.Json()
+
+	if err != nil {
+		return err
+	}
+
+	err = lp.DHT.AddProvider(pr.Key, &dht.Provider{Provider: pr.Provider, Value: dat, Expires: pr.Expires()})
+
+	if err != nil {
+		return proto.NewProtocolError(proto.ErrorTooLarge, "Failed to store provider record: %s", err.Error())
+	}
+
+	ks, _ := pr.Key.String()
+	ps, _ := pr.Provider.String()
+	log.WithFields(log.Fields{"key": ks, "provider": ps}).Info("Stored provider record")
+
+	return msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoOk})
+}
+
+// Replies with the provider records held for a key, then the closest entries
+// to it, so that a lookup can carry on.
+func (lp *LocalPeer) HandleGetProviders(msg *proto.Message) error {
+	if len(msg.Content) != dht.AddressBinarySize {
+		return proto.NewProtocolError(proto.ErrorInvalid, "Invalid provider key")
+	}
+
+	key := dht.Address{Raw: msg.Content}
+	providers := lp.DHT.Providers(key)
+	records := make([]json.RawMessage, 0, len(providers))
 
+	for _, i := range providers {
+		records = append(records, i.Value)
+	}
+
+	dat, err := json.Marshal(records)
+
+	if err != nil {
+		return err
+	}
+
+	err = msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoProviders, Content: dat})
+
+	if err != nil {
+		return err
+	}
+
+	pairs, err := lp.DHT.FindClosest(key)
+
+	if err != nil {
+		return err
+	}
+
+	results := &proto.Message{Header: proto.ProtoEntry}
+	results.WriteInt(len(pairs))
+
+	if err = msg.Client.WriteMessage(results); err != nil {
+		return err
+	}
+
+	for _, i := range pairs {
+		if err = msg.Client.WriteMessage(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (lp *LocalPeer) HandleSearch(msg *proto.Message) error {
 	if len(msg.Content) > MaxSearchLength {
-		return errors.New("Search query too long")
+		return proto.NewProtocolError(proto.ErrorTooLarge, "Search query too long")
 	}
 
 	sq := proto.MessageSearchQuery{}
 	err := msg.Decode(&sq)
 
 	if err != nil {
-		return err
+		return proto.NewProtocolError(proto.ErrorInvalid, "Invalid search query")
 	}
 
 	log.WithField("query", sq.Query).Info("Search recieved")
@@ -201,9 +336,7 @@ func (lp *LocalPeer) HandleSearch(msg *proto.Message) error {
 		Content: json,
 	}
 
-	msg.Client.WriteMessage(post_msg)
-
-	return nil
+	return msg.Client.WriteMessage(post_msg)
 }
 
 func (lp *LocalPeer) HandleRecent(msg *proto.Message) error {
@@ -212,7 +345,7 @@ func (lp *LocalPeer) HandleRecent(msg *proto.Message) error {
 	page, err := strconv.Atoi(string(msg.Content))
 
 	if err != nil {
-		return err
+		return proto.NewProtocolError(proto.ErrorInvalid, "Invalid page")
 	}
 
 	recent, err := lp.Database.QueryRecent(page)
@@ -232,9 +365,7 @@ func (lp *LocalPeer) HandleRecent(msg *proto.Message) error {
 		Content: recent_json,
 	}
 
-	msg.Client.WriteMessage(resp)
-
-	return nil
+	return msg.Client.WriteMessage(resp)
 }
 
 func (lp *LocalPeer) HandlePopular(msg *proto.Message) error {
@@ -243,7 +374,7 @@ func (lp *LocalPeer) HandlePopular(msg *proto.Message) error {
 	page, err := strconv.Atoi(string(msg.Content))
 
 	if err != nil {
-		return err
+		return proto.NewProtocolError(proto.ErrorInvalid, "Invalid page")
 	}
 
 	recent, err := lp.Database.QueryPopular(page)
@@ -263,9 +394,7 @@ func (lp *LocalPeer) HandlePopular(msg *proto.Message) error {
 		Content: recent_json,
 	}
 
-	msg.Client.WriteMessage(resp)
-
-	return nil
+	return msg.Client.WriteMessage(resp)
 }
 
 func (lp *LocalPeer) HandleHashList(msg *proto.Message) error {
@@ -274,17 +403,36 @@ func (lp *LocalPeer) HandleHashList(msg *proto.Message) error {
 	s, _ := address.String()
 	log.WithField("address", s).Info("Collection request recieved")
 
-	var sig []byte
+	if !address.Equals(lp.Address()) {
+		// We can only hand out what the owner signed for peers we mirror.
+		mcol, ok := lp.Collections.Get(s)
 
-	if address.Equals(lp.Address()) {
-		sig = lp.Sign(lp.Collection.HashList)
-	} else {
-		// this means that the hash list wanted does not belong to this peer
-		// TODO: sort out getting a hash list for a peer that has been mirrored
+		if !ok {
+			return proto.NewProtocolError(proto.ErrorNotFound, "Collection not found")
+		}
+
+		return lp.sendCollection(msg, mcol.(*proto.MessageCollection))
+	}
+
+	mhl := proto.MessageCollection{
+		Hash:     lp.Collection.Hash(),
+		HashList: lp.Collection.HashList,
+		Size:     len(lp.Collection.HashList) / 32,
+		Encoding: lp.Collection.Encoding,
+	}
+	mhl.Signature = lp.Sign(mhl.SignedData())
+
+	return lp.sendCollection(msg, &mhl)
+}
+
+func (lp *LocalPeer) sendCollection(msg *proto.Message, mhl *proto.MessageCollection) error {
+	// Older peers can only hash pieces the legacy way.
+	if mhl.Encoding != data.EncodingLegacy &&
+		!msg.Client.Agreement().Has(proto.FeatureCanonical) {
+		return proto.NewProtocolError(proto.ErrorUnsupported, "Collection uses an encoding this peer does not support")
 	}
 
-	mhl := proto.MessageCollection{lp.Collection.Hash(), lp.Collection.HashList, len(lp.Collection.HashList) / 32, sig}
-	data, err := mhl.Encode()
+	dat, err := mhl.Encode()
 
 	if err != nil {
 		return err
@@ -292,12 +440,10 @@ func (lp *LocalPeer) HandleHashList(msg *proto.Message) error {
 
 	resp := &proto.Message{
 		Header:  proto.ProtoHashList,
-		Content: data,
+		Content: dat,
 	}
 
-	msg.Client.WriteMessage(resp)
-
-	return nil
+	return msg.Client.WriteMessage(resp)
 }
 
 func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
@@ -311,12 +457,12 @@ func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
 	}).Info("Recieved piece request")
 
 	if err != nil {
-		return err
+		return proto.NewProtocolError(proto.ErrorInvalid, "Invalid piece request")
 	}
 
 	var posts chan *data.Post
 
-	lps, _ := lp.Entry.Address.String()
+	lps, _ := lp.Address().String()
 	if mrp.Address == lps {
 		posts = lp.Database.QueryPiecePosts(mrp.Id, mrp.Length, true)
 
@@ -325,7 +471,7 @@ func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
 		posts = db.(*data.Database).QueryPiecePosts(mrp.Id, mrp.Length, true)
 
 	} else {
-		return errors.New("Piece not found")
+		return proto.NewProtocolError(proto.ErrorNotFound, "Piece not found")
 	}
 
 	// Buffered writer -> gzip -> net
@@ -335,15 +481,43 @@ func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
 	// The former may allow for database reads to occur a little faster though.
 	// buffer both?
 	bw := bufio.NewWriter(msg.Stream)
-	gzw := gzip.NewWriter(bw)
+	var w io.Writer = bw
+
+	// Peers only compress if both sides have agreed to.
+	compress := msg.Client.Agreement().Has(proto.FeatureGzip)
+	var gzw *gzip.Writer
+
+	if compress {
+		gzw = gzip.NewWriter(bw)
+		w = gzw
+	}
+
+	encoding := data.EncodingLegacy
+
+	if msg.Client.Agreement().Has(proto.FeatureCanonical) {
+		encoding = data.EncodingCanonical
+	}
 
 	for i := range posts {
-		i.Write("|", "", gzw)
+		err = i.Encode(encoding, w)
+
+		if err != nil {
+			// Let the query finish, rather than leave it blocked.
+			go func() {
+				for range posts {
+				}
+			}()
+
+			return err
+		}
 	}
 
-	(&data.Post{Id: -1}).Write("|", "", gzw)
+	// A post with an id of -1 marks the end.
+	(&data.Post{Id: -1}).Encode(encoding, w)
 
-	gzw.Flush()
+	if compress {
+		gzw.Flush()
+	}
 	bw.Flush()
 
 	log.Info("Sent all")
@@ -364,25 +538,24 @@ func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
 	s, _ := address.String()
 
 	if len(address.Raw) != dht.AddressBinarySize {
-		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
-		return errors.New("Invalid binary address size")
+		return proto.NewProtocolError(proto.ErrorInvalid, "Invalid binary address size")
 	}
 
-	if address.Equals(lp.Address()) {
-		log.WithField("peer", s).Info("New seed peer")
+	// The peer asking is the one that now seeds address.
+	if msg.From == nil {
+		return proto.NewProtocolError(proto.ErrorInvalid, "Seed not verified")
+	}
 
-		add := true
+	seed, _ := msg.From.Bytes()
 
-		for _, i := range lp.Entry.Seeds {
-			if address.Equals(&dht.Address{i}) {
-				add = false
-			}
-		}
+	if address.Equals(lp.Address()) {
+		from, _ := msg.From.String()
+		log.WithField("peer", from).Info("New seed peer")
 
-		if add {
-			b, _ := address.Bytes()
-			lp.Entry.Seeds = append(lp.Entry.Seeds, b)
-		}
+		// Seeds are not signed, so there is nothing to sign again.
+		lp.entryLock.Lock()
+		lp.Entry.Seeds = addSeed(lp.Entry.Seeds, seed)
+		lp.entryLock.Unlock()
 
 	} else {
 		// then we need to see if we have the entry for that address
@@ -392,6 +565,10 @@ func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
 			return err
 		}
 
+		if kv == nil {
+			return proto.NewProtocolError(proto.ErrorNotFound, "No entry for %s", s)
+		}
+
 		decoded, err := proto.JsonToEntry(kv.Value())
 
 		if err != nil {
@@ -401,8 +578,7 @@ func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
 		// if the routing table contains the address we are looking for,
 		// register a new seed.
 		if decoded.Address.Equals(&address) {
-			b, _ := address.Bytes()
-			decoded.Seeds = append(decoded.Seeds, b)
+			decoded.Seeds = addSeed(decoded.Seeds, seed)
 		}
 
 		json, err := decoded.Json()
@@ -413,9 +589,22 @@ func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
 		lp.DHT.Insert(dht.NewKeyValue(address, json))
 	}
 
-	msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoOk})
+	return msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoOk})
+}
 
-	return nil
+// Once there are too many seeds for the entry to validate, the oldest goes.
+func addSeed(seeds [][]byte, seed []byte) [][]byte {
+	for _, i := range seeds {
+		if bytes.Equal(i, seed) {
+			return seeds
+		}
+	}
+
+	if len(seeds) >= proto.MaxSeeds {
+		seeds = seeds[len(seeds)-proto.MaxSeeds+1:]
+	}
+
+	return append(seeds, seed)
 }
 
 func (lp *LocalPeer) HandlePing(msg *proto.Message) error {
@@ -425,6 +614,61 @@ func (lp *LocalPeer) HandlePing(msg *proto.Message) error {
 	return msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoPong})
 }
 
+// Replies with a sample of the entries seen most recently, leaving out the
+// peer that asked. Only entries that verify are sent.
+func (lp *LocalPeer) HandlePex(msg *proto.Message) error {
+	n, err := msg.ReadInt()
+
+	if err != nil {
+		return proto.NewProtocolError(proto.ErrorInvalid, "Invalid entry count")
+	}
+
+	if n < 0 || n > proto.MaxPexEntries {
+		n = proto.MaxPexEntries
+	}
+
+	s, _ := msg.From.String()
+	log.WithFields(log.Fields{"peer": s, "count": n}).Info("Peer exchange")
+
+	pairs := make(dht.Pairs, 0, n)
+
+	// One extra, in case the peer asking is among them.
+	for _, i := range lp.DHT.Recent(n + 1) {
+		if len(pairs) >= n {
+			break
+		}
+
+		if i.Key().Equals(msg.From) {
+			continue
+		}
+
+		if _, err := proto.VerifyPair(i); err != nil {
+			continue
+		}
+
+		pairs = append(pairs, i)
+	}
+
+	results := &proto.Message{Header: proto.ProtoEntry}
+	results.WriteInt(len(pairs))
+
+	err = msg.Client.WriteMessage(results)
+
+	if err != nil {
+		return err
+	}
+
+	for _, i := range pairs {
+		err = msg.Client.WriteMessage(i)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (lp *LocalPeer) HandleCloseConnection(addr *dht.Address) {
 	s, _ := addr.String()
 	lp.Peers.Remove(s)
@@ -433,6 +677,8 @@ func (lp *LocalPeer) HandleCloseConnection(addr *dht.Address) {
 func (lp *LocalPeer) HandleHandshake(header proto.ConnHeader) (proto.NetworkPeer, error) {
 	peer := &Peer{}
 	peer.SetTCP(header)
+	lp.observe(header.Entry.Address, header.Client.RemoteAddr())
+
 	_, err := peer.ConnectServer()
 
 	if err != nil {
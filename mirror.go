@@ -0,0 +1,592 @@
+// Mirrors the collection of a peer from the peer itself and any of its seeds
+// at the same time. The signed hash list is fetched once, then the pieces
+// still needed are split into ranges, and each source takes ranges as it is
+// ready for them. Every piece is checked against the hash list, a range that
+// fails is handed to another source, and pieces are written to the database
+// in order so that post ids match those of the origin.
+
+package libzif
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zif/zif/data"
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/proto"
+)
+
+const (
+	// How many pieces are requested from a source at once, by default.
+	MirrorRangeSize = 16
+
+	// How far ahead of the database sources may download, in pieces. Pieces
+	// that arrive out of order are held in memory until they can be written.
+	MirrorWindow = MirrorRangeSize * 8
+
+	// How many times a range is tried before the mirror fails.
+	MirrorAttempts = 3
+
+	// A source that fails this many ranges is no longer used.
+	MirrorSourceFailures = 3
+
+	// How long to spend connecting to each seed.
+	MirrorConnectTimeout = time.Second * 10
+)
+
+type Mirror struct {
+	// Connects to seeds given their Zif address. If nil, only the origin is
+	// used.
+	Connect func(ctx context.Context, addr string) (*Peer, error)
+
+	// How many pieces to request from a source at once, defaults to
+	// MirrorRangeSize.
+	RangeSize int
+
+	// The signed collection, set once Run has fetched it.
+	Collection *proto.MessageCollection
+
+	origin *Peer
+	db     *data.Database
+	dir    string
+	state  *MirrorState
+}
+
+// Mirrors origin into db, storing the collection in dir. The origin may be a
+// seed for another peer, in which case that peer is mirrored.
+func NewMirror(origin *Peer, db *data.Database, dir string) *Mirror {
+	return &Mirror{origin: origin, db: db, dir: dir}
+}
+
+// A range of pieces still to be downloaded.
+type pieceRange struct {
+	start, length, attempts int
+}
+
+type mirroredPiece struct {
+	index int
+	piece *data.Piece
+}
+
+// Hands out ranges lowest first, but never further than MirrorWindow ahead of
+// the last piece written.
+type mirrorQueue struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	ranges []pieceRange
+	next   int
+	closed bool
+}
+
+func newMirrorQueue(next int) *mirrorQueue {
+	mq := &mirrorQueue{next: next}
+	mq.cond = sync.NewCond(&mq.lock)
+
+	return mq
+}
+
+// Blocks until a range is ready, false once the queue has been closed.
+func (mq *mirrorQueue) take() (pieceRange, bool) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	for {
+		if mq.closed {
+			return pieceRange{}, false
+		}
+
+		if len(mq.ranges) > 0 && mq.ranges[0].start < mq.next+MirrorWindow {
+			ret := mq.ranges[0]
+			mq.ranges = mq.ranges[1:]
+
+			return ret, true
+		}
+
+		mq.cond.Wait()
+	}
+}
+
+func (mq *mirrorQueue) put(r pieceRange) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	mq.ranges = append(mq.ranges, r)
+	sort.Slice(mq.ranges, func(i, j int) bool {
+		return mq.ranges[i].start < mq.ranges[j].start
+	})
+
+	mq.cond.Broadcast()
+}
+
+func (mq *mirrorQueue) advance(next int) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	mq.next = next
+	mq.cond.Broadcast()
+}
+
+func (mq *mirrorQueue) close() {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	mq.closed = true
+	mq.cond.Broadcast()
+}
+
+// Mirrors the collection, sending the index of each piece to onPiece as it is
+// written. onPiece may be nil, otherwise it is closed when Run returns.
+func (m *Mirror) Run(ctx context.Context, onPiece chan int) error {
+	if onPiece != nil {
+		defer close(onPiece)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	err := m.origin.CheckConnection(time.Second * 10)
+
+	if err != nil {
+		return err
+	}
+
+	entry, err := m.entry(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	s, _ := entry.Address.String()
+	log.WithField("peer", s).Info("Mirroring")
+
+	// What we had before, to compare with what the peer has now.
+	old, _ := LoadMirrorState(mirrorStatePath(m.dir))
+	oldList, _ := data.LoadCollection(filepath.Join(m.dir, "collection.dat"))
+
+	err = m.fetchCollection(ctx, entry)
+
+	if err != nil {
+		return err
+	}
+
+	m.state = resumeMirror(old, oldList.HashList, m.Collection)
+
+	// Anything past what has been verified may not match, fetch it again.
+	if int64(m.db.PostCount()) > m.state.LastPost() {
+		err = m.db.TruncatePosts(m.state.LastPost())
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = m.state.Save(mirrorStatePath(m.dir))
+
+	if err != nil {
+		return err
+	}
+
+	if m.state.Complete() {
+		log.Info("Mirror up to date")
+		return nil
+	}
+
+	since := m.state.Verified
+
+	size := m.RangeSize
+	if size <= 0 {
+		size = MirrorRangeSize
+	}
+
+	queue := newMirrorQueue(since)
+	defer queue.close()
+
+	for i := since; i < m.Collection.Size; i += size {
+		length := size
+
+		if i+length > m.Collection.Size {
+			length = m.Collection.Size - i
+		}
+
+		queue.put(pieceRange{start: i, length: length})
+	}
+
+	sources := m.sources(ctx, entry)
+	log.WithFields(log.Fields{
+		"pieces":  m.Collection.Size - since,
+		"sources": len(sources),
+	}).Info("Downloading collection")
+
+	results := make(chan mirroredPiece, size*len(sources))
+	failed := make(chan error, 1)
+
+	var wg sync.WaitGroup
+
+	for _, i := range sources {
+		wg.Add(1)
+
+		go func(source *Peer) {
+			defer wg.Done()
+			m.work(ctx, source, entry, queue, results, failed)
+		}(i)
+	}
+
+	// Closed once no sources are left working.
+	finished := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	err = m.write(ctx, since, queue, results, failed, finished, onPiece)
+
+	if err != nil {
+		return err
+	}
+
+	log.Info("Mirror complete")
+
+	m.origin.RequestAddPeerContext(ctx, s)
+
+	return nil
+}
+
+func (m *Mirror) entry(ctx context.Context) (*proto.Entry, error) {
+	if m.origin.seed {
+		return m.origin.seedFor, nil
+	}
+
+	// The post count may well have changed since the entry was cached.
+	m.origin.entry = nil
+
+	return m.origin.EntryContext(ctx)
+}
+
+// Fetches and verifies the signed hash list from the origin, then stores it.
+// The signed copy is kept so that we can hand it out as a seed.
+func (m *Mirror) fetchCollection(ctx context.Context, entry *proto.Entry) error {
+	stream, err := m.origin.OpenStream()
+
+	if err != nil {
+		return err
+	}
+
+	defer stream.Close()
+
+	m.Collection, err = stream.CollectionContext(ctx, entry.Address, entry.PublicKey)
+
+	if err != nil {
+		return m.origin.check(err)
+	}
+
+	collection := data.Collection{HashList: m.Collection.HashList, Encoding: m.Collection.Encoding}
+	err = collection.Save(filepath.Join(m.dir, "collection.dat"))
+
+	if err != nil {
+		return err
+	}
+
+	return saveSignedCollection(filepath.Join(m.dir, "collection.json"), m.Collection)
+}
+
+// The signed hash list of a mirrored peer is kept as it was recieved, we
+// cannot sign it ourselves.
+func saveSignedCollection(path string, mcol *proto.MessageCollection) error {
+	dat, err := mcol.Encode()
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, dat, 0644)
+}
+
+func loadSignedCollection(path string) (*proto.MessageCollection, error) {
+	dat, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mcol := &proto.MessageCollection{}
+	err = json.Unmarshal(dat, mcol)
+
+	return mcol, err
+}
+
+// The origin, and any seeds of the entry that can be reached.
+func (m *Mirror) sources(ctx context.Context, entry *proto.Entry) []*Peer {
+	ret := []*Peer{m.origin}
+
+	if m.Connect == nil {
+		return ret
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, i := range entry.Seeds {
+		addr := dht.Address{Raw: i}
+
+		if addr.Equals(m.origin.Address()) || addr.Equals(&entry.Address) {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(addr dht.Address) {
+			defer wg.Done()
+
+			s, _ := addr.String()
+			connectCtx, cancel := context.WithTimeout(ctx, MirrorConnectTimeout)
+			defer cancel()
+
+			peer, err := m.Connect(connectCtx, s)
+
+			if err != nil {
+				log.WithField("seed", s).Info("Seed unreachable")
+				return
+			}
+
+			lock.Lock()
+			ret = append(ret, peer)
+			lock.Unlock()
+		}(addr)
+	}
+
+	wg.Wait()
+
+	return ret
+}
+
+// Takes ranges from the queue and downloads them from source until there are
+// none left, or source has failed too often.
+func (m *Mirror) work(ctx context.Context, source *Peer, entry *proto.Entry, queue *mirrorQueue, results chan<- mirroredPiece, failed chan<- error) {
+	failures := 0
+	s, _ := source.Address().String()
+
+	for failures < MirrorSourceFailures {
+		r, ok := queue.take()
+
+		if !ok {
+			return
+		}
+
+		done, err := m.fetch(ctx, source, entry, r, results)
+
+		if err == nil {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		failures++
+		log.WithFields(log.Fields{
+			"source": s,
+			"start":  r.start + done,
+			"err":    err.Error(),
+		}).Warn("Failed to download pieces")
+
+		rest := pieceRange{r.start + done, r.length - done, r.attempts + 1}
+
+		if rest.attempts >= MirrorAttempts {
+			select {
+			case failed <- err:
+			default:
+			}
+
+			return
+		}
+
+		queue.put(rest)
+	}
+
+	log.WithField("source", s).Warn("Giving up on mirror source")
+}
+
+// Downloads a range of pieces from source, returning how many were received
+// and verified before anything went wrong.
+func (m *Mirror) fetch(ctx context.Context, source *Peer, entry *proto.Entry, r pieceRange, results chan<- mirroredPiece) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := source.OpenStream()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer stream.Close()
+
+	done := 0
+
+	for piece := range stream.PiecesContext(ctx, entry.Address, r.start, r.length) {
+		index := r.start + done
+
+		// Pieces are hashed however the owner hashed them, regardless of
+		// how they were sent.
+		piece.Encoding = m.Collection.Encoding
+		hash, err := piece.Rehash()
+
+		if err != nil {
+			return done, err
+		}
+
+		if !bytes.Equal(m.Collection.HashList[32*index:32*index+32], hash) {
+			return done, errors.New("Piece hash mismatch")
+		}
+
+		piece.Id = uint(index)
+
+		select {
+		case results <- mirroredPiece{index, piece}:
+		case <-ctx.Done():
+			return done, ctx.Err()
+		}
+
+		done++
+
+		if done == r.length {
+			return done, nil
+		}
+	}
+
+	if ctx.Err() != nil {
+		return done, ctx.Err()
+	}
+
+	return done, errors.New("Source sent too few pieces")
+}
+
+// Writes pieces to the database in order as they arrive, until every piece
+// has been written or the mirror has failed. The state is saved every
+// MirrorSaveInterval pieces, once they are in the database.
+func (m *Mirror) write(ctx context.Context, next int, queue *mirrorQueue, results <-chan mirroredPiece, failed <-chan error, finished <-chan struct{}, onPiece chan int) (err error) {
+	var pieces chan *data.Piece
+	var inserted chan error
+
+	// Where each piece written since the last flush ends.
+	var ends []int64
+
+	start := func() {
+		pieces = make(chan *data.Piece, data.PieceSize)
+		inserted = make(chan error, 1)
+		ends = make([]int64, 0, MirrorSaveInterval)
+
+		go func(pieces chan *data.Piece, inserted chan error) {
+			inserted <- m.db.InsertPieces(pieces, true, func(last int64) {
+				ends = append(ends, last)
+			})
+		}(pieces, inserted)
+	}
+
+	// Waits for what has been written so far to be inserted, then records it.
+	flush := func() error {
+		if pieces == nil {
+			return nil
+		}
+
+		close(pieces)
+		err := <-inserted
+		pieces = nil
+
+		if err != nil {
+			return err
+		}
+
+		m.state.Ends = append(m.state.Ends, ends...)
+		m.state.Verified = next
+
+		return m.state.Save(mirrorStatePath(m.dir))
+	}
+
+	start()
+
+	// Do not return until every piece written has been inserted.
+	defer func() {
+		if ferr := flush(); err == nil {
+			err = ferr
+		}
+	}()
+
+	pending := make(map[int]*data.Piece)
+
+	add := func(mp mirroredPiece) error {
+		pending[mp.index] = mp.piece
+
+		for {
+			piece, ok := pending[next]
+
+			if !ok {
+				break
+			}
+
+			delete(pending, next)
+			pieces <- piece
+
+			if onPiece != nil {
+				onPiece <- next
+			}
+
+			next++
+
+			if next%MirrorSaveInterval == 0 {
+				if err := flush(); err != nil {
+					return err
+				}
+
+				start()
+			}
+		}
+
+		queue.advance(next)
+
+		return nil
+	}
+
+	for next < m.Collection.Size {
+		select {
+		case mp := <-results:
+			err = add(mp)
+
+		case err = <-failed:
+		case <-finished:
+			// Sources may have finished with pieces still to be read.
+			for err == nil {
+				select {
+				case mp := <-results:
+					err = add(mp)
+					continue
+				default:
+				}
+
+				break
+			}
+
+			if err == nil && next < m.Collection.Size {
+				err = errors.New("Mirror failed, no sources left")
+			}
+
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
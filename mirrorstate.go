@@ -0,0 +1,129 @@
+// The progress of a mirror is saved alongside it, so that an interrupted mirror
+// picks up where it stopped rather than starting again. Pieces are written in
+// order, so those verified are always the first Verified of the collection.
+
+package libzif
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zif/zif/proto"
+)
+
+// How many pieces are written to the database between saves of the state.
+const MirrorSaveInterval = 16
+
+type MirrorState struct {
+	// The hash of the hash list being mirrored. The hash list itself is kept
+	// in collection.dat.
+	Root     []byte
+	Size     int
+	Encoding int
+
+	// Pieces [0, Verified) have been checked and written. Ends holds the id
+	// of the last post in the database once each of them was, as posts we
+	// already had are skipped and ids need not follow on from each other.
+	Verified int
+	Ends     []int64
+}
+
+func (ms *MirrorState) Complete() bool {
+	return ms.Size > 0 && ms.Verified >= ms.Size
+}
+
+// The id of the last post written from a verified piece, 0 if there are none.
+func (ms *MirrorState) LastPost() int64 {
+	if ms.Verified == 0 {
+		return 0
+	}
+
+	return ms.Ends[ms.Verified-1]
+}
+
+func (ms *MirrorState) Save(path string) error {
+	dat, err := json.Marshal(ms)
+
+	if err != nil {
+		return err
+	}
+
+	// Written then moved, so that a crash cannot leave half a file.
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, dat, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func LoadMirrorState(path string) (*MirrorState, error) {
+	dat, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ms := &MirrorState{}
+	err = json.Unmarshal(dat, ms)
+
+	return ms, err
+}
+
+func mirrorStatePath(dir string) string {
+	return filepath.Join(dir, "mirror.json")
+}
+
+// Works out how much of a newly fetched collection we already have, given the
+// state and hash list saved by the last mirror. Pieces that have changed since
+// then, and everything after them, must be fetched again.
+func resumeMirror(old *MirrorState, oldList []byte, mcol *proto.MessageCollection) *MirrorState {
+	ms := &MirrorState{
+		Root:     mcol.Hash,
+		Size:     mcol.Size,
+		Encoding: mcol.Encoding,
+	}
+
+	switch {
+	case old == nil || len(old.Ends) != old.Verified:
+		// Mirrored before progress was saved, so there is no telling which
+		// pieces the posts we have came from. Everything is fetched again.
+
+	case bytes.Equal(old.Root, mcol.Hash) && old.Encoding == mcol.Encoding:
+		return &MirrorState{mcol.Hash, mcol.Size, mcol.Encoding, old.Verified, old.Ends}
+
+	case old.Encoding == mcol.Encoding:
+		for ms.Verified < old.Verified && ms.Verified < mcol.Size &&
+			bytes.Equal(pieceHash(oldList, ms.Verified), pieceHash(mcol.HashList, ms.Verified)) {
+			ms.Verified++
+		}
+
+		ms.Ends = old.Ends[:ms.Verified]
+
+		log.WithFields(log.Fields{
+			"verified":  old.Verified,
+			"unchanged": ms.Verified,
+		}).Warn("Mirrored collection has changed")
+
+	default:
+		log.Warn("Mirrored collection encoding has changed")
+	}
+
+	return ms
+}
+
+// The hash of piece i in a hash list, nil if the list is too short.
+func pieceHash(list []byte, i int) []byte {
+	if len(list) < 32*i+32 {
+		return nil
+	}
+
+	return list[32*i : 32*i+32]
+}
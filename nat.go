@@ -7,8 +7,10 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Asks a public service what address we are seen from, empty if it can't be
+// reached.
 // TODO: Make this check using UpNp/NAT_PMP first, then query services.
-func external_ip() string {
+func ExternalIP() string {
 	resp, err := http.Get("https://api.ipify.org/")
 
 	if err != nil {
@@ -0,0 +1,189 @@
+// Searching the whole network, rather than a peer we already know of. Peers
+// publish records for the terms in their titles, so the peers with the most
+// of the query's terms are found in the DHT and searched, and what they have
+// is merged.
+
+package libzif
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zif/zif/data"
+	"github.com/zif/zif/proto"
+)
+
+const (
+	// Any more terms in a query are not looked up.
+	MaxQueryTerms = 8
+
+	// How many peers a query is sent to.
+	MaxSearchPeers = 8
+)
+
+type NetworkResult struct {
+	*data.Post
+
+	// The peers that returned the post.
+	Sources []string `json:"sources"`
+}
+
+// Finds the peers with the most terms of query in their titles, searches them,
+// and merges what they return. Posts returned by more peers come first.
+func (lp *LocalPeer) NetworkSearch(ctx context.Context, query string, page int) ([]*NetworkResult, error) {
+	terms := data.Terms(query)
+
+	if len(terms) == 0 {
+		return nil, errors.New("Query has no terms to search for")
+	}
+
+	if len(terms) > MaxQueryTerms {
+		terms = terms[:MaxQueryTerms]
+	}
+
+	peers := lp.searchPeers(ctx, terms)
+
+	log.WithFields(log.Fields{"query": query, "peers": len(peers)}).Info("Network search")
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var failed error
+
+	merged := make(map[string]*NetworkResult)
+	answered := 0
+
+	for _, i := range peers {
+		wg.Add(1)
+
+		go func(addr string) {
+			defer wg.Done()
+
+			posts, err := lp.searchPeer(ctx, addr, query, page)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			if err != nil {
+				log.WithFields(log.Fields{"peer": addr, "reason": err.Error()}).Info("Network search failed")
+				failed = err
+				return
+			}
+
+			answered++
+
+			for _, post := range posts {
+				if res, ok := merged[post.InfoHash]; ok {
+					res.Sources = append(res.Sources, addr)
+				} else {
+					merged[post.InfoHash] = &NetworkResult{post, []string{addr}}
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if answered == 0 && failed != nil {
+		return nil, failed
+	}
+
+	ret := make([]*NetworkResult, 0, len(merged))
+
+	for _, i := range merged {
+		ret = append(ret, i)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if len(ret[i].Sources) != len(ret[j].Sources) {
+			return len(ret[i].Sources) > len(ret[j].Sources)
+		}
+
+		if ret[i].Seeders != ret[j].Seeders {
+			return ret[i].Seeders > ret[j].Seeders
+		}
+
+		return ret[i].InfoHash < ret[j].InfoHash
+	})
+
+	return ret, nil
+}
+
+// The peers to send a query to, those with the most of its terms first.
+func (lp *LocalPeer) searchPeers(ctx context.Context, terms []string) []string {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	self, _ := lp.Address().String()
+	coverage := make(map[string]int)
+
+	for _, i := range terms {
+		wg.Add(1)
+
+		go func(term string) {
+			defer wg.Done()
+
+			records, err := lp.FindProviders(ctx, proto.TermKey(term))
+
+			if err != nil {
+				log.WithFields(log.Fields{"term": term, "reason": err.Error()}).Info("Failed to find term")
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			for _, r := range records {
+				s, _ := r.Provider.String()
+
+				if s != self {
+					coverage[s]++
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	ret := make([]string, 0, len(coverage))
+
+	for i := range coverage {
+		ret = append(ret, i)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if coverage[ret[i]] != coverage[ret[j]] {
+			return coverage[ret[i]] > coverage[ret[j]]
+		}
+
+		return ret[i] < ret[j]
+	})
+
+	if len(ret) > MaxSearchPeers {
+		ret = ret[:MaxSearchPeers]
+	}
+
+	return ret
+}
+
+func (lp *LocalPeer) searchPeer(ctx context.Context, addr, query string, page int) ([]*data.Post, error) {
+	peer, err := lp.ConnectPeerContext(ctx, addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res, stream, err := peer.SearchContext(ctx, query, page)
+
+	if stream != nil {
+		stream.Close()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Posts, nil
+}
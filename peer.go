@@ -6,11 +6,10 @@
 package libzif
 
 import (
-	"bytes"
+	"context"
 	"errors"
-	"fmt"
-	"math"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/yamux"
@@ -38,8 +37,14 @@ type Peer struct {
 	// If this peer is acting as a seed for another
 	seed    bool
 	seedFor *proto.Entry
+
+	// How many times this peer has broken protocol limits.
+	strikes int32
 }
 
+// How many times a peer may break protocol limits before it is disconnected.
+const MaxStrikes = 3
+
 func (p *Peer) EAddress() common.Encodable {
 	return &p.address
 }
@@ -56,6 +61,32 @@ func (p *Peer) Streams() *proto.StreamManager {
 	return &p.streams
 }
 
+func (p *Peer) Penalise(reason error) {
+	strikes := atomic.AddInt32(&p.strikes, 1)
+
+	s, _ := p.Address().String()
+	log.WithFields(log.Fields{
+		"peer":    s,
+		"strikes": strikes,
+		"reason":  reason.Error(),
+	}).Warn("Peer penalised")
+
+	if strikes >= MaxStrikes {
+		log.WithField("peer", s).Warn("Disconnecting misbehaving peer")
+		p.Terminate()
+	}
+}
+
+// Penalises the peer if err was caused by it breaking limits, err is returned
+// either way.
+func (p *Peer) check(err error) error {
+	if proto.IsViolation(err) {
+		p.Penalise(err)
+	}
+
+	return err
+}
+
 func (p *Peer) CheckConnection(timeOut time.Duration) error {
 	session := p.streams.GetSession()
 
@@ -88,6 +119,10 @@ func (p *Peer) CheckConnection(timeOut time.Duration) error {
 }
 
 func (p *Peer) Announce(lp *LocalPeer) error {
+	return p.AnnounceContext(context.Background(), lp)
+}
+
+func (p *Peer) AnnounceContext(ctx context.Context, lp *LocalPeer) error {
 	err := p.CheckConnection(time.Second * 10)
 	if err != nil {
 		return err
@@ -96,14 +131,6 @@ func (p *Peer) Announce(lp *LocalPeer) error {
 	s, _ := p.Address().String()
 	log.Debug("Sending announce to ", s)
 
-	if lp.Entry.PublicAddress == "" {
-		log.Debug("Local peer public address is nil, attempting to fetch")
-		ip := external_ip()
-		log.Debug("External IP is ", ip)
-		lp.Entry.PublicAddress = ip
-	}
-	lp.SignEntry()
-
 	stream, err := p.OpenStream()
 
 	if err != nil {
@@ -112,15 +139,15 @@ func (p *Peer) Announce(lp *LocalPeer) error {
 
 	defer stream.Close()
 
-	err = stream.Announce(lp.Entry)
+	err = stream.AnnounceContext(ctx, lp.CopyEntry())
 
-	return err
+	return p.check(err)
 }
 
 func (p *Peer) Connect(addr string, lp *LocalPeer) error {
 	log.Debug("Connecting to ", addr)
 
-	pair, err := p.streams.OpenTCP(addr, lp, lp.Entry)
+	pair, err := p.streams.OpenTCP(addr, lp, lp.CopyEntry())
 
 	if err != nil {
 		return err
@@ -132,8 +159,16 @@ func (p *Peer) Connect(addr string, lp *LocalPeer) error {
 	p.limiter = &util.PeerLimiter{}
 	p.limiter.Setup()
 
+	// Before inserting, so that the entry is grouped by where it really is.
+	lp.observe(pair.Entry.Address, pair.Client.RemoteAddr())
+
 	encoded, _ := pair.Entry.Json()
-	lp.DHT.Insert(dht.NewKeyValue(pair.Entry.Address, encoded))
+	err = lp.DHT.Insert(dht.NewKeyValue(pair.Entry.Address, encoded))
+
+	if proto.IsInvalidEntry(err) {
+		p.Penalise(err)
+		return err
+	}
 
 	return nil
 }
@@ -199,6 +234,10 @@ func (p *Peer) CloseStreams() {
 }
 
 func (p *Peer) Entry() (*proto.Entry, error) {
+	return p.EntryContext(context.Background())
+}
+
+func (p *Peer) EntryContext(ctx context.Context) (*proto.Entry, error) {
 	err := p.CheckConnection(time.Second * 10)
 	if err != nil {
 		return nil, err
@@ -209,7 +248,7 @@ func (p *Peer) Entry() (*proto.Entry, error) {
 	}
 
 	s, _ := p.Address().String()
-	client, kv, err := p.Query(s)
+	client, kv, err := p.QueryContext(ctx, s)
 
 	if err != nil {
 		return nil, err
@@ -217,6 +256,10 @@ func (p *Peer) Entry() (*proto.Entry, error) {
 
 	defer client.Close()
 
+	if kv == nil {
+		return nil, errors.New("Failed to fetch entry")
+	}
+
 	entry, err := proto.JsonToEntry(kv.Value())
 
 	if err != nil {
@@ -235,46 +278,99 @@ func (p *Peer) Entry() (*proto.Entry, error) {
 }
 
 func (p *Peer) Ping() (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	return p.PingContext(ctx)
+}
+
+func (p *Peer) PingContext(ctx context.Context) (time.Duration, error) {
 	err := p.CheckConnection(time.Second * 10)
 	if err != nil {
 		return 0, err
 	}
 
 	stream, err := p.OpenStream()
-	defer stream.Close()
 
 	if err != nil {
-		log.Error(err.Error())
+		return 0, err
 	}
 
+	defer stream.Close()
+
 	s, _ := p.Address().String()
 	log.Info("Pinging ", s)
 
-	return stream.Ping(time.Second * 10)
+	took, err := stream.PingContext(ctx)
+
+	return took, p.check(err)
 }
 
 func (p *Peer) Bootstrap(d *dht.DHT) (*proto.Client, error) {
+	return p.BootstrapContext(context.Background(), d)
+}
+
+func (p *Peer) BootstrapContext(ctx context.Context, d *dht.DHT) (*proto.Client, error) {
 	err := p.CheckConnection(time.Second * 10)
 	if err != nil {
 		return nil, err
 	}
 
-	initial, err := p.Entry()
+	initial, err := p.EntryContext(ctx)
 
 	if err != nil {
 		return nil, err
 	}
 
 	dat, _ := initial.Json()
+	err = d.Insert(dht.NewKeyValue(initial.Address, dat))
+
+	if proto.IsInvalidEntry(err) {
+		p.Penalise(err)
+		return nil, err
+	}
+
+	stream, err := p.OpenStream()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.check(stream.BootstrapContext(ctx, d, d.Address()))
+
+	if err != nil {
+		return stream, err
+	}
+
+	// Peers that support it can fill the rest of the table far quicker.
+	if p.streams.Agreement().Has(proto.FeaturePex) {
+		client, pairs, err := p.PexContext(ctx, proto.MaxPexEntries)
+
+		if client != nil {
+			client.Close()
+		}
+
+		if err != nil {
+			log.Warn(err.Error())
+		}
 
-	d.Insert(dht.NewKeyValue(initial.Address, dat))
+		self := d.Address()
 
-	stream, _ := p.OpenStream()
+		for _, i := range pairs {
+			if !i.Key().Equals(&initial.Address) && !i.Key().Equals(&self) {
+				d.Insert(i)
+			}
+		}
+	}
 
-	return stream, stream.Bootstrap(d, d.Address())
+	return stream, nil
 }
 
 func (p *Peer) Query(address string) (common.Closable, *dht.KeyValue, error) {
+	return p.QueryContext(context.Background(), address)
+}
+
+func (p *Peer) QueryContext(ctx context.Context, address string) (common.Closable, *dht.KeyValue, error) {
 	err := p.CheckConnection(time.Second * 10)
 	if err != nil {
 		return nil, nil, err
@@ -282,71 +378,81 @@ func (p *Peer) Query(address string) (common.Closable, *dht.KeyValue, error) {
 
 	log.WithField("target", address).Info("Querying")
 
-	stream, _ := p.OpenStream()
-	entry, err := stream.Query(address)
-	return stream, entry, err
-}
+	stream, err := p.OpenStream()
 
-func (p *Peer) FindClosest(address string) (common.Closable, dht.Pairs, error) {
-	err := p.CheckConnection(time.Second * 10)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	log.WithField("target", address).Info("Finding closest")
+	entry, err := stream.QueryContext(ctx, address)
+	return stream, entry, p.check(err)
+}
 
-	stream, _ := p.OpenStream()
-	res, err := stream.FindClosest(address)
-	return stream, res, err
+func (p *Peer) FindClosest(address string) (common.Closable, dht.Pairs, error) {
+	return p.FindClosestContext(context.Background(), address)
 }
 
-// asks a peer to query its database and return the results
-func (p *Peer) Search(search string, page int) (*data.SearchResult, *proto.Client, error) {
+func (p *Peer) FindClosestContext(ctx context.Context, address string) (common.Closable, dht.Pairs, error) {
 	err := p.CheckConnection(time.Second * 10)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	s, _ := p.Address().String()
-	log.WithField("Query", s).Info("Searching")
+	log.WithField("target", address).Info("Finding closest")
+
 	stream, err := p.OpenStream()
 
 	if err != nil {
 		return nil, nil, err
 	}
 
-	posts, err := stream.Search(search, page)
-	res := &data.SearchResult{
-		Posts:  posts,
-		Source: s,
+	res, err := stream.FindClosestContext(ctx, address)
+	return stream, res, p.check(err)
+}
+
+// Asks the peer for up to n of the entries it has seen recently, any that do
+// not verify are left out.
+func (p *Peer) Pex(n int) (common.Closable, dht.Pairs, error) {
+	return p.PexContext(context.Background(), n)
+}
+
+func (p *Peer) PexContext(ctx context.Context, n int) (common.Closable, dht.Pairs, error) {
+	err := p.CheckConnection(time.Second * 10)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	stream, err := p.OpenStream()
+
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return res, stream, nil
+	res, err := stream.PexContext(ctx, n)
+	return stream, res, p.check(err)
 }
 
-func (p *Peer) Recent(page int) ([]*data.Post, *proto.Client, error) {
+// Asks the peer to store a provider record.
+func (p *Peer) AddProviderContext(ctx context.Context, pr *proto.ProviderRecord) error {
 	err := p.CheckConnection(time.Second * 10)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
 	stream, err := p.OpenStream()
 
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	posts, err := stream.Recent(page)
-
-	return posts, stream, err
+	defer stream.Close()
 
+	return p.check(stream.AddProviderContext(ctx, pr))
 }
 
-func (p *Peer) Popular(page int) ([]*data.Post, *proto.Client, error) {
+// Asks the peer for the providers of key, and the closest entries it knows of
+// to key.
+func (p *Peer) GetProvidersContext(ctx context.Context, key dht.Address) ([]*proto.ProviderRecord, dht.Pairs, error) {
 	err := p.CheckConnection(time.Second * 10)
 	if err != nil {
 		return nil, nil, err
@@ -358,99 +464,106 @@ func (p *Peer) Popular(page int) ([]*data.Post, *proto.Client, error) {
 		return nil, nil, err
 	}
 
-	posts, err := stream.Popular(page)
+	defer stream.Close()
 
-	return posts, stream, err
+	records, pairs, err := stream.GetProvidersContext(ctx, key)
 
+	return records, pairs, p.check(err)
 }
 
-func (p *Peer) Mirror(db *data.Database, onPiece chan int) (*proto.Client, error) {
+// asks a peer to query its database and return the results
+func (p *Peer) Search(search string, page int) (*data.SearchResult, *proto.Client, error) {
+	return p.SearchContext(context.Background(), search, page)
+}
+
+func (p *Peer) SearchContext(ctx context.Context, search string, page int) (*data.SearchResult, *proto.Client, error) {
 	err := p.CheckConnection(time.Second * 10)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	pieces := make(chan *data.Piece, data.PieceSize)
-	defer close(pieces)
-	defer close(onPiece)
-
-	go db.InsertPieces(pieces, true)
-
 	s, _ := p.Address().String()
-	log.WithField("peer", s).Info("Mirroring")
-
+	log.WithField("Query", s).Info("Searching")
 	stream, err := p.OpenStream()
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	var entry *proto.Entry
-	if p.seed {
-		entry = p.seedFor
-	} else {
-		entry, err = p.Entry()
-	}
+	posts, err := stream.SearchContext(ctx, search, page)
 
 	if err != nil {
-		return nil, err
+		stream.Close()
+		return nil, nil, p.check(err)
 	}
 
-	mcol, err := stream.Collection(entry.Address, entry.PublicKey)
+	res := &data.SearchResult{
+		Posts:  posts,
+		Source: s,
+	}
+
+	return res, stream, nil
+}
+
+func (p *Peer) Recent(page int) ([]*data.Post, *proto.Client, error) {
+	return p.RecentContext(context.Background(), page)
+}
 
+func (p *Peer) RecentContext(ctx context.Context, page int) ([]*data.Post, *proto.Client, error) {
+	err := p.CheckConnection(time.Second * 10)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	collection := data.Collection{HashList: mcol.HashList}
-	es, _ := entry.Address.String()
-	collection.Save(fmt.Sprintf("./data/%s/collection.dat", es))
+	stream, err := p.OpenStream()
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if int(db.PostCount()) == p.entry.PostCount {
-		return stream, nil
-	}
+	posts, err := stream.RecentContext(ctx, page)
 
-	currentStore := int(math.Ceil(float64(db.PostCount()) / float64(data.PieceSize)))
+	return posts, stream, p.check(err)
 
-	since := 0
-	if currentStore != 0 {
-		since = currentStore - 1
-	}
+}
 
-	log.WithField("Size", mcol.Size).Info("Downloading collection")
-	piece_stream := stream.Pieces(entry.Address, since, mcol.Size)
+func (p *Peer) Popular(page int) ([]*data.Post, *proto.Client, error) {
+	return p.PopularContext(context.Background(), page)
+}
 
-	i := 0
-	for piece := range piece_stream {
-		log.Info(len(mcol.HashList))
-		hash := piece.Hash()
+func (p *Peer) PopularContext(ctx context.Context, page int) ([]*data.Post, *proto.Client, error) {
+	err := p.CheckConnection(time.Second * 10)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		if !bytes.Equal(mcol.HashList[32*i:32*i+32], hash) {
-			return nil, errors.New("Piece hash mismatch")
-		}
+	stream, err := p.OpenStream()
 
-		onPiece <- i
+	if err != nil {
+		return nil, nil, err
+	}
 
-		if len(pieces) == 100 {
-			log.Info("Piece buffer full, io is blocking")
-		}
-		pieces <- piece
+	posts, err := stream.PopularContext(ctx, page)
 
-		i++
-	}
+	return posts, stream, p.check(err)
 
-	log.Info("Mirror complete")
+}
 
-	p.RequestAddPeer(s)
+// Mirrors the posts of this peer into db, the collection is saved in dir. Only
+// this peer is used, see Mirror for fetching from its seeds as well.
+func (p *Peer) Mirror(db *data.Database, dir string, onPiece chan int) error {
+	return p.MirrorContext(context.Background(), db, dir, onPiece)
+}
 
-	return stream, err
+func (p *Peer) MirrorContext(ctx context.Context, db *data.Database, dir string, onPiece chan int) error {
+	return NewMirror(p, db, dir).Run(ctx, onPiece)
 }
 
 func (p *Peer) RequestAddPeer(addr string) (*proto.Client, error) {
+	return p.RequestAddPeerContext(context.Background(), addr)
+}
+
+func (p *Peer) RequestAddPeerContext(ctx context.Context, addr string) (*proto.Client, error) {
 	err := p.CheckConnection(time.Second * 10)
 	if err != nil {
 		return nil, err
@@ -462,5 +575,5 @@ func (p *Peer) RequestAddPeer(addr string) (*proto.Client, error) {
 		return nil, err
 	}
 
-	return stream, stream.RequestAddPeer(addr)
+	return stream, p.check(stream.RequestAddPeerContext(ctx, addr))
 }
@@ -0,0 +1,197 @@
+// Decides whether inbound connections are accepted, so that a single host, or
+// a lot of idle sockets, cannot use up the server.
+
+package proto
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Inbound connections open at once, handshaking or not.
+	DefaultMaxConnections = 512
+
+	// Inbound connections open at once from a single IP.
+	DefaultMaxPerIP = 8
+
+	// Connections that have not yet finished handshaking.
+	DefaultMaxHandshakes = 64
+
+	// How long a connection has to send the preamble and finish handshaking.
+	DefaultHandshakeTimeout = time.Second * 10
+)
+
+// Limits on inbound connections. Anything left as zero uses the default.
+type AdmissionLimits struct {
+	MaxConnections   int
+	MaxPerIP         int
+	MaxHandshakes    int
+	HandshakeTimeout time.Duration
+}
+
+func (al AdmissionLimits) maxConnections() int {
+	if al.MaxConnections == 0 {
+		return DefaultMaxConnections
+	}
+
+	return al.MaxConnections
+}
+
+func (al AdmissionLimits) maxPerIP() int {
+	if al.MaxPerIP == 0 {
+		return DefaultMaxPerIP
+	}
+
+	return al.MaxPerIP
+}
+
+func (al AdmissionLimits) maxHandshakes() int {
+	if al.MaxHandshakes == 0 {
+		return DefaultMaxHandshakes
+	}
+
+	return al.MaxHandshakes
+}
+
+func (al AdmissionLimits) handshakeTimeout() time.Duration {
+	if al.HandshakeTimeout == 0 {
+		return DefaultHandshakeTimeout
+	}
+
+	return al.HandshakeTimeout
+}
+
+// Counts of connections accepted and turned away.
+type AdmissionStats struct {
+	Accepted          uint64 `json:"accepted"`
+	RejectedTotal     uint64 `json:"rejected_total"`
+	RejectedPerIP     uint64 `json:"rejected_per_ip"`
+	RejectedHandshake uint64 `json:"rejected_handshake"`
+	TimedOut          uint64 `json:"timed_out"`
+	Open              int    `json:"open"`
+	Handshaking       int    `json:"handshaking"`
+}
+
+// The zero value is ready to use.
+type admission struct {
+	lock        sync.Mutex
+	open        int
+	perIP       map[string]int
+	handshaking int
+
+	accepted          uint64
+	rejectedTotal     uint64
+	rejectedPerIP     uint64
+	rejectedHandshake uint64
+	timedOut          uint64
+}
+
+// The host part of an address, or the whole thing if it has no port.
+func remoteHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+// Takes a connection slot and a handshake slot for conn. If that is not
+// possible false is returned, and the caller should close conn. Otherwise the
+// returned conn releases its connection slot when closed, and handshakeDone
+// must be called once handshaking is over.
+func (a *admission) admit(conn net.Conn, limits AdmissionLimits) (net.Conn, bool) {
+	host := remoteHost(conn.RemoteAddr())
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.perIP == nil {
+		a.perIP = make(map[string]int)
+	}
+
+	if a.open >= limits.maxConnections() {
+		a.rejectedTotal++
+		return nil, false
+	}
+
+	if a.perIP[host] >= limits.maxPerIP() {
+		a.rejectedPerIP++
+		return nil, false
+	}
+
+	if a.handshaking >= limits.maxHandshakes() {
+		a.rejectedHandshake++
+		return nil, false
+	}
+
+	a.open++
+	a.perIP[host]++
+	a.handshaking++
+	a.accepted++
+
+	return &admittedConn{Conn: conn, admission: a, host: host}, true
+}
+
+func (a *admission) handshakeDone() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.handshaking--
+}
+
+func (a *admission) timeout() {
+	atomic.AddUint64(&a.timedOut, 1)
+}
+
+func (a *admission) release(host string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.open--
+	a.perIP[host]--
+
+	if a.perIP[host] <= 0 {
+		delete(a.perIP, host)
+	}
+}
+
+func (a *admission) stats() AdmissionStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return AdmissionStats{
+		Accepted:          a.accepted,
+		RejectedTotal:     a.rejectedTotal,
+		RejectedPerIP:     a.rejectedPerIP,
+		RejectedHandshake: a.rejectedHandshake,
+		TimedOut:          atomic.LoadUint64(&a.timedOut),
+		Open:              a.open,
+		Handshaking:       a.handshaking,
+	}
+}
+
+// Gives its slot back when closed, however many times that happens.
+type admittedConn struct {
+	net.Conn
+
+	admission *admission
+	host      string
+	once      sync.Once
+}
+
+func (ac *admittedConn) Close() error {
+	ac.once.Do(func() {
+		ac.admission.release(ac.host)
+	})
+
+	return ac.Conn.Close()
+}
@@ -0,0 +1,119 @@
+package proto
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type hostAddr string
+
+func (ha hostAddr) Network() string { return "tcp" }
+func (ha hostAddr) String() string  { return string(ha) }
+
+// A connection that appears to come from addr.
+type fromConn struct {
+	net.Conn
+	addr hostAddr
+}
+
+func (fc fromConn) RemoteAddr() net.Addr { return fc.addr }
+
+func from(addr string) net.Conn {
+	conn, _ := net.Pipe()
+	return fromConn{conn, hostAddr(addr)}
+}
+
+func TestAdmissionLimits(t *testing.T) {
+	var a admission
+	limits := AdmissionLimits{MaxConnections: 3, MaxPerIP: 2, MaxHandshakes: 10}
+
+	first, ok := a.admit(from("10.0.0.1:1000"), limits)
+	if !ok {
+		t.Fatal("First connection refused")
+	}
+
+	if _, ok := a.admit(from("10.0.0.1:1001"), limits); !ok {
+		t.Fatal("Second connection refused")
+	}
+
+	if _, ok := a.admit(from("10.0.0.1:1002"), limits); ok {
+		t.Error("Per IP limit not enforced")
+	}
+
+	if _, ok := a.admit(from("10.0.0.2:1000"), limits); !ok {
+		t.Fatal("Connection from another IP refused")
+	}
+
+	if _, ok := a.admit(from("10.0.0.3:1000"), limits); ok {
+		t.Error("Connection limit not enforced")
+	}
+
+	// Closing twice must only give back one slot.
+	first.Close()
+	first.Close()
+
+	stats := a.stats()
+
+	if stats.Open != 2 || stats.RejectedPerIP != 1 || stats.RejectedTotal != 1 {
+		t.Errorf("Incorrect stats: %+v", stats)
+	}
+
+	if _, ok := a.admit(from("10.0.0.1:1003"), limits); !ok {
+		t.Error("Slot not released on close")
+	}
+}
+
+func TestAdmissionHandshakes(t *testing.T) {
+	var a admission
+	limits := AdmissionLimits{MaxHandshakes: 1}
+
+	if _, ok := a.admit(from("10.0.0.1:1000"), limits); !ok {
+		t.Fatal("First connection refused")
+	}
+
+	if _, ok := a.admit(from("10.0.0.2:1000"), limits); ok {
+		t.Error("Handshake limit not enforced")
+	}
+
+	a.handshakeDone()
+
+	if _, ok := a.admit(from("10.0.0.2:1000"), limits); !ok {
+		t.Error("Handshake slot not released")
+	}
+}
+
+// A connection that never sends anything is closed once the handshake timeout
+// passes.
+func TestServerHandshakeTimeout(t *testing.T) {
+	network := NewMemoryNetwork()
+	server := Server{
+		Transport: network,
+		Limits:    AdmissionLimits{HandshakeTimeout: time.Millisecond * 50},
+	}
+
+	if err := server.Listen("a:1", nil, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Close()
+
+	conn, err := network.Dial("a:1")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Idle connection was not closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("Idle connection was not closed")
+	}
+
+	stats := server.Admission()
+
+	if stats.TimedOut != 1 || stats.Open != 0 || stats.Handshaking != 0 {
+		t.Errorf("Incorrect stats: %+v", stats)
+	}
+}
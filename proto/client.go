@@ -2,8 +2,10 @@ package proto
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"time"
@@ -26,11 +28,26 @@ type Client struct {
 
 	decoder *json.Decoder
 	encoder *json.Encoder
+
+	// Everything read from conn goes through this, so a peer cannot make us
+	// read forever.
+	budget *budgetReader
+
+	// What was agreed upon for this connection. The version decides whether
+	// messages are sent as JSON or binary frames.
+	agreement Agreement
+
+	// The hash of the handshake transcript, once there has been one. The key
+	// exchange is signed along with it.
+	transcript []byte
 }
 
 // Creates a new client, automatically setting up the json encoder/decoder.
+// This client uses JSON framing, as understood by all peers.
 func NewClient(conn net.Conn) *Client {
-	return &Client{conn, json.NewDecoder(conn), json.NewEncoder(conn)}
+	budget := newBudgetReader(conn, DefaultStreamBudget)
+
+	return &Client{conn, json.NewDecoder(budget), json.NewEncoder(conn), budget, LegacyAgreement, nil}
 }
 
 func (c *Client) Terminate() {
@@ -45,8 +62,96 @@ func (c *Client) Close() (err error) {
 	return
 }
 
-// Encodes v as json and writes it to c.conn.
+// The address of the other end of the connection.
+func (c *Client) RemoteAddr() net.Addr {
+	if c.conn == nil {
+		return nil
+	}
+
+	return c.conn.RemoteAddr()
+}
+
+// The version and features agreed upon for this connection.
+func (c *Client) Agreement() Agreement {
+	return c.agreement
+}
+
+// Applies the deadline of ctx to the connection, and interrupts anything
+// blocked on it if ctx is cancelled. The returned function must be called once
+// the request is finished with. It clears the deadline again, so the stream can
+// be reused, and if err is set and ctx was cancelled then it is replaced with
+// the reason why.
+func (c *Client) bind(ctx context.Context, err *error) func() {
+	deadline, hasDeadline := ctx.Deadline()
+
+	if hasDeadline {
+		c.conn.SetDeadline(deadline)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	if ctx.Done() != nil {
+		go func() {
+			defer close(stopped)
+
+			select {
+			case <-ctx.Done():
+				// A deadline in the past unblocks any reads and writes.
+				c.conn.SetDeadline(time.Unix(1, 0))
+			case <-done:
+			}
+		}()
+	} else {
+		close(stopped)
+	}
+
+	return func() {
+		close(done)
+		<-stopped
+
+		if hasDeadline || ctx.Err() != nil {
+			c.conn.SetDeadline(time.Time{})
+		}
+
+		if err == nil || *err == nil {
+			return
+		}
+
+		if ctx.Err() != nil {
+			*err = ctx.Err()
+		} else if hasDeadline && !time.Now().Before(deadline) {
+			// The connection can time out just before the context does.
+			*err = context.DeadlineExceeded
+		}
+	}
+}
+
+// Whether this client sends binary frames rather than JSON.
+func (c *Client) framed() bool {
+	return c.agreement.Version != ProtoVersionJson
+}
+
+// Encodes v and writes it to c.conn. Messages are written as a single frame,
+// any other value is encoded as json and then framed.
 func (c *Client) WriteMessage(v interface{}) error {
+	if c.framed() {
+		switch msg := v.(type) {
+		case *Message:
+			return WriteFrame(c.conn, msg.Header, 0, msg.Content)
+		case Message:
+			return WriteFrame(c.conn, msg.Header, 0, msg.Content)
+		}
+
+		dat, err := json.Marshal(v)
+
+		if err != nil {
+			return err
+		}
+
+		return WriteFrame(c.conn, ProtoHeader, FrameValue, dat)
+	}
+
 	if c.encoder == nil {
 		c.encoder = json.NewEncoder(c.conn)
 	}
@@ -56,17 +161,58 @@ func (c *Client) WriteMessage(v interface{}) error {
 	return err
 }
 
+// The reader for everything read from c.conn.
+func (c *Client) reader() io.Reader {
+	if c.budget == nil {
+		c.budget = newBudgetReader(c.conn, DefaultStreamBudget)
+	}
+
+	return c.budget
+}
+
+// Allows another n bytes to be read from this stream, used when a reply is
+// expected to be large.
+func (c *Client) RaiseBudget(n int64) {
+	c.reader()
+	c.budget.raise(n)
+}
+
+// A stream that has broken limits cannot be trusted to be in a sane state, so
+// it is dropped.
+func (c *Client) violated(err error) error {
+	if IsViolation(err) {
+		c.conn.Close()
+	}
+
+	return err
+}
+
 // Blocks until a message is read from c.conn, decodes it into a *Message and
 // returns.
 func (c *Client) ReadMessage() (*Message, error) {
 	var msg Message
 
-	if c.decoder == nil {
-		c.decoder = json.NewDecoder(c.conn)
-	}
+	if c.framed() {
+		header, _, content, err := ReadFrame(c.reader())
 
-	if err := c.decoder.Decode(&msg); err != nil {
-		return nil, err
+		if err != nil {
+			return nil, c.violated(err)
+		}
+
+		msg.Header = header
+		msg.Content = content
+	} else {
+		if c.decoder == nil {
+			c.decoder = json.NewDecoder(c.reader())
+		}
+
+		if err := c.decoder.Decode(&msg); err != nil {
+			return nil, c.violated(err)
+		}
+
+		if limit := MessageLimit(msg.Header); len(msg.Content) > limit {
+			return nil, c.violated(&LimitError{fmt.Sprintf("message %d", msg.Header), int64(limit)})
+		}
 	}
 
 	msg.Stream = c.conn
@@ -74,35 +220,63 @@ func (c *Client) ReadMessage() (*Message, error) {
 	return &msg, nil
 }
 
+// Reads a value written with WriteMessage, decoding it into i.
 func (c *Client) Decode(i interface{}) error {
-	return c.decoder.Decode(i)
+	if c.framed() {
+		_, _, content, err := ReadFrame(c.reader())
+
+		if err != nil {
+			return c.violated(err)
+		}
+
+		return json.Unmarshal(content, i)
+	}
+
+	if c.decoder == nil {
+		c.decoder = json.NewDecoder(c.reader())
+	}
+
+	return c.violated(c.decoder.Decode(i))
+}
+
+// Replies with ProtoNo, telling the peer why its request failed.
+func (c *Client) WriteError(reason error) error {
+	dat, err := ToProtocolError(reason).Encode()
+
+	if err != nil {
+		return err
+	}
+
+	return c.WriteMessage(&Message{Header: ProtoNo, Content: dat})
 }
 
-// Pings a client with a specified timeout, returns true/false depending on
-// if it recieves a reply.
+// Pings a client with a specified timeout, returns how long it took to get a
+// reply.
 func (c *Client) Ping(timeout time.Duration) (time.Duration, error) {
-	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	c.WriteMessage(&Message{Header: ProtoPing})
+	return c.PingContext(ctx)
+}
 
-	tchan := make(chan bool)
+func (c *Client) PingContext(ctx context.Context) (took time.Duration, err error) {
+	defer c.bind(ctx, &err)()
 
-	go func() {
-		rep, err := c.ReadMessage()
+	start := time.Now()
 
-		if err != nil || rep.Header != ProtoPong {
-			tchan <- false
-		}
+	err = c.WriteMessage(&Message{Header: ProtoPing})
 
-		tchan <- true
-	}()
+	if err != nil {
+		return 0, err
+	}
 
-	select {
-	case <-tchan:
-		return time.Since(start), nil
-	case <-time.After(timeout):
-		return time.Since(start), errors.New("Ping timeout")
+	rep, err := c.ReadMessage()
+
+	if err != nil {
+		return time.Since(start), err
 	}
+
+	return time.Since(start), rep.Expect(ProtoPong)
 }
 
 // Replies to a Ping request.
@@ -128,6 +302,12 @@ func (c *Client) SendStruct(e common.Encodable) error {
 // Announce the given DHT entry to a peer, passes on this peers details,
 // meaning that it can be reached by other peers on the network.
 func (c *Client) Announce(e common.Encodable) error {
+	return c.AnnounceContext(context.Background(), e)
+}
+
+func (c *Client) AnnounceContext(ctx context.Context, e common.Encodable) (err error) {
+	defer c.bind(ctx, &err)()
+
 	json, err := e.Json()
 
 	if err != nil {
@@ -152,15 +332,19 @@ func (c *Client) Announce(e common.Encodable) error {
 		return err
 	}
 
-	if !ok.Ok() {
-		return errors.New("Peer did not respond with ok")
+	if err = ok.Expect(ProtoOk); err != nil {
+		return err
 	}
 
 	return nil
 }
 
 func (c *Client) FindClosest(address string) (dht.Pairs, error) {
-	// TODO: LimitReader
+	return c.FindClosestContext(context.Background(), address)
+}
+
+func (c *Client) FindClosestContext(ctx context.Context, address string) (pairs dht.Pairs, err error) {
+	defer c.bind(ctx, &err)()
 
 	msg := &Message{
 		Header:  ProtoDhtFindClosest,
@@ -168,7 +352,7 @@ func (c *Client) FindClosest(address string) (dht.Pairs, error) {
 	}
 
 	// Tell the peer the address we are looking for
-	err := c.WriteMessage(msg)
+	err = c.WriteMessage(msg)
 
 	if err != nil {
 		return nil, err
@@ -185,8 +369,8 @@ func (c *Client) FindClosest(address string) (dht.Pairs, error) {
 
 	log.Debug("Peer accepted address")
 
-	if !recv.Ok() {
-		return nil, errors.New("Peer refused query address")
+	if err = recv.Expect(ProtoOk); err != nil {
+		return nil, err
 	}
 
 	closest, err := c.ReadMessage()
@@ -195,12 +379,20 @@ func (c *Client) FindClosest(address string) (dht.Pairs, error) {
 		return nil, err
 	}
 
+	if err = closest.Expect(ProtoEntry); err != nil {
+		return nil, err
+	}
+
 	length, err := closest.ReadInt()
 
 	if err != nil {
 		return nil, err
 	}
 
+	if length < 0 || length > MaxClosest {
+		return nil, c.violated(&LimitError{"closest entries", MaxClosest})
+	}
+
 	entries := make(dht.Pairs, 0, length)
 
 	for i := 0; i < length; i++ {
@@ -219,7 +411,11 @@ func (c *Client) FindClosest(address string) (dht.Pairs, error) {
 }
 
 func (c *Client) Query(address string) (*dht.KeyValue, error) {
-	// TODO: LimitReader
+	return c.QueryContext(context.Background(), address)
+}
+
+func (c *Client) QueryContext(ctx context.Context, address string) (kv *dht.KeyValue, err error) {
+	defer c.bind(ctx, &err)()
 
 	msg := &Message{
 		Header:  ProtoDhtQuery,
@@ -227,7 +423,7 @@ func (c *Client) Query(address string) (*dht.KeyValue, error) {
 	}
 
 	// Tell the peer the address we are looking for
-	err := c.WriteMessage(msg)
+	err = c.WriteMessage(msg)
 
 	if err != nil {
 		return nil, err
@@ -240,22 +436,28 @@ func (c *Client) Query(address string) (*dht.KeyValue, error) {
 		return nil, err
 	}
 
-	if !recv.Ok() {
-		return nil, errors.New("Peer refused query address")
+	if err = recv.Expect(ProtoOk); err != nil {
+		return nil, err
 	}
 
-	kv := &dht.KeyValue{}
+	kv = &dht.KeyValue{}
 	kvr, err := c.ReadMessage()
 
 	if err != nil {
 		return nil, err
 	}
 
-	if kvr.Header == ProtoNo {
+	// Not having the entry is not an error, the caller can go on to ask for
+	// the closest entries instead. Older peers send an empty ProtoNo for this.
+	if kvr.Header == ProtoNo && (len(kvr.Content) == 0 || IsErrorCode(kvr.Err(), ErrorNotFound)) {
 		return nil, nil
 	}
 
-	kvr.Decode(kv)
+	if err = kvr.Expect(ProtoDhtQuery); err != nil {
+		return nil, err
+	}
+
+	err = kvr.Decode(kv)
 
 	return kv, err
 
@@ -265,20 +467,34 @@ func (c *Client) Query(address string) (*dht.KeyValue, error) {
 // both it's own and the peers address, storing the result. This means that after
 // a bootstrap, it should be possible to connect to *any* peer!
 func (c *Client) Bootstrap(d *dht.DHT, address dht.Address) error {
+	return c.BootstrapContext(context.Background(), d, address)
+}
+
+func (c *Client) BootstrapContext(ctx context.Context, d *dht.DHT, address dht.Address) error {
 	s, _ := address.String()
-	peers, err := c.FindClosest(s)
+	peers, err := c.FindClosestContext(ctx, s)
 
 	if err != nil {
 		return err
 	}
 
 	// add them all to our routing table! :D
+	// Any the DHT refuses as invalid are counted against the peer.
+	var invalid *InvalidEntries
+
 	for _, e := range peers {
 		if len(e.Key().Raw) != dht.AddressBinarySize {
 			continue
 		}
 
-		d.Insert(e)
+		if err = d.Insert(e); IsInvalidEntry(err) {
+			if invalid == nil {
+				invalid = &InvalidEntries{}
+			}
+
+			invalid.Count++
+			invalid.Reason = err
+		}
 	}
 
 	if len(peers) > 1 {
@@ -287,11 +503,21 @@ func (c *Client) Bootstrap(d *dht.DHT, address dht.Address) error {
 		log.Info("Bootstrapped with 1 new peer")
 	}
 
+	if invalid != nil {
+		return invalid
+	}
+
 	return nil
 }
 
 // TODO: Paginate searches
 func (c *Client) Search(search string, page int) ([]*data.Post, error) {
+	return c.SearchContext(context.Background(), search, page)
+}
+
+func (c *Client) SearchContext(ctx context.Context, search string, page int) (posts []*data.Post, err error) {
+	defer c.bind(ctx, &err)()
+
 	log.WithField("Query", search).Info("Querying")
 
 	sq := MessageSearchQuery{search, page}
@@ -308,24 +534,36 @@ func (c *Client) Search(search string, page int) ([]*data.Post, error) {
 
 	c.WriteMessage(msg)
 
-	var posts []*data.Post
-
 	recv, err := c.ReadMessage()
 
 	if err != nil {
 		return nil, err
 	}
 
+	if err = recv.Expect(ProtoPosts); err != nil {
+		return nil, err
+	}
+
 	err = recv.Decode(&posts)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if len(posts) > MaxPageSize {
+		return nil, c.violated(&LimitError{"posts", MaxPageSize})
+	}
+
 	return posts, nil
 }
 
 func (c *Client) Recent(page int) ([]*data.Post, error) {
+	return c.RecentContext(context.Background(), page)
+}
+
+func (c *Client) RecentContext(ctx context.Context, page int) (posts []*data.Post, err error) {
+	defer c.bind(ctx, &err)()
+
 	log.Info("Fetching recent posts from peer")
 
 	page_s := strconv.Itoa(page)
@@ -335,7 +573,7 @@ func (c *Client) Recent(page int) ([]*data.Post, error) {
 		Content: []byte(page_s),
 	}
 
-	err := c.WriteMessage(msg)
+	err = c.WriteMessage(msg)
 
 	if err != nil {
 		return nil, err
@@ -347,15 +585,28 @@ func (c *Client) Recent(page int) ([]*data.Post, error) {
 		return nil, err
 	}
 
-	var posts []*data.Post
+	if err = posts_msg.Expect(ProtoPosts); err != nil {
+		return nil, err
+	}
+
 	posts_msg.Decode(&posts)
 
+	if len(posts) > MaxPageSize {
+		return nil, c.violated(&LimitError{"posts", MaxPageSize})
+	}
+
 	log.Info("Recieved ", len(posts), " recent posts")
 
 	return posts, nil
 }
 
 func (c *Client) Popular(page int) ([]*data.Post, error) {
+	return c.PopularContext(context.Background(), page)
+}
+
+func (c *Client) PopularContext(ctx context.Context, page int) (posts []*data.Post, err error) {
+	defer c.bind(ctx, &err)()
+
 	log.Info("Fetching popular posts from peer")
 
 	page_s := strconv.Itoa(page)
@@ -365,7 +616,7 @@ func (c *Client) Popular(page int) ([]*data.Post, error) {
 		Content: []byte(page_s),
 	}
 
-	err := c.WriteMessage(msg)
+	err = c.WriteMessage(msg)
 
 	if err != nil {
 		return nil, err
@@ -377,9 +628,16 @@ func (c *Client) Popular(page int) ([]*data.Post, error) {
 		return nil, err
 	}
 
-	var posts []*data.Post
+	if err = posts_msg.Expect(ProtoPosts); err != nil {
+		return nil, err
+	}
+
 	posts_msg.Decode(&posts)
 
+	if len(posts) > MaxPageSize {
+		return nil, c.violated(&LimitError{"posts", MaxPageSize})
+	}
+
 	log.Info("Recieved ", len(posts), " popular posts")
 
 	return posts, nil
@@ -388,6 +646,12 @@ func (c *Client) Popular(page int) ([]*data.Post, error) {
 // Download a hash list for a peer. Expects said hash list to be valid and
 // signed.
 func (c *Client) Collection(address dht.Address, pk ed25519.PublicKey) (*MessageCollection, error) {
+	return c.CollectionContext(context.Background(), address, pk)
+}
+
+func (c *Client) CollectionContext(ctx context.Context, address dht.Address, pk ed25519.PublicKey) (mcol *MessageCollection, err error) {
+	defer c.bind(ctx, &err)()
+
 	s, _ := address.String()
 	log.WithField("for", s).Info("Sending request for a collection")
 
@@ -405,6 +669,10 @@ func (c *Client) Collection(address dht.Address, pk ed25519.PublicKey) (*Message
 		return nil, err
 	}
 
+	if err = hl.Expect(ProtoHashList); err != nil {
+		return nil, err
+	}
+
 	mhl := MessageCollection{}
 	err = hl.Decode(&mhl)
 
@@ -425,6 +693,18 @@ func (c *Client) Collection(address dht.Address, pk ed25519.PublicKey) (*Message
 
 // Download a piece from a peer, given the address and id of the piece we want.
 func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
+	return c.PiecesContext(context.Background(), address, id, length)
+}
+
+// The channel returned is closed once all pieces have been read, or if ctx is
+// cancelled before then.
+func (c *Client) PiecesContext(ctx context.Context, address dht.Address, id, length int) chan *data.Piece {
+	stop := c.bind(ctx, nil)
+
+	// Every post requested may be as large as is allowed.
+	budget := int64(length) * data.PieceSize * MaxPostSize
+	c.RaiseBudget(budget)
+
 	s, _ := address.String()
 	log.WithFields(log.Fields{
 		"address": s,
@@ -438,6 +718,7 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 	dat, err := mrp.Encode()
 
 	if err != nil {
+		stop()
 		return nil
 	}
 
@@ -461,69 +742,91 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 	}
 
 	go func() {
+		defer stop()
 		defer close(ret)
 
-		gzr, err := gzip.NewReader(c.conn)
+		var r io.Reader = c.reader()
 
-		if err != nil {
-			return
+		if c.agreement.Has(FeatureGzip) {
+			gzr, err := gzip.NewReader(r)
+
+			if err != nil {
+				return
+			}
+
+			// Limit what comes out of gzip too, a small stream can
+			// decompress into a very large one.
+			r = newBudgetReader(gzr, budget)
 		}
 
-		errReader := data.NewErrorReader(gzr)
+		errReader := data.NewErrorReader(r)
+
+		// Reads a post in the legacy encoding, fields separated by "|".
+		readLegacy := func() (*data.Post, error) {
+			id := convert(errReader.ReadString('|'))
+
+			if id == -1 {
+				return &data.Post{Id: id}, errReader.Err
+			}
+
+			post := &data.Post{
+				Id:         id,
+				InfoHash:   errReader.ReadString('|'),
+				Title:      errReader.ReadString('|'),
+				Size:       convert(errReader.ReadString('|')),
+				FileCount:  convert(errReader.ReadString('|')),
+				Seeders:    convert(errReader.ReadString('|')),
+				Leechers:   convert(errReader.ReadString('|')),
+				UploadDate: convert(errReader.ReadString('|')),
+				Tags:       errReader.ReadString('|'),
+				Meta:       errReader.ReadString('|'),
+			}
+
+			return post, errReader.Err
+		}
+
+		readPost := readLegacy
+
+		if c.agreement.Has(FeatureCanonical) {
+			readPost = func() (*data.Post, error) {
+				return data.ReadCanonicalPost(r)
+			}
+		}
 
 		for i := 0; i < length; i++ {
 			piece := data.Piece{}
 			piece.Setup()
 
-			count := 0
-			for {
-				if count >= data.PieceSize {
-					break
-				}
+			var err error
 
-				id_s := errReader.ReadString('|')
-				id := convert(id_s)
+			for count := 0; count < data.PieceSize; count++ {
+				var post *data.Post
+				post, err = readPost()
 
-				if id == -1 {
+				if err != nil {
+					log.Error("Failed to read post: ", err.Error())
 					break
 				}
 
-				ih := errReader.ReadString('|')
-				title := errReader.ReadString('|')
-				size := convert(errReader.ReadString('|'))
-				filecount := convert(errReader.ReadString('|'))
-				seeders := convert(errReader.ReadString('|'))
-				leechers := convert(errReader.ReadString('|'))
-				uploaddate := convert(errReader.ReadString('|'))
-				tags := errReader.ReadString('|')
-				meta := errReader.ReadString('|')
-
-				if errReader.Err != nil {
-					log.Error("Failed to read post: ", errReader.Err.Error())
+				if post.Id == -1 {
 					break
 				}
 
-				if err != nil {
-					log.Error(err.Error())
-				}
+				piece.Add(*post, true)
+			}
 
-				post := data.Post{
-					Id:         id,
-					InfoHash:   ih,
-					Title:      title,
-					Size:       size,
-					FileCount:  filecount,
-					Seeders:    seeders,
-					Leechers:   leechers,
-					UploadDate: uploaddate,
-					Tags:       tags,
-					Meta:       meta,
-				}
+			// The stream has failed or been cancelled, there is nothing more
+			// to read.
+			if err != nil {
+				c.violated(err)
+				return
+			}
 
-				piece.Add(post, true)
-				count++
+			select {
+			case ret <- &piece:
+			case <-ctx.Done():
+				return
 			}
-			ret <- &piece
 		}
 	}()
 
@@ -531,6 +834,12 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 }
 
 func (c *Client) RequestAddPeer(addr string) error {
+	return c.RequestAddPeerContext(context.Background(), addr)
+}
+
+func (c *Client) RequestAddPeerContext(ctx context.Context, addr string) (err error) {
+	defer c.bind(ctx, &err)()
+
 	msg := &Message{
 		Header:  ProtoRequestAddPeer,
 		Content: []byte(addr),
@@ -543,8 +852,8 @@ func (c *Client) RequestAddPeer(addr string) error {
 		return err
 	}
 
-	if !rep.Ok() {
-		return errors.New("Peer add request failed")
+	if err = rep.Expect(ProtoOk); err != nil {
+		return err
 	}
 
 	log.Info("Registered as seed peer")
@@ -0,0 +1,85 @@
+package proto
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientContextCancel(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	agreement := Agreement{Version: ProtoVersion}
+	cl := &Client{conn: a, agreement: agreement}
+
+	// Read the request, but never reply.
+	go ReadFrame(b)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*50, cancel)
+
+	_, err := cl.SearchContext(ctx, "ubuntu", 0)
+
+	if err != context.Canceled {
+		t.Errorf("Expected cancellation, got %v", err)
+	}
+}
+
+func TestClientContextDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	agreement := Agreement{Version: ProtoVersion}
+	cl := &Client{conn: a, agreement: agreement}
+
+	go ReadFrame(b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	_, err := cl.RecentContext(ctx, 0)
+
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline to be exceeded, got %v", err)
+	}
+}
+
+func TestClientDeadlineCleared(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	agreement := Agreement{Version: ProtoVersion}
+	cl := &Client{conn: a, agreement: agreement}
+
+	// Answers every ping.
+	go func() {
+		for {
+			if _, _, _, err := ReadFrame(b); err != nil {
+				return
+			}
+
+			if WriteFrame(b, ProtoPong, 0, nil) != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if _, err := cl.PingContext(ctx); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The stream is still usable once the first deadline has passed.
+	time.Sleep(time.Millisecond * 100)
+
+	if _, err := cl.PingContext(context.Background()); err != nil {
+		t.Error(err.Error())
+	}
+}
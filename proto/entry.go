@@ -1,9 +1,12 @@
 package proto
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 
 	"github.com/zif/zif/dht"
 
@@ -30,6 +33,15 @@ type Entry struct {
 	CollectionSig []byte `json:"collectionSig"`
 	Port          int    `json:"port"`
 
+	// Raised every time the entry is signed, so that an older copy of it can
+	// never replace a newer one.
+	Seq int64 `json:"seq"`
+
+	// Proof of work for the public key, see dht.Work. Nonce meets Difficulty,
+	// and peers may turn away entries below a minimum difficulty.
+	Nonce      uint64 `json:"nonce"`
+	Difficulty int    `json:"difficulty"`
+
 	// Essentially just a list of other peers who have this entry in their table.
 	// They may or may not actually have pieces, so mirror/piece requests may go
 	// awry.
@@ -63,24 +75,29 @@ func JsonToEntry(j []byte) (*Entry, error) {
 // This is signed, *not* the JSON. This is needed because otherwise the order of
 // the posts encoded is not actually guaranteed, which can lead to invalid
 // signatures. Plus we can only sign data that is actually needed.
+// Every field is either fixed width or prefixed with its length, otherwise
+// characters could be moved from one field to the next without changing what
+// is signed.
 func (e Entry) Bytes() ([]byte, error) {
-	ret, err := e.String()
-	return []byte(ret), err
+	buf := bytes.Buffer{}
+
+	writeField(&buf, []byte(e.Name))
+	writeField(&buf, []byte(e.Desc))
+	writeField(&buf, e.PublicKey)
+	binary.Write(&buf, binary.BigEndian, int64(e.Port))
+	writeField(&buf, []byte(e.PublicAddress))
+	writeField(&buf, e.Address.Raw)
+	binary.Write(&buf, binary.BigEndian, int64(e.PostCount))
+	binary.Write(&buf, binary.BigEndian, e.Seq)
+	binary.Write(&buf, binary.BigEndian, e.Nonce)
+	binary.Write(&buf, binary.BigEndian, int64(e.Difficulty))
+
+	return buf.Bytes(), nil
 }
 
 func (e Entry) String() (string, error) {
-	var str string
-
-	str += e.Name
-	str += e.Desc
-	str += string(e.PublicKey)
-	str += string(e.Port)
-	str += string(e.PublicAddress)
-	s, _ := e.Address.String()
-	str += s
-	str += string(e.PostCount)
-
-	return str, nil
+	ret, err := e.Bytes()
+	return string(ret), err
 }
 
 func (e Entry) Json() ([]byte, error) {
@@ -138,6 +155,21 @@ func (entry *Entry) Verify() error {
 		return errors.New("Failed to verify signature")
 	}
 
+	// Otherwise anyone could sign an entry for someone else's address.
+	addr := dht.NewAddress(entry.PublicKey)
+
+	if !addr.Equals(&entry.Address) {
+		return errors.New("Entry address does not match public key")
+	}
+
+	if len(entry.Name) > MaxNameLength {
+		return errors.New(fmt.Sprintf("Name too large (%d char max)", MaxNameLength))
+	}
+
+	if len(entry.Desc) > MaxDescLength {
+		return errors.New(fmt.Sprintf("Description too large (%d char max)", MaxDescLength))
+	}
+
 	if len(entry.PublicAddress) == 0 {
 		return errors.New("Public address must be set")
 	}
@@ -147,8 +179,40 @@ func (entry *Entry) Verify() error {
 		return errors.New("Public address is too large (253 char max)")
 	}
 
-	if entry.Port > 65535 {
-		return errors.New("Port too large (" + string(entry.Port) + ")")
+	if entry.Port < 0 || entry.Port > 65535 {
+		return errors.New("Port out of range (" + strconv.Itoa(entry.Port) + ")")
+	}
+
+	if entry.PostCount < 0 || entry.Seq < 0 {
+		return errors.New("Post count and sequence number cannot be negative")
+	}
+
+	if entry.Difficulty < 0 || entry.Difficulty > dht.MaxDifficulty {
+		return errors.New("Difficulty out of range (" + strconv.Itoa(entry.Difficulty) + ")")
+	}
+
+	if dht.Work(entry.PublicKey, entry.Nonce) < entry.Difficulty {
+		return errors.New("Nonce does not meet difficulty")
+	}
+
+	if len(entry.Seeds) > MaxSeeds {
+		return errors.New(fmt.Sprintf("Too many seeds (%d max)", MaxSeeds))
+	}
+
+	for _, i := range entry.Seeds {
+		if len(i) != dht.AddressBinarySize {
+			return errors.New("Invalid seed address")
+		}
+	}
+
+	return nil
+}
+
+// Returns an error if the entry's proof of work is below min. Verify makes
+// sure the work is really there.
+func (entry *Entry) CheckWork(min int) error {
+	if entry.Difficulty < min {
+		return &InsufficientWork{entry.Difficulty, min}
 	}
 
 	return nil
@@ -0,0 +1,89 @@
+package proto
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Why a peer refused a request, sent along with every ProtoNo.
+type ErrorCode int
+
+const (
+	ErrorInternal ErrorCode = iota
+	ErrorRateLimited
+	ErrorNotFound
+	ErrorTooLarge
+	ErrorUnsupported
+	ErrorInvalid
+)
+
+func (ec ErrorCode) String() string {
+	switch ec {
+	case ErrorRateLimited:
+		return "rate limited"
+	case ErrorNotFound:
+		return "not found"
+	case ErrorTooLarge:
+		return "too large"
+	case ErrorUnsupported:
+		return "unsupported"
+	case ErrorInvalid:
+		return "invalid"
+	}
+
+	return "internal"
+}
+
+// The content of a ProtoNo reply. Handlers can return these to choose what
+// the remote peer is told, any other error is sent as ErrorInternal.
+type ProtocolError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func NewProtocolError(code ErrorCode, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{code, fmt.Sprintf(format, args...)}
+}
+
+func (pe *ProtocolError) Error() string {
+	return fmt.Sprintf("Peer refused request (%s): %s", pe.Code, pe.Message)
+}
+
+func (pe *ProtocolError) Encode() ([]byte, error) {
+	data, err := json.Marshal(pe)
+	return data, err
+}
+
+// Converts any error into one that can be sent to a peer. The details of
+// internal errors are not sent, they may contain things peers have no
+// business knowing.
+func ToProtocolError(err error) *ProtocolError {
+	if pe, ok := err.(*ProtocolError); ok {
+		return pe
+	}
+
+	return &ProtocolError{ErrorInternal, "Internal error"}
+}
+
+// Decodes the content of a ProtoNo. Older peers send either nothing or a plain
+// string, so fall back to that.
+func DecodeProtocolError(content []byte) *ProtocolError {
+	pe := &ProtocolError{}
+
+	if err := json.Unmarshal(content, pe); err == nil && pe.Message != "" {
+		return pe
+	}
+
+	if len(content) == 0 {
+		return &ProtocolError{ErrorInternal, "No reason given"}
+	}
+
+	return &ProtocolError{ErrorInternal, string(content)}
+}
+
+// Whether err is a ProtocolError with the given code.
+func IsErrorCode(err error, code ErrorCode) bool {
+	pe, ok := err.(*ProtocolError)
+
+	return ok && pe.Code == code
+}
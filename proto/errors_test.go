@@ -0,0 +1,58 @@
+package proto
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestProtocolErrorReply(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	agreement := Agreement{Version: ProtoVersion}
+	writer := &Client{conn: a, agreement: agreement}
+	reader := &Client{conn: b, agreement: agreement}
+
+	go func() {
+		writer.WriteError(NewProtocolError(ErrorNotFound, "Piece not found"))
+		writer.WriteError(errors.New("database is locked"))
+	}()
+
+	msg, err := reader.ReadMessage()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = msg.Expect(ProtoPosts)
+
+	if !IsErrorCode(err, ErrorNotFound) || err.(*ProtocolError).Message != "Piece not found" {
+		t.Error("Error not decoded correctly")
+	}
+
+	msg, err = reader.ReadMessage()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if pe := msg.Err().(*ProtocolError); pe.Code != ErrorInternal || pe.Message != "Internal error" {
+		t.Error("Internal error details were sent")
+	}
+}
+
+func TestProtocolErrorLegacy(t *testing.T) {
+	msg := &Message{Header: ProtoNo, Content: []byte("Signature not verified")}
+
+	pe, ok := msg.Err().(*ProtocolError)
+
+	if !ok || pe.Code != ErrorInternal || pe.Message != "Signature not verified" {
+		t.Error("Plain string error not decoded")
+	}
+
+	if (&Message{Header: ProtoOk}).Err() != nil {
+		t.Error("Error returned for ok message")
+	}
+}
@@ -0,0 +1,87 @@
+// Binary framing for messages. Used instead of JSON once both peers have agreed
+// on a protocol version that supports it.
+//
+// A frame is laid out as follows, all integers little endian:
+//
+//	header  uint16 - the message code, see protocolinfo.go
+//	flags   uint8
+//	length  uint32 - the length of the content that follows
+//	content [length]byte
+
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	FrameHeaderSize = 7
+
+	// No single frame may be larger than this, stops a peer from making us
+	// allocate silly amounts of memory with a single length prefix.
+	MaxFrameSize = 16 * 1024 * 1024
+)
+
+const (
+	// The content of this frame is a JSON encoded value passed to
+	// Client.WriteMessage, rather than the content of a Message.
+	FrameValue uint8 = 1 << iota
+)
+
+type FrameTooLarge struct {
+	Length uint32
+}
+
+func (ftl *FrameTooLarge) Error() string {
+	return fmt.Sprintf("Frame too large: %d bytes, max: %d", ftl.Length, MaxFrameSize)
+}
+
+// Writes a single frame to w. The header and content are written with one call
+// to Write, so frames from different goroutines do not interleave.
+func WriteFrame(w io.Writer, header int, flags uint8, content []byte) error {
+	if len(content) > MaxFrameSize {
+		return &FrameTooLarge{uint32(len(content))}
+	}
+
+	buf := make([]byte, FrameHeaderSize+len(content))
+
+	binary.LittleEndian.PutUint16(buf[0:2], uint16(header))
+	buf[2] = flags
+	binary.LittleEndian.PutUint32(buf[3:7], uint32(len(content)))
+	copy(buf[FrameHeaderSize:], content)
+
+	_, err := w.Write(buf)
+
+	return err
+}
+
+// Reads a single frame from r, returning the header, flags and content.
+func ReadFrame(r io.Reader) (int, uint8, []byte, error) {
+	var head [FrameHeaderSize]byte
+
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, 0, nil, err
+	}
+
+	header := int(binary.LittleEndian.Uint16(head[0:2]))
+	flags := head[2]
+	length := binary.LittleEndian.Uint32(head[3:7])
+
+	if length > MaxFrameSize {
+		return 0, 0, nil, &FrameTooLarge{length}
+	}
+
+	if limit := MessageLimit(header); int64(length) > int64(limit) {
+		return 0, 0, nil, &LimitError{fmt.Sprintf("message %d", header), int64(limit)}
+	}
+
+	content := make([]byte, length)
+
+	if _, err := io.ReadFull(r, content); err != nil {
+		return 0, 0, nil, err
+	}
+
+	return header, flags, content, nil
+}
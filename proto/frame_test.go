@@ -0,0 +1,78 @@
+package proto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	content := []byte{0, 1, 2, '|', 255}
+
+	err := WriteFrame(buf, ProtoPosts, FrameValue, content)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if buf.Len() != FrameHeaderSize+len(content) {
+		t.Errorf("Incorrect frame length: %d", buf.Len())
+	}
+
+	header, flags, read, err := ReadFrame(buf)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if header != ProtoPosts || flags != FrameValue || !bytes.Equal(read, content) {
+		t.Error("Frame did not survive a round trip")
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{0x01, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff})
+
+	_, _, _, err := ReadFrame(buf)
+
+	if _, ok := err.(*FrameTooLarge); !ok {
+		t.Error("Oversized frame was not rejected")
+	}
+}
+
+func TestClientFramed(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	agreement := Agreement{Version: ProtoVersion}
+	writer := &Client{conn: a, agreement: agreement}
+	reader := &Client{conn: b, agreement: agreement}
+
+	go func() {
+		writer.WriteMessage(&Message{Header: ProtoSearch, Content: []byte("arch")})
+		writer.WriteMessage(MessageSearchQuery{"ubuntu", 2})
+	}()
+
+	msg, err := reader.ReadMessage()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if msg.Header != ProtoSearch || string(msg.Content) != "arch" {
+		t.Error("Message not read correctly")
+	}
+
+	var sq MessageSearchQuery
+	err = reader.Decode(&sq)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if sq.Query != "ubuntu" || sq.Page != 2 {
+		t.Error("Value not decoded correctly")
+	}
+}
@@ -11,21 +11,25 @@ import (
 )
 
 // Perform a handshake operation given a peer. server.go does the other end of this.
-func handshake(cl Client, lp common.Signer, data common.Encodable) (*Entry, error) {
-	header, err := handshake_recieve(cl)
+func handshake(cl *Client, lp common.Signer, data common.Encodable) (*Entry, error) {
+	if cl.framed() {
+		return transcript_handshake(cl, lp, data, false)
+	}
+
+	header, err := handshake_recieve(*cl)
 
 	if err != nil {
-		cl.WriteMessage(Message{Header: ProtoNo, Content: []byte(err.Error())})
+		cl.WriteError(&ProtocolError{ErrorInvalid, err.Error()})
 		return header, err
 	}
 
 	if lp == nil {
-		cl.WriteMessage(Message{Header: ProtoNo, Content: []byte("nil LocalPeer")})
+		cl.WriteError(NewProtocolError(ErrorInternal, "nil LocalPeer"))
 		return header, errors.New("Handshake passed nil LocalPeer")
 	}
 
 	cl.WriteMessage(Message{Header: ProtoOk})
-	err = handshake_send(cl, lp, data)
+	err = handshake_send(*cl, lp, data)
 
 	if err != nil {
 		return header, err
@@ -52,7 +56,7 @@ func handshake_recieve(cl Client) (*Entry, error) {
 	log.Debug("Read header")
 
 	if check(err) {
-		cl.WriteMessage(Message{Header: ProtoNo})
+		cl.WriteError(NewProtocolError(ErrorInvalid, "Failed to read header"))
 		return nil, err
 	}
 
@@ -100,7 +104,7 @@ func handshake_recieve(cl Client) (*Entry, error) {
 
 	if !verified {
 		log.Error("Failed to verify peer ", s)
-		cl.WriteMessage(Message{Header: ProtoNo})
+		cl.WriteError(NewProtocolError(ErrorInvalid, "Signature not verified"))
 		cl.Close()
 		return nil, errors.New("Signature not verified")
 	}
@@ -142,8 +146,8 @@ func handshake_send(cl Client, lp common.Signer, data common.Encodable) error {
 		return err
 	}
 
-	if !msg.Ok() {
-		return errors.New("Peer refused header")
+	if err = msg.Expect(ProtoOk); err != nil {
+		return err
 	}
 
 	log.Debug("Header sent")
@@ -174,8 +178,8 @@ func handshake_send(cl Client, lp common.Signer, data common.Encodable) error {
 		return err
 	}
 
-	if !msg.Ok() {
-		return errors.New("Peer refused signature")
+	if err = msg.Expect(ProtoOk); err != nil {
+		return err
 	}
 
 	log.Info("Handshake sent ok")
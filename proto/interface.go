@@ -8,21 +8,12 @@ import (
 	"github.com/zif/zif/dht"
 )
 
+// Messages are handled by whatever is registered with Server.Router, this is
+// only what the server needs to manage connections.
 type ProtocolHandler interface {
 	common.Signer
 	NetworkPeer
 
-	HandleAnnounce(*Message) error
-	HandleQuery(*Message) error
-	HandleFindClosest(*Message) error
-	HandleSearch(*Message) error
-	HandleRecent(*Message) error
-	HandlePopular(*Message) error
-	HandleHashList(*Message) error
-	HandlePiece(*Message) error
-	HandleAddPeer(*Message) error
-	HandlePing(*Message) error
-
 	HandleHandshake(ConnHeader) (NetworkPeer, error)
 	HandleCloseConnection(*dht.Address)
 }
@@ -31,9 +22,14 @@ type ProtocolHandler interface {
 // peers with the DHT properly.
 type NetworkPeer interface {
 	Session() *yamux.Session
+	Streams() *StreamManager
 	AddStream(net.Conn)
 
 	Address() *dht.Address
 	Query(string) (common.Closable, *dht.KeyValue, error)
 	FindClosest(address string) (common.Closable, dht.Pairs, error)
+
+	// Called when the peer breaks the rules, for instance sending more than
+	// it is allowed to.
+	Penalise(error)
 }
@@ -0,0 +1,118 @@
+// Limits on how much a peer is able to make us read, decode and allocate.
+// Anything over these limits is treated as a peer misbehaving, the stream is
+// dropped and the peer penalised.
+
+package proto
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/zif/zif/dht"
+)
+
+const (
+	// The limit for any message without one of its own.
+	DefaultMessageLimit = 4 * 1024
+
+	// Messages that contain entries, or other JSON values.
+	ValueMessageLimit = 64 * 1024
+
+	// The largest a single post may be.
+	MaxPostSize = 16 * 1024
+
+	// How much may be read from a single stream. Streams downloading pieces
+	// have this raised to fit the pieces requested.
+	DefaultStreamBudget = 32 * 1024 * 1024
+
+	// The most entries a peer may send in reply to FindClosest.
+	MaxClosest = dht.BucketSize
+
+	// Limits on the fields of an entry, so that one always fits in a
+	// message.
+	MaxNameLength = 128
+	MaxDescLength = 2048
+	MaxSeeds      = 64
+)
+
+// The most that can be sent in a message, by header.
+var MessageLimits = map[int]int{
+	ProtoHeader:          ValueMessageLimit,
+	ProtoHello:           ValueMessageLimit * 2,
+	ProtoCapabilities:    MaxCapabilitiesSize,
+	ProtoSearch:          1024,
+	ProtoRequestPiece:    1024,
+	ProtoEntry:           ValueMessageLimit,
+	ProtoPosts:           MaxPageSize * MaxPostSize,
+	ProtoHashList:        MaxFrameSize,
+	ProtoPost:            MaxPostSize,
+	ProtoDhtQuery:        ValueMessageLimit,
+	ProtoDhtAnnounce:     ValueMessageLimit,
+	ProtoDhtFindClosest:  1024,
+	ProtoPex:             1024,
+	ProtoRequestAddPeer:  1024,
+	ProtoRequestHashList: 1024,
+	ProtoDhtAddProvider:  1024,
+	ProtoDhtGetProviders: 1024,
+	ProtoProviders:       ValueMessageLimit,
+}
+
+func MessageLimit(header int) int {
+	if limit, ok := MessageLimits[header]; ok {
+		return limit
+	}
+
+	return DefaultMessageLimit
+}
+
+// Returned when a peer sends more than it is allowed to.
+type LimitError struct {
+	What  string
+	Limit int64
+}
+
+func (le *LimitError) Error() string {
+	return fmt.Sprintf("Limit exceeded for %s, max: %d", le.What, le.Limit)
+}
+
+// Whether err was caused by a peer breaking limits, rather than the network.
+func IsViolation(err error) bool {
+	switch err.(type) {
+	case *LimitError, *FrameTooLarge, *InvalidEntries:
+		return true
+	}
+
+	return false
+}
+
+// Fails reads once more than the budget has been read.
+type budgetReader struct {
+	reader    io.Reader
+	budget    int64
+	remaining int64
+}
+
+func newBudgetReader(r io.Reader, budget int64) *budgetReader {
+	return &budgetReader{r, budget, budget}
+}
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+	if br.remaining <= 0 {
+		return 0, &LimitError{"stream", br.budget}
+	}
+
+	if int64(len(p)) > br.remaining {
+		p = p[:br.remaining]
+	}
+
+	n, err := br.reader.Read(p)
+	br.remaining -= int64(n)
+
+	return n, err
+}
+
+// Allows another n bytes to be read.
+func (br *budgetReader) raise(n int64) {
+	br.budget += n
+	br.remaining += n
+}
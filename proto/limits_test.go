@@ -0,0 +1,71 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestMessageLimit(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	err := WriteFrame(buf, ProtoSearch, 0, make([]byte, MessageLimit(ProtoSearch)+1))
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, _, _, err = ReadFrame(buf)
+
+	if _, ok := err.(*LimitError); !ok {
+		t.Error("Message over its limit was not rejected")
+	}
+}
+
+func TestStreamBudget(t *testing.T) {
+	br := newBudgetReader(bytes.NewReader(make([]byte, 100)), 10)
+	buf := make([]byte, 100)
+
+	n, err := br.Read(buf)
+
+	if n != 10 || err != nil {
+		t.Fatalf("Read %d bytes, %v", n, err)
+	}
+
+	_, err = br.Read(buf)
+
+	if !IsViolation(err) {
+		t.Error("Read past the stream budget")
+	}
+}
+
+func TestFindClosestLimit(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	agreement := Agreement{Version: ProtoVersion}
+	cl := &Client{conn: a, agreement: agreement}
+	server := &Client{conn: b, agreement: agreement}
+
+	go func() {
+		server.ReadMessage()
+		server.WriteMessage(&Message{Header: ProtoOk})
+
+		results := &Message{Header: ProtoEntry}
+		results.WriteInt(1 << 30)
+		server.WriteMessage(results)
+	}()
+
+	_, err := cl.FindClosest("address")
+
+	if !IsViolation(err) {
+		t.Errorf("Expected a limit violation, got %v", err)
+	}
+
+	// The stream should have been dropped.
+	if err = binary.Write(a, binary.LittleEndian, int8(0)); err == nil {
+		t.Error("Stream was not closed")
+	}
+}
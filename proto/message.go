@@ -2,6 +2,7 @@ package proto
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 
 	"github.com/zif/zif/dht"
@@ -45,3 +46,26 @@ func (m *Message) Decode(iface interface{}) error {
 func (m *Message) Ok() bool {
 	return m.Header == ProtoOk
 }
+
+// The error carried by a ProtoNo reply, or nil for any other message.
+func (m *Message) Err() error {
+	if m.Header != ProtoNo {
+		return nil
+	}
+
+	return DecodeProtocolError(m.Content)
+}
+
+// Checks that a reply has the header we expected, returning the peer's reason
+// if it refused.
+func (m *Message) Expect(header int) error {
+	if err := m.Err(); err != nil {
+		return err
+	}
+
+	if m.Header != header {
+		return fmt.Errorf("Unexpected reply, header %d", m.Header)
+	}
+
+	return nil
+}
@@ -18,6 +18,16 @@ type MessageCollection struct {
 	HashList  []byte
 	Size      int
 	Signature []byte
+
+	// The post encoding pieces were hashed with, older peers do not send this
+	// and so use data.EncodingLegacy.
+	Encoding int `json:",omitempty"`
+}
+
+// An ephemeral X25519 key, signed so that it is bound to a Zif identity.
+type MessageKeyExchange struct {
+	Key       []byte
+	Signature []byte
 }
 
 type MessageSearchQuery struct {
@@ -50,7 +60,11 @@ func (mp *MessagePiece) Hash() ([]byte, error) {
 }
 
 func (mhl *MessageCollection) Verify(pk ed25519.PublicKey) error {
-	verified := ed25519.Verify(pk, mhl.HashList, mhl.Signature)
+	if mhl.Size < 0 || mhl.Size*32 != len(mhl.HashList) {
+		return errors.New("Hash list does not match size")
+	}
+
+	verified := ed25519.Verify(pk, mhl.SignedData(), mhl.Signature)
 
 	if !verified {
 		return errors.New("Invalid signature")
@@ -69,11 +83,29 @@ func (mhl *MessageCollection) Verify(pk ed25519.PublicKey) error {
 	return nil
 }
 
+// What the owner of a collection signs. The encoding is included, unless it is
+// legacy so that older peers can still verify.
+func (mhl *MessageCollection) SignedData() []byte {
+	if mhl.Encoding == 0 {
+		return mhl.HashList
+	}
+
+	ret := make([]byte, len(mhl.HashList), len(mhl.HashList)+1)
+	copy(ret, mhl.HashList)
+
+	return append(ret, byte(mhl.Encoding))
+}
+
 func (mhl *MessageCollection) Encode() ([]byte, error) {
 	data, err := json.Marshal(mhl)
 	return data, err
 }
 
+func (mkx *MessageKeyExchange) Encode() ([]byte, error) {
+	data, err := json.Marshal(mkx)
+	return data, err
+}
+
 func (sq *MessageSearchQuery) Encode() ([]byte, error) {
 	data, err := json.Marshal(sq)
 	return data, err
@@ -0,0 +1,202 @@
+// Middleware that can be applied to a Router.
+
+package proto
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zif/zif/util"
+)
+
+// How many peers rate limits are tracked for before the one least recently
+// heard from is forgotten.
+const MaxRateLimited = 4096
+
+// How many headers each peer has a rate limit of its own for. Messages with
+// any other header share one, so that a peer cannot make us keep a limit for
+// every header it can think of.
+const MaxRateLimitedHeaders = 32
+
+// Logs every message handled, along with how long it took.
+func Logging(header int, next Handler) Handler {
+	return func(msg *Message) error {
+		start := time.Now()
+		err := next(msg)
+
+		fields := log.Fields{
+			"header": header,
+			"took":   time.Since(start),
+		}
+
+		if msg.From != nil {
+			fields["peer"], _ = msg.From.String()
+		}
+
+		if err != nil {
+			fields["err"] = err.Error()
+		}
+
+		log.WithFields(fields).Debug("Handled message")
+
+		return err
+	}
+}
+
+// Refuses messages that do not come from a peer that has completed a
+// handshake.
+func RequirePeer(header int, next Handler) Handler {
+	return func(msg *Message) error {
+		if msg.From == nil {
+			return NewProtocolError(ErrorInvalid, "Handshake required")
+		}
+
+		return next(msg)
+	}
+}
+
+// Refuses messages from a peer once it has sent too many with the same header,
+// allowing one every rate and bursting to burst.
+func RateLimit(rate time.Duration, burst int) Middleware {
+	var lock sync.Mutex
+	peers := make(map[string]*peerBuckets)
+
+	// Counts messages, to tell which peer was heard from least recently.
+	var clock uint64
+
+	return func(header int, next Handler) Handler {
+		return func(msg *Message) error {
+			if msg.From == nil {
+				return next(msg)
+			}
+
+			s, _ := msg.From.String()
+
+			lock.Lock()
+
+			peer, ok := peers[s]
+
+			if !ok {
+				if len(peers) >= MaxRateLimited {
+					forgetIdlest(peers)
+				}
+
+				peer = &peerBuckets{headers: make(map[int]*util.Bucket)}
+				peers[s] = peer
+			}
+
+			clock++
+			peer.used = clock
+			bucket := peer.bucket(header, rate, burst)
+
+			lock.Unlock()
+
+			if !bucket.Allow() {
+				return NewProtocolError(ErrorRateLimited, "Too many requests")
+			}
+
+			return next(msg)
+		}
+	}
+}
+
+// The rate limits for one peer.
+type peerBuckets struct {
+	headers map[int]*util.Bucket
+
+	// Shared by headers past MaxRateLimitedHeaders.
+	others *util.Bucket
+
+	used uint64
+}
+
+func (pb *peerBuckets) bucket(header int, rate time.Duration, burst int) *util.Bucket {
+	if bucket, ok := pb.headers[header]; ok {
+		return bucket
+	}
+
+	if len(pb.headers) < MaxRateLimitedHeaders {
+		bucket := util.NewBucket(rate, burst)
+		pb.headers[header] = bucket
+
+		return bucket
+	}
+
+	if pb.others == nil {
+		pb.others = util.NewBucket(rate, burst)
+	}
+
+	return pb.others
+}
+
+// Removes the peer least recently heard from.
+func forgetIdlest(peers map[string]*peerBuckets) {
+	idlest := ""
+	var used uint64
+
+	for k, v := range peers {
+		if idlest == "" || v.used < used {
+			idlest, used = k, v.used
+		}
+	}
+
+	delete(peers, idlest)
+}
+
+type MessageStats struct {
+	Count  uint64        `json:"count"`
+	Errors uint64        `json:"errors"`
+	Time   time.Duration `json:"time"`
+}
+
+// Counts messages handled, how many failed, and how long they took.
+type Metrics struct {
+	lock  sync.Mutex
+	stats map[int]*MessageStats
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{stats: make(map[int]*MessageStats)}
+}
+
+func (m *Metrics) Middleware(header int, next Handler) Handler {
+	return func(msg *Message) error {
+		start := time.Now()
+		err := next(msg)
+		took := time.Since(start)
+
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		stats, ok := m.stats[header]
+
+		if !ok {
+			stats = &MessageStats{}
+			m.stats[header] = stats
+		}
+
+		stats.Count++
+		stats.Time += took
+
+		if err != nil {
+			stats.Errors++
+		}
+
+		return err
+	}
+}
+
+// A copy of the stats for every header handled so far.
+func (m *Metrics) Stats() map[int]MessageStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ret := make(map[int]MessageStats, len(m.stats))
+
+	for header, stats := range m.stats {
+		ret[header] = *stats
+	}
+
+	return ret
+}
@@ -0,0 +1,228 @@
+// Version and capability negotiation. This happens directly after the magic
+// bytes and version are sent, and before the handshake. Both sides advertise
+// which protocol versions and optional features they support, and then agree
+// on a common set. Peers that send ProtoVersionJson predate this, and do not
+// negotiate.
+
+package proto
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Optional features, a peer only makes use of these if both sides of a
+// connection support them.
+const (
+	// Pieces are gzip compressed when sent.
+	FeatureGzip = "gzip"
+
+	// Connections are encrypted once the handshake is complete. Like
+	// FeatureTranscript, this is always used once negotiated.
+	FeatureSecure = "aead"
+
+	// Handshakes sign a transcript of both sides, rather than a cookie. This
+	// is always used once negotiated, whether or not it was agreed, otherwise
+	// it could be stripped out of negotiation by someone in the middle.
+	FeatureTranscript = "transcript"
+
+	// Peers can be asked for recently seen entries with ProtoPex.
+	FeaturePex = "pex"
+
+	// Posts are sent, and collections hashed, with the canonical encoding
+	// rather than the legacy "|" separated one.
+	FeatureCanonical = "canonical"
+
+	// Provider records can be stored and found with ProtoDhtAddProvider and
+	// ProtoDhtGetProviders.
+	FeatureProviders = "providers"
+)
+
+// How long each side has to send their capabilities.
+const NegotiateTimeout = time.Second * 10
+
+// The largest capabilities message we are willing to read.
+const MaxCapabilitiesSize = 4096
+
+var (
+	// The protocol versions this peer can speak, newest first.
+	SupportedVersions = []int16{ProtoVersion}
+
+	// Features this peer supports.
+	SupportedFeatures = []string{FeatureGzip, FeatureSecure, FeatureTranscript, FeaturePex, FeatureCanonical, FeatureProviders}
+
+	// What was implicitly supported before negotiation existed.
+	LegacyAgreement = Agreement{Version: ProtoVersionJson, Features: []string{FeatureGzip}}
+)
+
+// Sent by both sides of a connection to advertise what they support.
+type Capabilities struct {
+	Versions []int16  `json:"versions"`
+	Features []string `json:"features"`
+}
+
+// What both sides of a connection have agreed to use. This is stored on the
+// StreamManager, and every Client for the connection.
+type Agreement struct {
+	Version  int16    `json:"version"`
+	Features []string `json:"features"`
+
+	// The capabilities and reply exchanged to reach this, exactly as they
+	// were sent. These go into the handshake transcript, so that if anything
+	// was changed along the way the handshake fails.
+	negotiation [][]byte
+}
+
+type NegotiationError struct {
+	Reason string
+}
+
+func (ne *NegotiationError) Error() string {
+	return "Negotiation failed: " + ne.Reason
+}
+
+func LocalCapabilities() Capabilities {
+	return Capabilities{SupportedVersions, SupportedFeatures}
+}
+
+// Finds the newest version both sides support, and the features they have in
+// common.
+func (c Capabilities) Agree(other Capabilities) (Agreement, error) {
+	ret := Agreement{Features: make([]string, 0, len(c.Features))}
+
+	found := false
+	for _, i := range c.Versions {
+		for _, j := range other.Versions {
+			if i == j && i != ProtoVersionJson && (!found || i > ret.Version) {
+				ret.Version = i
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		return ret, &NegotiationError{"No common protocol version"}
+	}
+
+	for _, i := range c.Features {
+		for _, j := range other.Features {
+			if i == j {
+				ret.Features = append(ret.Features, i)
+				break
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// Whether or not both sides support a feature.
+func (a Agreement) Has(feature string) bool {
+	for _, i := range a.Features {
+		if i == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The connecting side of negotiation. Sends our capabilities, then waits to
+// hear what the server has agreed to.
+func negotiate_send(conn net.Conn) (Agreement, error) {
+	var agreement Agreement
+
+	conn.SetDeadline(time.Now().Add(NegotiateTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	caps, err := json.Marshal(LocalCapabilities())
+
+	if err != nil {
+		return agreement, err
+	}
+
+	err = WriteFrame(conn, ProtoCapabilities, 0, caps)
+
+	if err != nil {
+		return agreement, err
+	}
+
+	header, _, content, err := ReadFrame(conn)
+
+	// Peers that predate negotiation will not reply at all.
+	if err != nil {
+		return agreement, errVersionNotAcknowledged
+	}
+
+	if header == ProtoNo {
+		return agreement, &NegotiationError{string(content)}
+	}
+
+	if header != ProtoOk {
+		return agreement, &NegotiationError{"Unexpected reply"}
+	}
+
+	err = json.Unmarshal(content, &agreement)
+
+	if err != nil {
+		return agreement, err
+	}
+
+	agreement.negotiation = [][]byte{caps, content}
+
+	log.WithFields(log.Fields{
+		"version":  agreement.Version,
+		"features": agreement.Features,
+	}).Debug("Negotiated")
+
+	return agreement, nil
+}
+
+// The listening side of negotiation. If nothing can be agreed upon, the remote
+// is told why.
+func negotiate_recieve(conn net.Conn) (Agreement, error) {
+	var agreement Agreement
+
+	conn.SetDeadline(time.Now().Add(NegotiateTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	header, _, content, err := ReadFrame(conn)
+
+	if err != nil {
+		return agreement, err
+	}
+
+	if header != ProtoCapabilities || len(content) > MaxCapabilitiesSize {
+		WriteFrame(conn, ProtoNo, 0, []byte("Expected capabilities"))
+		return agreement, errors.New("Expected capabilities")
+	}
+
+	var remote Capabilities
+	err = json.Unmarshal(content, &remote)
+
+	if err != nil {
+		WriteFrame(conn, ProtoNo, 0, []byte("Invalid capabilities"))
+		return agreement, err
+	}
+
+	agreement, err = LocalCapabilities().Agree(remote)
+
+	if err != nil {
+		WriteFrame(conn, ProtoNo, 0, []byte(err.(*NegotiationError).Reason))
+		return agreement, err
+	}
+
+	dat, err := json.Marshal(agreement)
+
+	if err != nil {
+		return agreement, err
+	}
+
+	agreement.negotiation = [][]byte{content, dat}
+
+	return agreement, WriteFrame(conn, ProtoOk, 0, dat)
+}
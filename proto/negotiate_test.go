@@ -0,0 +1,178 @@
+package proto
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestCapabilitiesAgree(t *testing.T) {
+	local := Capabilities{[]int16{1, 2, 3}, []string{FeatureGzip, "a"}}
+	remote := Capabilities{[]int16{0, 2, 1}, []string{"b", FeatureGzip}}
+
+	agreement, err := local.Agree(remote)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if agreement.Version != 2 {
+		t.Errorf("Incorrect version agreed: %d", agreement.Version)
+	}
+
+	if !agreement.Has(FeatureGzip) || agreement.Has("a") || agreement.Has("b") {
+		t.Error("Incorrect features agreed")
+	}
+
+	_, err = local.Agree(Capabilities{[]int16{ProtoVersionJson, 4}, nil})
+
+	if _, ok := err.(*NegotiationError); !ok {
+		t.Error("Agreed without a common version")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ret := make(chan Agreement)
+
+	go func() {
+		agreement, err := negotiate_recieve(b)
+
+		if err != nil {
+			t.Error(err.Error())
+		}
+
+		ret <- agreement
+	}()
+
+	agreement, err := negotiate_send(a)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	server := <-ret
+
+	if agreement.Version != ProtoVersion || server.Version != ProtoVersion {
+		t.Error("Negotiated incorrect version")
+	}
+
+	if !agreement.Has(FeatureGzip) || !server.Has(FeatureGzip) {
+		t.Error("Negotiated incorrect features")
+	}
+}
+
+// Someone in the middle taking a feature out of our capabilities must make
+// the handshake fail, rather than leave both sides using less than they could.
+func TestNegotiateStripped(t *testing.T) {
+	a, b := net.Pipe()
+	c, d := net.Pipe()
+	defer a.Close()
+	defer d.Close()
+
+	// Relays everything between b and c, except the capabilities, which lose
+	// FeatureSecure.
+	go func() {
+		defer b.Close()
+		defer c.Close()
+
+		go io.Copy(b, c)
+
+		header, flags, content, err := ReadFrame(b)
+
+		if err != nil {
+			return
+		}
+
+		var caps Capabilities
+		json.Unmarshal(content, &caps)
+
+		features := []string{}
+		for _, i := range caps.Features {
+			if i != FeatureSecure {
+				features = append(features, i)
+			}
+		}
+
+		caps.Features = features
+		content, _ = json.Marshal(caps)
+
+		if WriteFrame(c, header, flags, content) == nil {
+			io.Copy(c, b)
+		}
+	}()
+
+	client, _ := newTestSigner(t)
+	server, _ := newTestSigner(t)
+
+	ret := make(chan error, 1)
+
+	go func() {
+		agreement, err := negotiate_recieve(d)
+
+		if err == nil {
+			_, err = handshake(&Client{conn: d, agreement: agreement}, server, testEntry(t, server))
+		}
+
+		d.Close()
+		ret <- err
+	}()
+
+	agreement, err := negotiate_send(a)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if agreement.Has(FeatureSecure) {
+		t.Fatal("Feature not stripped")
+	}
+
+	_, err = transcript_handshake(&Client{conn: a, agreement: agreement}, client, testEntry(t, client), true)
+
+	if err == nil {
+		t.Error("Handshake after stripped negotiation succeeded")
+	}
+
+	if <-ret == nil {
+		t.Error("Handshake after stripped negotiation succeeded")
+	}
+}
+
+// Records whether a connection was closed.
+type closeConn struct {
+	net.Conn
+	closed bool
+}
+
+func (cc *closeConn) Close() error {
+	cc.closed = true
+	return cc.Conn.Close()
+}
+
+// However a new connection fails, it is not left open.
+func TestOpenClosesFailed(t *testing.T) {
+	a, b := net.Pipe()
+	conn := &closeConn{Conn: a}
+
+	// Hangs up once it has the preamble.
+	go func() {
+		io.ReadFull(b, make([]byte, 4))
+		b.Close()
+	}()
+
+	var sm StreamManager
+	signer, _ := newTestSigner(t)
+
+	if _, err := sm.open(func() (net.Conn, error) { return conn, nil }, nil, testEntry(t, signer)); err == nil {
+		t.Fatal("Opened a connection that hung up")
+	}
+
+	if !conn.closed {
+		t.Error("Failed connection left open")
+	}
+}
@@ -0,0 +1,116 @@
+// Peer exchange. A connected peer can be asked for a sample of the entries it
+// has seen recently, which fills a new routing table far faster than
+// exploring with FindClosest alone.
+
+package proto
+
+import (
+	"context"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zif/zif/dht"
+)
+
+// The most entries that will be sent in, or read from, a single exchange.
+const MaxPexEntries = 32
+
+// Asks for up to n recently seen entries. Only those that verify are returned,
+// anything else the peer sent is dropped.
+func (c *Client) Pex(n int) (dht.Pairs, error) {
+	return c.PexContext(context.Background(), n)
+}
+
+func (c *Client) PexContext(ctx context.Context, n int) (pairs dht.Pairs, err error) {
+	defer c.bind(ctx, &err)()
+
+	if !c.agreement.Has(FeaturePex) {
+		return nil, NewProtocolError(ErrorUnsupported, "Peer does not support peer exchange")
+	}
+
+	if n > MaxPexEntries {
+		n = MaxPexEntries
+	}
+
+	msg := &Message{Header: ProtoPex}
+	msg.WriteInt(n)
+
+	err = c.WriteMessage(msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.ReadMessage()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = reply.Expect(ProtoEntry); err != nil {
+		return nil, err
+	}
+
+	length, err := reply.ReadInt()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if length < 0 || length > n {
+		return nil, c.violated(&LimitError{"exchanged entries", int64(n)})
+	}
+
+	pairs = make(dht.Pairs, 0, length)
+	dropped := 0
+
+	for i := 0; i < length; i++ {
+		kv := &dht.KeyValue{}
+		err = c.Decode(kv)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := VerifyPair(kv); err != nil {
+			dropped++
+			continue
+		}
+
+		pairs = append(pairs, kv)
+	}
+
+	if dropped > 0 {
+		log.WithField("dropped", dropped).Warn("Peer exchange contained invalid entries")
+	}
+
+	log.WithField("entries", len(pairs)).Info("Peer exchange complete")
+
+	return pairs, nil
+}
+
+// Decodes the entry held in kv, and checks that it is signed and stored under
+// the address it belongs to.
+func VerifyPair(kv *dht.KeyValue) (*Entry, error) {
+	if !kv.Valid() {
+		return nil, errors.New("Invalid key value")
+	}
+
+	entry, err := JsonToEntry(kv.Value())
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = entry.Verify()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !entry.Address.Equals(kv.Key()) {
+		return nil, errors.New("Entry stored under the wrong address")
+	}
+
+	return entry, nil
+}
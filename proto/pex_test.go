@@ -0,0 +1,32 @@
+package proto
+
+import (
+	"testing"
+
+	"github.com/zif/zif/dht"
+)
+
+func TestVerifyPair(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	entry := testEntry(t, signer)
+	dat, _ := entry.Json()
+
+	if _, err := VerifyPair(dht.NewKeyValue(entry.Address, dat)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// A valid entry stored under someone else's address.
+	other, _ := newTestSigner(t)
+	otherEntry := testEntry(t, other)
+
+	if _, err := VerifyPair(dht.NewKeyValue(otherEntry.Address, dat)); err == nil {
+		t.Error("Entry under the wrong address accepted")
+	}
+
+	entry.Name = "changed"
+	dat, _ = entry.Json()
+
+	if _, err := VerifyPair(dht.NewKeyValue(entry.Address, dat)); err == nil {
+		t.Error("Entry with invalid signature accepted")
+	}
+}
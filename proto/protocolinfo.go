@@ -6,7 +6,12 @@ var (
 	// Protocol header, so we know this is a zif client.
 	// Version should follow.
 	ProtoZif     int16 = 0x7a66
-	ProtoVersion int16 = 0x0000
+	ProtoVersion int16 = 0x0001
+
+	// The original version, messages are sent as a stream of JSON objects.
+	// Peers that connect with this version are still accepted, but do not
+	// negotiate. Any other version is followed by negotiation.
+	ProtoVersionJson int16 = 0x0000
 
 	ProtoHeader = 0x0000
 
@@ -20,6 +25,16 @@ var (
 	ProtoPong      = 0x0007
 	ProtoDone      = 0x0008
 
+	// Sent during negotiation, contains the versions and features a peer
+	// supports.
+	ProtoCapabilities = 0x0009
+
+	// An ephemeral key, signed with the identity key of the sender.
+	ProtoKeyExchange = 0x000a
+
+	// An entry, nonce and time, sent at the start of a transcript handshake.
+	ProtoHello = 0x000b
+
 	ProtoSearch  = 0x0101 // Request a search
 	ProtoRecent  = 0x0102 // Request recent posts
 	ProtoPopular = 0x0103 // Request popular posts
@@ -41,7 +56,18 @@ var (
 	ProtoPiece    = 0x0203
 	ProtoPost     = 0x0204
 
+	// A list of provider records, followed by the closest entries to the key
+	// they were asked for with.
+	ProtoProviders = 0x0205
+
 	ProtoDhtQuery       = 0x0300
 	ProtoDhtAnnounce    = 0x0301
 	ProtoDhtFindClosest = 0x0302
+
+	// Request a sample of recently seen entries.
+	ProtoPex = 0x0303
+
+	// Store a provider record, and ask for those stored under a key.
+	ProtoDhtAddProvider  = 0x0304
+	ProtoDhtGetProviders = 0x0305
 )
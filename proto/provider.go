@@ -0,0 +1,237 @@
+// Provider records, saying that a peer has something. This is which peers
+// index an infohash, so that anyone with a magnet link can find every peer
+// that describes it, and which peers have a term in their post titles.
+
+package proto
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zif/zif/common"
+	"github.com/zif/zif/dht"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+)
+
+type ProviderRecord struct {
+	Key       dht.Address `json:"key"`
+	Provider  dht.Address `json:"provider"`
+	PublicKey []byte      `json:"publicKey"`
+
+	// When the record was signed, it expires dht.ProviderTTL after.
+	Time      int64  `json:"time"`
+	Signature []byte `json:"signature"`
+}
+
+// The key provider records for an infohash are stored under. Hashed first, as
+// addresses can only be made from 32 bytes.
+func ProviderKey(infohash string) dht.Address {
+	hash := sha3.Sum256([]byte(strings.ToLower(infohash)))
+	return dht.NewAddress(hash[:])
+}
+
+// The key records for peers with a term in their titles are stored under.
+// Prefixed, so that a term can never share a key with an infohash.
+func TermKey(term string) dht.Address {
+	hash := sha3.Sum256([]byte("term:" + strings.ToLower(term)))
+	return dht.NewAddress(hash[:])
+}
+
+// Makes a record saying that whoever signer is provides key, signed now.
+func NewProviderRecord(key dht.Address, signer common.Signer) *ProviderRecord {
+	pr := &ProviderRecord{
+		Key:       key,
+		Provider:  dht.NewAddress(signer.PublicKey()),
+		PublicKey: signer.PublicKey(),
+		Time:      time.Now().Unix(),
+	}
+
+	pr.Signature = signer.Sign(pr.Bytes())
+
+	return pr
+}
+
+// What is signed.
+func (pr *ProviderRecord) Bytes() []byte {
+	ret := make([]byte, 0, len(pr.Key.Raw)+len(pr.Provider.Raw)+len(pr.PublicKey)+8)
+	ret = append(ret, pr.Key.Raw...)
+	ret = append(ret, pr.Provider.Raw...)
+	ret = append(ret, pr.PublicKey...)
+
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], uint64(pr.Time))
+
+	return append(ret, t[:]...)
+}
+
+func (pr *ProviderRecord) Json() ([]byte, error) {
+	return json.Marshal(pr)
+}
+
+func (pr *ProviderRecord) Expires() time.Time {
+	return time.Unix(pr.Time, 0).Add(dht.ProviderTTL)
+}
+
+func (pr *ProviderRecord) Verify() error {
+	if len(pr.Key.Raw) != dht.AddressBinarySize {
+		return errors.New("Invalid provider key")
+	}
+
+	if len(pr.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("Invalid public key")
+	}
+
+	if len(pr.Signature) != ed25519.SignatureSize {
+		return errors.New("Invalid signature")
+	}
+
+	addr := dht.NewAddress(pr.PublicKey)
+
+	if !addr.Equals(&pr.Provider) {
+		return errors.New("Provider address does not match public key")
+	}
+
+	if !ed25519.Verify(pr.PublicKey, pr.Bytes(), pr.Signature) {
+		return errors.New("Failed to verify signature")
+	}
+
+	if time.Unix(pr.Time, 0).After(time.Now().Add(MaxClockSkew)) {
+		return errors.New("Provider record signed in the future")
+	}
+
+	if time.Now().After(pr.Expires()) {
+		return errors.New("Provider record expired")
+	}
+
+	return nil
+}
+
+// Asks the peer to store a provider record.
+func (c *Client) AddProvider(pr *ProviderRecord) error {
+	return c.AddProviderContext(context.Background(), pr)
+}
+
+func (c *Client) AddProviderContext(ctx context.Context, pr *ProviderRecord) (err error) {
+	defer c.bind(ctx, &err)()
+
+	if !c.agreement.Has(FeatureProviders) {
+		return NewProtocolError(ErrorUnsupported, "Peer does not support provider records")
+	}
+
+	dat, err := pr.Json()
+
+	if err != nil {
+		return err
+	}
+
+	err = c.WriteMessage(&Message{Header: ProtoDhtAddProvider, Content: dat})
+
+	if err != nil {
+		return err
+	}
+
+	ok, err := c.ReadMessage()
+
+	if err != nil {
+		return err
+	}
+
+	return ok.Expect(ProtoOk)
+}
+
+// Asks the peer for the providers it holds for key, along with the closest
+// entries it knows of to key. Only records that verify and are for key are
+// returned.
+func (c *Client) GetProviders(key dht.Address) ([]*ProviderRecord, dht.Pairs, error) {
+	return c.GetProvidersContext(context.Background(), key)
+}
+
+func (c *Client) GetProvidersContext(ctx context.Context, key dht.Address) (records []*ProviderRecord, pairs dht.Pairs, err error) {
+	defer c.bind(ctx, &err)()
+
+	if !c.agreement.Has(FeatureProviders) {
+		return nil, nil, NewProtocolError(ErrorUnsupported, "Peer does not support provider records")
+	}
+
+	err = c.WriteMessage(&Message{Header: ProtoDhtGetProviders, Content: key.Raw})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reply, err := c.ReadMessage()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = reply.Expect(ProtoProviders); err != nil {
+		return nil, nil, err
+	}
+
+	sent := make([]*ProviderRecord, 0)
+
+	if err = reply.Decode(&sent); err != nil {
+		return nil, nil, err
+	}
+
+	if len(sent) > dht.MaxProviders {
+		return nil, nil, c.violated(&LimitError{"providers", dht.MaxProviders})
+	}
+
+	records = make([]*ProviderRecord, 0, len(sent))
+	dropped := 0
+
+	for _, i := range sent {
+		if i == nil || !i.Key.Equals(&key) || i.Verify() != nil {
+			dropped++
+			continue
+		}
+
+		records = append(records, i)
+	}
+
+	if dropped > 0 {
+		log.WithField("dropped", dropped).Warn("Provider records were invalid")
+	}
+
+	closest, err := c.ReadMessage()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = closest.Expect(ProtoEntry); err != nil {
+		return nil, nil, err
+	}
+
+	length, err := closest.ReadInt()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if length < 0 || length > MaxClosest {
+		return nil, nil, c.violated(&LimitError{"closest entries", MaxClosest})
+	}
+
+	pairs = make(dht.Pairs, 0, length)
+
+	for i := 0; i < length; i++ {
+		kv := &dht.KeyValue{}
+
+		if err = c.Decode(kv); err != nil {
+			return nil, nil, err
+		}
+
+		pairs = append(pairs, kv)
+	}
+
+	return records, pairs, nil
+}
@@ -0,0 +1,53 @@
+package proto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zif/zif/dht"
+)
+
+func TestProviderRecord(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	key := ProviderKey("657C483DC66C1F248FC2EDA5F5682EA557233E7A")
+
+	if !key.Equals(ptr(ProviderKey("657c483dc66c1f248fc2eda5f5682ea557233e7a"))) {
+		t.Error("Infohash case changed the key")
+	}
+
+	pr := NewProviderRecord(key, signer)
+
+	if err := pr.Verify(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Signed, but for a different key.
+	other := *pr
+	other.Key = ProviderKey("9f9165d9a281a9b8e782cd5176bbcc8256fd1871")
+
+	if other.Verify() == nil {
+		t.Error("Record with changed key verified")
+	}
+
+	// Someone else claiming to provide it with our signature.
+	someone, _ := newTestSigner(t)
+	other = *pr
+	other.Provider = dht.NewAddress(someone.public)
+
+	if other.Verify() == nil {
+		t.Error("Record for another provider verified")
+	}
+
+	// Old records are no good, however well signed.
+	old := *pr
+	old.Time = time.Now().Add(-dht.ProviderTTL - time.Minute).Unix()
+	old.Signature = signer.Sign(old.Bytes())
+
+	if old.Verify() == nil {
+		t.Error("Expired record verified")
+	}
+}
+
+func ptr(a dht.Address) *dht.Address {
+	return &a
+}
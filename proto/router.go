@@ -0,0 +1,78 @@
+// Routes incoming messages to whatever has registered to handle their header.
+// Anything can register handlers, so new message types do not need to touch
+// the server or the LocalPeer.
+
+package proto
+
+import "sync"
+
+// Handles a single message. Any error returned is sent back to the peer as a
+// ProtoNo.
+type Handler func(*Message) error
+
+// Wraps a handler, used for things that should happen around every message
+// such as logging or rate limiting. The header is the one the handler was
+// registered for.
+type Middleware func(header int, next Handler) Handler
+
+// The zero value is ready to use.
+type Router struct {
+	lock       sync.RWMutex
+	handlers   map[int]Handler
+	middleware []Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{handlers: make(map[int]Handler)}
+}
+
+// Registers a handler for a header, replacing any that was already there.
+func (r *Router) Register(header int, handler Handler) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.handlers == nil {
+		r.handlers = make(map[int]Handler)
+	}
+
+	r.handlers[header] = handler
+}
+
+// Adds middleware to the chain. Middleware added first runs first, and it
+// applies to all handlers, including those registered before it was added.
+func (r *Router) Use(middleware ...Middleware) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Whether anything has registered to handle a header.
+func (r *Router) Handles(header int) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	_, ok := r.handlers[header]
+
+	return ok
+}
+
+// Passes a message through the middleware chain to its handler.
+func (r *Router) Route(msg *Message) error {
+	r.lock.RLock()
+	handler, ok := r.handlers[msg.Header]
+	middleware := r.middleware
+	r.lock.RUnlock()
+
+	if !ok {
+		handler = func(msg *Message) error {
+			return NewProtocolError(ErrorUnsupported, "Unknown message type %d", msg.Header)
+		}
+	}
+
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](msg.Header, handler)
+	}
+
+	return handler(msg)
+}
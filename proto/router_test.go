@@ -0,0 +1,117 @@
+package proto
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/zif/zif/dht"
+)
+
+func TestRouter(t *testing.T) {
+	var router Router
+	order := make([]string, 0, 3)
+
+	trace := func(name string) Middleware {
+		return func(header int, next Handler) Handler {
+			return func(msg *Message) error {
+				order = append(order, name)
+				return next(msg)
+			}
+		}
+	}
+
+	router.Register(ProtoPing, func(msg *Message) error {
+		order = append(order, "handler")
+		return nil
+	})
+	router.Use(trace("first"), trace("second"))
+
+	if err := router.Route(&Message{Header: ProtoPing}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(order) != 3 || order[0] != "first" || order[1] != "second" || order[2] != "handler" {
+		t.Errorf("Middleware ran in the wrong order: %v", order)
+	}
+
+	err := router.Route(&Message{Header: ProtoSearch})
+
+	if !IsErrorCode(err, ErrorUnsupported) {
+		t.Errorf("Unknown header not refused: %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	var router Router
+
+	router.Register(ProtoPing, func(*Message) error { return nil })
+	router.Use(RateLimit(time.Hour, 2))
+
+	from := &dht.Address{Raw: make([]byte, dht.AddressBinarySize)}
+
+	for i := 0; i < 2; i++ {
+		if err := router.Route(&Message{Header: ProtoPing, From: from}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	err := router.Route(&Message{Header: ProtoPing, From: from})
+
+	if !IsErrorCode(err, ErrorRateLimited) {
+		t.Errorf("Burst exceeded without being rate limited: %v", err)
+	}
+}
+
+// Headers no one handles still count against a peer, but past a few they
+// share a limit rather than each having their own.
+func TestRateLimitHeaders(t *testing.T) {
+	var router Router
+
+	router.Use(RateLimit(time.Hour, 2))
+
+	from := &dht.Address{Raw: make([]byte, dht.AddressBinarySize)}
+	limited := 0
+
+	for i := 0; i < MaxRateLimitedHeaders+3; i++ {
+		err := router.Route(&Message{Header: 0x1000 + i, From: from})
+
+		if IsErrorCode(err, ErrorRateLimited) {
+			limited++
+		} else if !IsErrorCode(err, ErrorUnsupported) {
+			t.Fatalf("Unknown header %d not refused: %v", i, err)
+		}
+	}
+
+	if limited != 1 {
+		t.Errorf("%d unknown headers rate limited, expected 1", limited)
+	}
+}
+
+// Once too many peers are tracked, the one heard from least recently is
+// forgotten, even if it is still limited.
+func TestRateLimitForgets(t *testing.T) {
+	var router Router
+
+	router.Register(ProtoPing, func(*Message) error { return nil })
+	router.Use(RateLimit(time.Hour, 1))
+
+	peer := func(i int) *dht.Address {
+		raw := make([]byte, dht.AddressBinarySize)
+		binary.BigEndian.PutUint32(raw, uint32(i))
+
+		return &dht.Address{Raw: raw}
+	}
+
+	router.Route(&Message{Header: ProtoPing, From: peer(0)})
+
+	for i := 1; i <= MaxRateLimited; i++ {
+		if err := router.Route(&Message{Header: ProtoPing, From: peer(i)}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if err := router.Route(&Message{Header: ProtoPing, From: peer(0)}); err != nil {
+		t.Errorf("Forgotten peer still limited: %v", err)
+	}
+}
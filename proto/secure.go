@@ -0,0 +1,279 @@
+// Encrypts a connection once the handshake is complete. Both sides generate an
+// ephemeral X25519 key and sign it with their identity key, along with the
+// handshake transcript, so only the peer we have just handshaked with, on this
+// connection, can derive the session keys. Everything after
+// this, yamux included, is sent as AEAD sealed records.
+//
+// Each record is laid out as follows:
+//
+//	length     uint32, little endian - the length of the sealed data
+//	sealed     [length]byte
+
+package proto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zif/zif/common"
+)
+
+const (
+	// The most plaintext that will be sealed in a single record.
+	MaxRecordSize = 16 * 1024
+
+	recordOverhead = 16
+)
+
+// Prepended to ephemeral keys before they are signed, so the signature cannot
+// be mistaken for one made for anything else.
+var keyExchangeLabel = []byte("zif key exchange")
+
+// Performs the key exchange over cl, returning a connection that encrypts
+// everything written to it. The initiator is the side that opened the
+// connection, it sends its key first.
+func secure(cl Client, lp common.Signer, remote ed25519.PublicKey, initiator bool) (net.Conn, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	public := private.PublicKey().Bytes()
+
+	local := MessageKeyExchange{
+		Key:       public,
+		Signature: lp.Sign(keyExchangeData(cl.transcript, public)),
+	}
+
+	var theirs *MessageKeyExchange
+
+	if initiator {
+		err = sendKeyExchange(cl, local)
+
+		if err == nil {
+			theirs, err = recieveKeyExchange(cl, remote)
+		}
+	} else {
+		theirs, err = recieveKeyExchange(cl, remote)
+
+		if err == nil {
+			err = sendKeyExchange(cl, local)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	remoteKey, err := ecdh.X25519().NewPublicKey(theirs.Key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := private.ECDH(remoteKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	initPub, respPub := public, theirs.Key
+	if !initiator {
+		initPub, respPub = theirs.Key, public
+	}
+
+	// Keys are derived for each direction, so the same nonce is never used
+	// twice with one key.
+	initKey := deriveKey(shared, "initiator", initPub, respPub)
+	respKey := deriveKey(shared, "responder", initPub, respPub)
+
+	log.Debug("Connection secured")
+
+	if initiator {
+		return newSecureConn(cl.conn, initKey, respKey)
+	}
+
+	return newSecureConn(cl.conn, respKey, initKey)
+}
+
+func sendKeyExchange(cl Client, kx MessageKeyExchange) error {
+	dat, err := kx.Encode()
+
+	if err != nil {
+		return err
+	}
+
+	return cl.WriteMessage(&Message{Header: ProtoKeyExchange, Content: dat})
+}
+
+func recieveKeyExchange(cl Client, remote ed25519.PublicKey) (*MessageKeyExchange, error) {
+	msg, err := cl.ReadMessage()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Header != ProtoKeyExchange {
+		return nil, errors.New("Expected key exchange")
+	}
+
+	kx := &MessageKeyExchange{}
+	err = msg.Decode(kx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(remote) != ed25519.PublicKeySize ||
+		!ed25519.Verify(remote, keyExchangeData(cl.transcript, kx.Key), kx.Signature) {
+		return nil, errors.New("Key exchange signature not verified")
+	}
+
+	return kx, nil
+}
+
+// What is signed for an ephemeral key. The transcript is a fixed size hash, so
+// it cannot run into the key.
+func keyExchangeData(transcript, key []byte) []byte {
+	ret := make([]byte, 0, len(keyExchangeLabel)+len(transcript)+len(key))
+	ret = append(ret, keyExchangeLabel...)
+	ret = append(ret, transcript...)
+
+	return append(ret, key...)
+}
+
+func deriveKey(shared []byte, label string, init, resp []byte) []byte {
+	hash := sha3.New256()
+
+	hash.Write(shared)
+	hash.Write([]byte(label))
+	hash.Write(init)
+	hash.Write(resp)
+
+	return hash.Sum(nil)
+}
+
+// A net.Conn that seals everything written, and opens everything read.
+type secureConn struct {
+	net.Conn
+
+	send cipher.AEAD
+	recv cipher.AEAD
+
+	sendNonce uint64
+	recvNonce uint64
+
+	// Plaintext that has been opened but not yet read.
+	buffer bytes.Buffer
+
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+}
+
+func newSecureConn(conn net.Conn, sendKey, recvKey []byte) (*secureConn, error) {
+	send, err := newAEAD(sendKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	recv, err := newAEAD(recvKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &secureConn{Conn: conn, send: send, recv: recv}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func nonce(aead cipher.AEAD, counter uint64) []byte {
+	ret := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(ret[len(ret)-8:], counter)
+
+	return ret
+}
+
+func (sc *secureConn) Write(b []byte) (int, error) {
+	sc.writeLock.Lock()
+	defer sc.writeLock.Unlock()
+
+	written := 0
+
+	for len(b) > 0 {
+		size := len(b)
+		if size > MaxRecordSize {
+			size = MaxRecordSize
+		}
+
+		record := make([]byte, 4, 4+size+recordOverhead)
+		record = sc.send.Seal(record, nonce(sc.send, sc.sendNonce), b[:size], nil)
+		binary.LittleEndian.PutUint32(record[0:4], uint32(len(record)-4))
+		sc.sendNonce++
+
+		if _, err := sc.Conn.Write(record); err != nil {
+			return written, err
+		}
+
+		written += size
+		b = b[size:]
+	}
+
+	return written, nil
+}
+
+func (sc *secureConn) Read(b []byte) (int, error) {
+	sc.readLock.Lock()
+	defer sc.readLock.Unlock()
+
+	if sc.buffer.Len() == 0 {
+		var length uint32
+
+		if err := binary.Read(sc.Conn, binary.LittleEndian, &length); err != nil {
+			return 0, err
+		}
+
+		if length > MaxRecordSize+recordOverhead {
+			return 0, errors.New("Record too large")
+		}
+
+		sealed := make([]byte, length)
+
+		if _, err := io.ReadFull(sc.Conn, sealed); err != nil {
+			return 0, err
+		}
+
+		plain, err := sc.recv.Open(sealed[:0], nonce(sc.recv, sc.recvNonce), sealed, nil)
+
+		if err != nil {
+			return 0, err
+		}
+
+		sc.recvNonce++
+		sc.buffer.Write(plain)
+	}
+
+	return sc.buffer.Read(b)
+}
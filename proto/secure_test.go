@@ -0,0 +1,130 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+type testSigner struct {
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+func (ts testSigner) PublicKey() []byte {
+	return ts.public
+}
+
+func (ts testSigner) Sign(msg []byte) []byte {
+	return ed25519.Sign(ts.private, msg)
+}
+
+func newTestSigner(t *testing.T) (testSigner, ed25519.PublicKey) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return testSigner{pk, sk}, pk
+}
+
+func TestSecure(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	agreement := Agreement{Version: ProtoVersion}
+	client, clientPk := newTestSigner(t)
+	server, serverPk := newTestSigner(t)
+
+	ret := make(chan net.Conn)
+
+	go func() {
+		conn, err := secure(Client{conn: b, agreement: agreement}, server, clientPk, false)
+
+		if err != nil {
+			t.Error(err.Error())
+		}
+
+		ret <- conn
+	}()
+
+	conn, err := secure(Client{conn: a, agreement: agreement}, client, serverPk, true)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	remote := <-ret
+
+	if remote == nil {
+		t.FailNow()
+	}
+
+	// Larger than a single record.
+	content := make([]byte, MaxRecordSize*2+100)
+	rand.Read(content)
+
+	go conn.Write(content)
+
+	read := make([]byte, len(content))
+	_, err = io.ReadFull(remote, read)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !bytes.Equal(content, read) {
+		t.Error("Content did not survive encryption")
+	}
+}
+
+func TestSecureWrongIdentity(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	agreement := Agreement{Version: ProtoVersion}
+	client, clientPk := newTestSigner(t)
+	server, _ := newTestSigner(t)
+	_, impostorPk := newTestSigner(t)
+
+	go secure(Client{conn: b, agreement: agreement}, server, clientPk, false)
+
+	_, err := secure(Client{conn: a, agreement: agreement}, client, impostorPk, true)
+
+	if err == nil {
+		t.Error("Key exchange accepted from the wrong identity")
+	}
+}
+
+// A key signed for one handshake cannot be used after another.
+func TestSecureTranscript(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	agreement := Agreement{Version: ProtoVersion}
+	client, clientPk := newTestSigner(t)
+	server, serverPk := newTestSigner(t)
+
+	// The server turns the key away, and gives up on the connection.
+	go func() {
+		secure(Client{conn: b, agreement: agreement, transcript: make([]byte, 32)}, server, clientPk, false)
+		b.Close()
+	}()
+
+	theirs := make([]byte, 32)
+	theirs[0] = 1
+
+	_, err := secure(Client{conn: a, agreement: agreement, transcript: theirs}, client, serverPk, true)
+
+	if err == nil {
+		t.Error("Key exchange accepted for another transcript")
+	}
+}
@@ -4,8 +4,10 @@ package proto
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -15,50 +17,169 @@ import (
 
 type Server struct {
 	listener net.Listener
+
+	// How connections are accepted, TCP if nil.
+	Transport Transport
+
+	// Every message read from a stream is passed to this.
+	Router Router
+
+	// Limits on inbound connections, set before Listen.
+	Limits    AdmissionLimits
+	admission admission
+
+	// Peers whose entries have less proof of work are turned away.
+	MinDifficulty int
+
+	// Whether peers that do not negotiate are accepted, see
+	// StreamManager.AllowLegacy.
+	AllowLegacy bool
+
+	// Tracks messages being handled, so that they can finish before shutdown.
+	lock    sync.Mutex
+	closing bool
+	active  int
+	drained chan struct{}
 }
 
-func (s *Server) Listen(addr string, handler ProtocolHandler, data common.Encodable) {
-	var err error
+// How long Shutdown waits for handlers to finish if not told otherwise.
+const DefaultDrainTimeout = time.Second * 10
+
+// Binds to addr, then accepts connections in the background until Close is
+// called.
+func (s *Server) Listen(addr string, handler ProtocolHandler, data common.Encodable) error {
+	transport := s.Transport
 
-	s.listener, err = net.Listen("tcp", addr)
+	if transport == nil {
+		transport = TCPTransport{}
+	}
+
+	listener, err := transport.Listen(addr)
 
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	log.WithField("address").Info("Listening")
+	s.lock.Lock()
+	s.listener = listener
+	s.lock.Unlock()
+
+	log.WithField("address", addr).Info("Listening")
+
+	go s.serve(listener, handler, data)
 
+	return nil
+}
+
+func (s *Server) serve(listener net.Listener, handler ProtocolHandler, data common.Encodable) {
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 
 		if err != nil {
+			if s.isClosing() {
+				return
+			}
+
 			log.Error(err.Error())
-		}
 
-		log.Info("New TCP connection")
+			// Temporary errors are worth retrying, anything else means the
+			// listener has been closed.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
 
-		var zif int16
-		binary.Read(conn, binary.LittleEndian, &zif)
+			return
+		}
+
+		admitted, ok := s.admission.admit(conn, s.Limits)
 
-		if zif != ProtoZif {
-			log.Error("This is not a Zif connection: ", zif)
+		if !ok {
+			log.WithField("remote", conn.RemoteAddr()).Warn("Connection refused, too many open")
+			conn.Close()
 			continue
 		}
 
-		log.Debug("Zif connection")
+		log.Info("New connection")
 
-		var version int16
-		binary.Read(conn, binary.LittleEndian, &version)
+		go s.accept(admitted, handler, data)
+	}
+}
 
-		if version != ProtoVersion {
-			log.Error("Incorrect protocol version: ", version)
-			continue
+// Counts of inbound connections accepted and refused.
+func (s *Server) Admission() AdmissionStats {
+	return s.admission.stats()
+}
+
+// Reads the magic bytes and version from a new connection, negotiates if the
+// peer supports it, then handshakes. The connection is closed if any of this
+// fails, or takes longer than the handshake timeout.
+func (s *Server) accept(conn net.Conn, handler ProtocolHandler, data common.Encodable) {
+	defer s.admission.handshakeDone()
+
+	deadline := time.Now().Add(s.Limits.handshakeTimeout())
+	conn.SetDeadline(deadline)
+
+	fail := func(err error) {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			s.admission.timeout()
+			log.WithField("remote", conn.RemoteAddr()).Warn("Handshake timed out")
+		} else {
+			log.Error(err.Error())
+		}
+
+		conn.Close()
+	}
+
+	var zif int16
+	err := binary.Read(conn, binary.LittleEndian, &zif)
+
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	if zif != ProtoZif {
+		log.Error("This is not a Zif connection: ", zif)
+		conn.Close()
+		return
+	}
+
+	log.Debug("Zif connection")
+
+	var version int16
+	err = binary.Read(conn, binary.LittleEndian, &version)
+
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	agreement := LegacyAgreement
+
+	// Peers using JSON predate negotiation, anything else is followed by the
+	// capabilities of the peer.
+	if version == ProtoVersionJson && !s.AllowLegacy {
+		fail(&NegotiationError{"Legacy peers are not accepted"})
+		return
+	}
+
+	if version != ProtoVersionJson {
+		agreement, err = negotiate_recieve(conn)
+
+		if err != nil {
+			fail(err)
+			return
 		}
 
-		log.Debug("Correct version")
+		// Negotiation clears the deadline when it is done.
+		conn.SetDeadline(deadline)
+	}
+
+	log.WithField("version", agreement.Version).Debug("Handshaking new connection")
+	err = s.Handshake(conn, handler, data, agreement)
 
-		log.Debug("Handshaking new connection")
-		go s.Handshake(conn, handler, data)
+	if err != nil {
+		fail(err)
 	}
 }
 
@@ -89,88 +210,183 @@ func (s *Server) ListenStream(peer NetworkPeer, handler ProtocolHandler) {
 
 		peer.AddStream(stream)
 
-		go s.HandleStream(peer, handler, stream)
+		go s.HandleStream(peer, stream)
 	}
 }
 
-func (s *Server) HandleStream(peer NetworkPeer, handler ProtocolHandler, stream net.Conn) {
+func (s *Server) HandleStream(peer NetworkPeer, stream net.Conn) {
 	log.Debug("Handling stream")
 
-	cl := Client{stream, nil, nil}
+	cl := peer.Streams().WrapStream(stream)
 
 	for {
 		msg, err := cl.ReadMessage()
 
 		if err != nil {
 			log.Error(err.Error())
+
+			if IsViolation(err) {
+				peer.Penalise(err)
+			}
+
 			return
 		}
-		msg.Client = &cl
+		msg.Client = cl
 		msg.From = peer.Address()
 
-		s.RouteMessage(msg, handler)
+		// Once shutting down, no new requests are started.
+		if !s.begin() {
+			cl.Close()
+			return
+		}
+
+		s.RouteMessage(msg)
+		s.end()
 	}
 }
 
-func (s *Server) RouteMessage(msg *Message, handler ProtocolHandler) {
-	var err error
+// Handlers may fail part way through a reply, so the peer is only told why
+// its request failed if nothing has been written yet. Otherwise the stream is
+// in an unknown state, and is closed.
+func (s *Server) RouteMessage(msg *Message) {
+	stream := &writeTracker{Conn: msg.Client.conn}
+	msg.Client.conn = stream
+	msg.Stream = stream
 
-	switch msg.Header {
+	// JSON is encoded straight to the connection, so the encoder has to be
+	// made again to write through this message's tracker, and again after.
+	msg.Client.encoder = nil
 
-	case ProtoDhtAnnounce:
-		err = handler.HandleAnnounce(msg)
-	case ProtoDhtQuery:
-		err = handler.HandleQuery(msg)
-	case ProtoDhtFindClosest:
-		err = handler.HandleFindClosest(msg)
-	case ProtoSearch:
-		err = handler.HandleSearch(msg)
-	case ProtoRecent:
-		err = handler.HandleRecent(msg)
-	case ProtoPopular:
-		err = handler.HandlePopular(msg)
-	case ProtoRequestHashList:
-		err = handler.HandleHashList(msg)
-	case ProtoRequestPiece:
-		err = handler.HandlePiece(msg)
-	case ProtoRequestAddPeer:
-		err = handler.HandleAddPeer(msg)
-	case ProtoPing:
-		err = handler.HandlePing(msg)
+	err := s.Router.Route(msg)
 
-	default:
-		log.Error("Unknown message type")
+	msg.Client.conn = stream.Conn
+	msg.Client.encoder = nil
 
+	if err == nil {
+		return
 	}
 
-	if err != nil {
-		log.Error(err.Error())
+	log.Error(err.Error())
+
+	if !stream.written {
+		msg.Client.WriteError(err)
+		return
 	}
 
+	msg.Client.Close()
 }
 
-func (s *Server) Handshake(conn net.Conn, lp ProtocolHandler, data common.Encodable) {
-	cl := Client{conn, nil, nil}
+// Records whether anything has been written to a stream.
+type writeTracker struct {
+	net.Conn
+	written bool
+}
 
-	header, err := handshake(cl, lp, data)
+func (wt *writeTracker) Write(b []byte) (int, error) {
+	wt.written = true
+	return wt.Conn.Write(b)
+}
+
+// Handshakes with a connection that has already been negotiated. The caller
+// is left to close conn if this fails.
+func (s *Server) Handshake(conn net.Conn, lp ProtocolHandler, data common.Encodable, agreement Agreement) error {
+	cl := Client{conn: conn, agreement: agreement}
+
+	header, err := handshake(&cl, lp, data)
 
 	if err != nil {
-		log.Error(err.Error())
-		return
+		return err
 	}
 
+	if err = header.CheckWork(s.MinDifficulty); err != nil {
+		return err
+	}
+
+	if cl.framed() {
+		cl.conn, err = secure(cl, lp, header.PublicKey, false)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// The handshake is done, from here on streams set their own deadlines.
+	conn.SetDeadline(time.Time{})
+
 	peer, err := lp.HandleHandshake(ConnHeader{cl, *header})
 
 	if err != nil {
-		log.Error(err.Error())
-		return
+		return err
 	}
 
 	go s.ListenStream(peer, lp)
+
+	return nil
 }
 
+// Stops accepting connections and new requests. Requests already being handled
+// carry on, use Shutdown to wait for them.
 func (s *Server) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closing {
+		return
+	}
+
+	s.closing = true
+	s.drained = make(chan struct{})
+
+	if s.active == 0 {
+		close(s.drained)
+	}
+
 	if s.listener != nil {
 		s.listener.Close()
 	}
 }
+
+// Closes the server, then waits up to timeout for any requests being handled,
+// such as piece transfers or searches, to finish.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	s.Close()
+
+	select {
+	case <-s.drained:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("Timed out waiting for requests to finish")
+	}
+}
+
+func (s *Server) isClosing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.closing
+}
+
+// Marks a request as started, false if the server is shutting down.
+func (s *Server) begin() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closing {
+		return false
+	}
+
+	s.active++
+
+	return true
+}
+
+func (s *Server) end() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.active--
+
+	if s.closing && s.active == 0 {
+		close(s.drained)
+	}
+}
@@ -0,0 +1,181 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerListenInUse(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	first := Server{Transport: network}
+	second := Server{Transport: network}
+
+	if err := first.Listen("a:1", nil, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer first.Close()
+
+	if err := second.Listen("a:1", nil, nil); err == nil {
+		t.Error("Listening on an address in use should fail")
+	}
+
+	first.Close()
+
+	if _, err := network.Dial("a:1"); err == nil {
+		t.Error("Closed server still accepting connections")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	var server Server
+
+	if !server.begin() {
+		t.Fatal("Server refused request before shutdown")
+	}
+
+	if server.Shutdown(time.Millisecond*10) == nil {
+		t.Error("Shutdown did not wait for request")
+	}
+
+	if server.begin() {
+		t.Error("Request started after shutdown")
+	}
+
+	done := make(chan error)
+
+	go func() {
+		done <- server.Shutdown(time.Second)
+	}()
+
+	server.end()
+
+	if err := <-done; err != nil {
+		t.Error(err.Error())
+	}
+}
+
+// Peers that do not negotiate would not be encrypted, so they are turned away
+// unless legacy peers are allowed.
+func TestServerRefusesLegacy(t *testing.T) {
+	network := NewMemoryNetwork()
+	server := Server{Transport: network}
+
+	if err := server.Listen("a:1", nil, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Close()
+
+	conn, err := network.Dial("a:1")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	binary.Write(conn, binary.LittleEndian, ProtoZif)
+	binary.Write(conn, binary.LittleEndian, ProtoVersionJson)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Legacy connection was not closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("Legacy connection was not closed")
+	}
+}
+
+func TestRouteMessageErrors(t *testing.T) {
+	s := Server{Router: *NewRouter()}
+
+	s.Router.Register(ProtoSearch, func(msg *Message) error {
+		return NewProtocolError(ErrorNotFound, "Nothing found")
+	})
+
+	// Fails before replying, with an error that is not the peer's business.
+	s.Router.Register(ProtoPopular, func(msg *Message) error {
+		return errors.New("database is locked")
+	})
+
+	// Fails having already started its reply.
+	s.Router.Register(ProtoRecent, func(msg *Message) error {
+		msg.Client.WriteMessage(&Message{Header: ProtoPosts})
+		return errors.New("database is locked")
+	})
+
+	route := func(header int) (*Client, net.Conn) {
+		a, b := net.Pipe()
+		cl := &Client{conn: a, agreement: Agreement{Version: ProtoVersion}}
+
+		go s.RouteMessage(&Message{Header: header, Client: cl})
+
+		return &Client{conn: b, agreement: Agreement{Version: ProtoVersion}}, a
+	}
+
+	peer, conn := route(ProtoSearch)
+	defer conn.Close()
+
+	reply, err := peer.ReadMessage()
+
+	if err != nil || reply.Header != ProtoNo {
+		t.Errorf("Expected an error reply, got %v", reply)
+	}
+
+	peer, conn = route(ProtoPopular)
+	defer conn.Close()
+
+	reply, err = peer.ReadMessage()
+
+	if err != nil || reply.Header != ProtoNo || !IsErrorCode(DecodeProtocolError(reply.Content), ErrorInternal) {
+		t.Errorf("Expected an internal error reply, got %v", reply)
+	}
+
+	peer, conn = route(ProtoRecent)
+	defer conn.Close()
+
+	if reply, err = peer.ReadMessage(); err != nil || reply.Header != ProtoPosts {
+		t.Fatalf("Expected the partial reply, got %v", reply)
+	}
+
+	if _, err = peer.ReadMessage(); err == nil {
+		t.Error("Stream left open after a reply failed")
+	}
+}
+
+// JSON clients keep their encoder between messages, which must not hide what
+// a later handler has written.
+func TestRouteMessageLegacy(t *testing.T) {
+	s := Server{Router: *NewRouter()}
+
+	s.Router.Register(ProtoPing, func(msg *Message) error {
+		return msg.Client.WriteMessage(&Message{Header: ProtoPong})
+	})
+
+	s.Router.Register(ProtoRecent, func(msg *Message) error {
+		msg.Client.WriteMessage(&Message{Header: ProtoPosts})
+		return NewProtocolError(ErrorNotFound, "Nothing more")
+	})
+
+	a, b := net.Pipe()
+	defer a.Close()
+
+	cl := &Client{conn: a, agreement: LegacyAgreement}
+	peer := &Client{conn: b, agreement: LegacyAgreement}
+
+	go func() {
+		s.RouteMessage(&Message{Header: ProtoPing, Client: cl})
+		s.RouteMessage(&Message{Header: ProtoRecent, Client: cl})
+	}()
+
+	for _, i := range []int{ProtoPong, ProtoPosts} {
+		if reply, err := peer.ReadMessage(); err != nil || reply.Header != i {
+			t.Fatalf("Expected %d, got %v", i, reply)
+		}
+	}
+
+	if _, err := peer.ReadMessage(); err == nil {
+		t.Error("Error sent after a reply had started")
+	}
+}
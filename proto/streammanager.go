@@ -16,9 +16,14 @@ import (
 	"github.com/zif/zif/common"
 )
 
+var errVersionNotAcknowledged = errors.New("Protocol version not acknowledged")
+
 type StreamManager struct {
 	connection ConnHeader
 
+	// The version and features agreed upon during negotiation.
+	agreement Agreement
+
 	// Open yamux servers
 	server *yamux.Session
 
@@ -31,10 +36,28 @@ type StreamManager struct {
 	Socks     bool
 	SocksPort int
 	torDialer proxy.Dialer
+
+	// Used to dial peers when not going through Tor, TCP if nil.
+	Transport Transport
+
+	// Peers whose entries have less proof of work are not connected to.
+	MinDifficulty int
+
+	// Whether to fall back to JSON for peers that do not negotiate. These
+	// connections are not encrypted, and anyone in the middle can force one,
+	// so this is off unless asked for.
+	AllowLegacy bool
 }
 
 func (sm *StreamManager) SetConnection(conn ConnHeader) {
 	sm.connection = conn
+	sm.agreement = conn.Client.agreement
+}
+
+// The version and features agreed upon for this connection, handlers can
+// use this to decide what they are able to send.
+func (sm *StreamManager) Agreement() Agreement {
+	return sm.agreement
 }
 
 func (sm *StreamManager) Setup() {
@@ -54,13 +77,7 @@ func (sm *StreamManager) OpenSocks(addr string, lp ProtocolHandler, data common.
 		sm.torDialer = dialer
 	}
 
-	conn, err := sm.torDialer.Dial("tcp", addr)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return sm.handleConnection(conn, lp, data)
+	return sm.open(func() (net.Conn, error) { return sm.torDialer.Dial("tcp", addr) }, lp, data)
 }
 
 func (sm *StreamManager) OpenTCP(addr string, lp ProtocolHandler, data common.Encodable) (*ConnHeader, error) {
@@ -72,55 +89,121 @@ func (sm *StreamManager) OpenTCP(addr string, lp ProtocolHandler, data common.En
 		return &sm.connection, nil
 	}
 
-	conn, err := net.Dial("tcp", addr)
+	transport := sm.Transport
+
+	if transport == nil {
+		transport = TCPTransport{}
+	}
+
+	return sm.open(func() (net.Conn, error) { return transport.Dial(addr) }, lp, data)
+}
+
+// Connects and negotiates using the newest protocol version. Older peers never
+// reply to negotiation, so if that times out and AllowLegacy is set then dial
+// again and fall back to JSON.
+func (sm *StreamManager) open(dial func() (net.Conn, error), lp ProtocolHandler, data common.Encodable) (*ConnHeader, error) {
+	conn, err := dial()
 
 	if err != nil {
 		return nil, err
 	}
 
-	return sm.handleConnection(conn, lp, data)
+	header, err := sm.handleConnection(conn, lp, data, ProtoVersion)
+
+	if err != errVersionNotAcknowledged {
+		return header, err
+	}
+
+	if !sm.AllowLegacy {
+		return nil, &NegotiationError{"Peer did not acknowledge protocol version"}
+	}
+
+	log.Info("Peer did not acknowledge protocol version, falling back to JSON")
+
+	conn, err = dial()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sm.handleConnection(conn, lp, data, ProtoVersionJson)
 }
 
-func (sm *StreamManager) handleConnection(conn net.Conn, lp ProtocolHandler, data common.Encodable) (*ConnHeader, error) {
+// Sets up a connection that has just been dialled. conn is closed if this
+// fails.
+func (sm *StreamManager) handleConnection(conn net.Conn, lp ProtocolHandler, data common.Encodable, version int16) (_ *ConnHeader, err error) {
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
 	log.WithField("zif", ProtoZif).Info("Sending")
-	err := binary.Write(conn, binary.LittleEndian, ProtoZif)
+	err = binary.Write(conn, binary.LittleEndian, ProtoZif)
 
 	if err != nil {
 		return nil, err
 	}
 
-	log.WithField("Version", ProtoVersion).Info("Sending")
-	err = binary.Write(conn, binary.LittleEndian, ProtoVersion)
+	log.WithField("Version", version).Info("Sending")
+	err = binary.Write(conn, binary.LittleEndian, version)
 
 	if err != nil {
 		return nil, err
 	}
 
-	header, err := sm.Handshake(conn, lp, data)
+	agreement := LegacyAgreement
+
+	if version != ProtoVersionJson {
+		agreement, err = negotiate_send(conn)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cl := &Client{conn: conn, agreement: agreement}
+	header, err := sm.Handshake(cl, lp, data)
 
 	if err != nil {
 		return nil, err
 	}
 
-	pair := ConnHeader{*NewClient(conn), *header}
-	sm.connection = pair
+	if err = header.CheckWork(sm.MinDifficulty); err != nil {
+		return nil, err
+	}
+
+	if cl.framed() {
+		cl.conn, err = secure(*cl, lp, header.PublicKey, true)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pair := ConnHeader{*cl, *header}
+	sm.SetConnection(pair)
 
 	return &pair, nil
 }
 
-func (sm *StreamManager) Handshake(conn net.Conn, lp ProtocolHandler, data common.Encodable) (*Entry, error) {
-	cl := NewClient(conn)
+func (sm *StreamManager) Handshake(cl *Client, lp ProtocolHandler, data common.Encodable) (*Entry, error) {
+	if cl.framed() {
+		log.Debug("Sending transcript handshake")
+		return transcript_handshake(cl, lp, data, true)
+	}
+
 	log.Debug("Sending handshake")
 	err := handshake_send(*cl, lp, data)
 
 	msg, err := cl.ReadMessage()
 
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
 
-	if !msg.Ok() {
-		return nil, errors.New(string(msg.Content))
+	if err = msg.Expect(ProtoOk); err != nil {
+		return nil, err
 	}
 
 	// server now knows that we are definitely who we say we are.
@@ -205,36 +288,38 @@ func (sm *StreamManager) GetSession() *yamux.Session {
 }
 
 func (sm *StreamManager) OpenStream() (*Client, error) {
-	var ret Client
-	var err error
 	session := sm.GetSession()
 
 	if session == nil {
 		return nil, errors.New("Cannot open stream, no session")
 	}
 
-	ret.conn, err = session.Open()
+	conn, err := session.Open()
 
 	if err != nil {
 		return nil, err
 	}
 
-	err = ret.conn.SetDeadline(time.Now().Add(time.Second * 10))
+	err = conn.SetDeadline(time.Now().Add(time.Second * 10))
 
 	if err != nil {
 		return nil, err
 	}
 
 	log.Debug("Opened stream (", session.NumStreams(), " total)")
-	return &ret, nil
+	return sm.WrapStream(conn), nil
+}
+
+// Wraps a stream in a Client that uses what was agreed upon for this
+// connection.
+func (sm *StreamManager) WrapStream(conn net.Conn) *Client {
+	return &Client{conn: conn, agreement: sm.agreement}
 }
 
 // These streams should be coming from Server.ListenStream, as they will be started
 // by the peer.
 func (sm *StreamManager) AddStream(conn net.Conn) {
-	var ret Client
-	ret.conn = conn
-	sm.clients = append(sm.clients, ret)
+	sm.clients = append(sm.clients, *sm.WrapStream(conn))
 }
 
 func (sm *StreamManager) GetStream(conn net.Conn) *Client {
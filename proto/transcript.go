@@ -0,0 +1,272 @@
+// The handshake used by every peer that negotiated, see FeatureTranscript. Both
+// sides send their entry along with a fresh nonce and the time, then each signs
+// a hash of everything that was exchanged: both nonces, both identities, both
+// times and the negotiation itself. A signature is then only valid for this one connection,
+// between these two peers, so it cannot be replayed or relayed elsewhere.
+//
+// The initiator is the side that opened the connection, it speaks first:
+//
+//	initiator -> responder    ProtoHello
+//	responder -> initiator    ProtoHello
+//	initiator -> responder    ProtoSig, signed initiator transcript
+//	responder -> initiator    ProtoSig, signed responder transcript
+
+package proto
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/zif/zif/common"
+	"github.com/zif/zif/util"
+)
+
+const (
+	// The size of the nonce each side contributes.
+	HandshakeNonceSize = 32
+
+	// How far apart the clocks of two peers can be.
+	MaxClockSkew = time.Minute * 5
+)
+
+// Prepended to transcripts before they are hashed, so that a transcript
+// signature cannot be mistaken for one made for anything else.
+var transcriptLabel = []byte("zif handshake transcript")
+
+// The first thing each side sends in a transcript handshake.
+type MessageHello struct {
+	Entry []byte
+	Nonce []byte
+	Time  int64
+}
+
+func (mh *MessageHello) Encode() ([]byte, error) {
+	data, err := json.Marshal(mh)
+	return data, err
+}
+
+// A hello that has been checked, along with the entry it carried.
+type hello struct {
+	msg   MessageHello
+	entry *Entry
+}
+
+func transcript_handshake(cl *Client, lp common.Signer, data common.Encodable, initiator bool) (*Entry, error) {
+	local, err := newHello(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var remote *hello
+
+	if initiator {
+		err = sendHello(*cl, local)
+
+		if err == nil {
+			remote, err = recieveHello(*cl)
+		}
+	} else {
+		remote, err = recieveHello(*cl)
+
+		if err == nil {
+			err = sendHello(*cl, local)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Both sides must agree on this, or the signatures will not verify.
+	init, resp := local, &remote.msg
+	if !initiator {
+		init, resp = &remote.msg, local
+	}
+
+	hash := transcript(cl.agreement, init, resp)
+	ours := lp.Sign(append([]byte(role(initiator)), hash...))
+
+	if initiator {
+		err = sendTranscriptSig(*cl, ours)
+
+		if err == nil {
+			err = recieveTranscriptSig(*cl, remote.entry, role(false), hash)
+		}
+	} else {
+		err = recieveTranscriptSig(*cl, remote.entry, role(true), hash)
+
+		if err == nil {
+			err = sendTranscriptSig(*cl, ours)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	cl.transcript = hash
+
+	s, _ := remote.entry.Address.String()
+	log.WithField("peer", s).Info("Verified")
+
+	return remote.entry, nil
+}
+
+func newHello(data common.Encodable) (*MessageHello, error) {
+	entry, err := data.Json()
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := util.CryptoRandBytes(HandshakeNonceSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &MessageHello{entry, nonce, time.Now().Unix()}, nil
+}
+
+func sendHello(cl Client, mh *MessageHello) error {
+	dat, err := mh.Encode()
+
+	if err != nil {
+		return err
+	}
+
+	return cl.WriteMessage(&Message{Header: ProtoHello, Content: dat})
+}
+
+// Reads a hello, checking that it is fresh and that the entry is valid and
+// belongs to the key that sent it. Anything wrong is reported to the peer.
+func recieveHello(cl Client) (*hello, error) {
+	msg, err := cl.ReadMessage()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = msg.Expect(ProtoHello); err != nil {
+		return nil, err
+	}
+
+	ret := &hello{}
+	err = msg.Decode(&ret.msg)
+
+	if err == nil {
+		ret.entry, err = checkHello(&ret.msg)
+	}
+
+	if err != nil {
+		cl.WriteError(&ProtocolError{ErrorInvalid, err.Error()})
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func checkHello(mh *MessageHello) (*Entry, error) {
+	if len(mh.Nonce) != HandshakeNonceSize {
+		return nil, errors.New("Invalid handshake nonce")
+	}
+
+	skew := time.Since(time.Unix(mh.Time, 0))
+
+	if skew > MaxClockSkew || skew < -MaxClockSkew {
+		return nil, errors.New("Handshake time too far from our own")
+	}
+
+	entry, err := JsonToEntry(mh.Entry)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = entry.Verify()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func sendTranscriptSig(cl Client, sig []byte) error {
+	return cl.WriteMessage(&Message{Header: ProtoSig, Content: sig})
+}
+
+func recieveTranscriptSig(cl Client, from *Entry, role string, hash []byte) error {
+	msg, err := cl.ReadMessage()
+
+	if err != nil {
+		return err
+	}
+
+	if err = msg.Expect(ProtoSig); err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(from.PublicKey, append([]byte(role), hash...), msg.Content) {
+		cl.WriteError(NewProtocolError(ErrorInvalid, "Transcript signature not verified"))
+		return errors.New("Transcript signature not verified")
+	}
+
+	return nil
+}
+
+// Each side signs with its role prepended, so a signature cannot be reflected
+// back at the peer that made it.
+func role(initiator bool) string {
+	if initiator {
+		return "initiator"
+	}
+
+	return "responder"
+}
+
+// Hashes everything both sides have sent, what they agreed on and how.
+func transcript(agreement Agreement, init, resp *MessageHello) []byte {
+	hash := sha3.New256()
+
+	hash.Write(transcriptLabel)
+	binary.Write(hash, binary.LittleEndian, agreement.Version)
+
+	// Features are not in any particular order after negotiation.
+	features := make([]string, len(agreement.Features))
+	copy(features, agreement.Features)
+	sort.Strings(features)
+
+	for _, i := range features {
+		writeField(hash, []byte(i))
+	}
+
+	binary.Write(hash, binary.LittleEndian, uint32(len(agreement.negotiation)))
+
+	for _, i := range agreement.negotiation {
+		writeField(hash, i)
+	}
+
+	for _, i := range []*MessageHello{init, resp} {
+		writeField(hash, i.Entry)
+		writeField(hash, i.Nonce)
+		binary.Write(hash, binary.LittleEndian, i.Time)
+	}
+
+	return hash.Sum(nil)
+}
+
+// Length prefixed, so that fields cannot run into each other.
+func writeField(hash io.Writer, field []byte) {
+	binary.Write(hash, binary.LittleEndian, uint32(len(field)))
+	hash.Write(field)
+}
@@ -0,0 +1,167 @@
+package proto
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// A signed entry for signer, valid enough to handshake with.
+func testEntry(t *testing.T, signer testSigner) *Entry {
+	entry := &Entry{
+		Name:          "test",
+		PublicAddress: "127.0.0.1",
+		PublicKey:     signer.public,
+		Port:          5050,
+	}
+
+	entry.Address.Generate(signer.public)
+
+	dat, err := entry.Bytes()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	entry.Signature = signer.Sign(dat)
+
+	return entry
+}
+
+func TestTranscriptHandshake(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	agreement := Agreement{Version: ProtoVersion, Features: []string{FeatureTranscript}}
+	client, _ := newTestSigner(t)
+	server, _ := newTestSigner(t)
+
+	clientEntry := testEntry(t, client)
+	serverEntry := testEntry(t, server)
+
+	type result struct {
+		entry *Entry
+		err   error
+	}
+
+	ret := make(chan result)
+
+	go func() {
+		entry, err := handshake(&Client{conn: b, agreement: agreement}, server, serverEntry)
+		ret <- result{entry, err}
+	}()
+
+	entry, err := transcript_handshake(&Client{conn: a, agreement: agreement}, client, clientEntry, true)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !entry.Address.Equals(&serverEntry.Address) {
+		t.Error("Client handshaked with the wrong peer")
+	}
+
+	res := <-ret
+
+	if res.err != nil {
+		t.Fatal(res.err.Error())
+	}
+
+	if !res.entry.Address.Equals(&clientEntry.Address) {
+		t.Error("Server handshaked with the wrong peer")
+	}
+}
+
+func TestTranscriptBinding(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	entry, _ := testEntry(t, signer).Json()
+
+	init := &MessageHello{entry, make([]byte, HandshakeNonceSize), time.Now().Unix()}
+	resp := &MessageHello{entry, make([]byte, HandshakeNonceSize), time.Now().Unix()}
+	resp.Nonce[0] = 1
+
+	agreement := Agreement{Version: ProtoVersion, Features: []string{FeatureTranscript, FeatureGzip}}
+	hash := transcript(agreement, init, resp)
+
+	reordered := Agreement{Version: ProtoVersion, Features: []string{FeatureGzip, FeatureTranscript}}
+	if string(hash) != string(transcript(reordered, init, resp)) {
+		t.Error("Transcript depends on feature order")
+	}
+
+	// Anything that changes must change the transcript, otherwise a signature
+	// could be used for another connection.
+	other := *resp
+	other.Nonce = make([]byte, HandshakeNonceSize)
+
+	negotiated := agreement
+	negotiated.negotiation = [][]byte{[]byte("caps"), []byte("reply")}
+
+	stripped := negotiated
+	stripped.negotiation = [][]byte{[]byte("caps"), []byte("reply, changed")}
+
+	changed := [][]byte{
+		transcript(Agreement{Version: ProtoVersionJson, Features: agreement.Features}, init, resp),
+		transcript(Agreement{Version: ProtoVersion, Features: []string{FeatureTranscript}}, init, resp),
+		transcript(agreement, resp, init),
+		transcript(agreement, init, &other),
+		transcript(negotiated, init, resp),
+	}
+
+	for i, c := range changed {
+		if string(c) == string(hash) {
+			t.Errorf("Transcript %d not changed", i)
+		}
+	}
+
+	if string(transcript(negotiated, init, resp)) == string(transcript(stripped, init, resp)) {
+		t.Error("Transcript does not cover negotiation")
+	}
+}
+
+func TestCheckHello(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	entry, _ := testEntry(t, signer).Json()
+
+	valid := MessageHello{entry, make([]byte, HandshakeNonceSize), time.Now().Unix()}
+
+	if _, err := checkHello(&valid); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	stale := valid
+	stale.Time = time.Now().Add(-MaxClockSkew * 2).Unix()
+
+	if _, err := checkHello(&stale); err == nil {
+		t.Error("Stale hello accepted")
+	}
+
+	short := valid
+	short.Nonce = short.Nonce[:8]
+
+	if _, err := checkHello(&short); err == nil {
+		t.Error("Short nonce accepted")
+	}
+
+	other, _ := newTestSigner(t)
+	stolen := testEntry(t, signer)
+	stolen.PublicKey = other.public
+	stolen.Signature = other.Sign(mustBytes(t, stolen))
+
+	invalid := valid
+	invalid.Entry, _ = stolen.Json()
+
+	if _, err := checkHello(&invalid); err == nil {
+		t.Error("Entry with another peer's address accepted")
+	}
+}
+
+func mustBytes(t *testing.T, e *Entry) []byte {
+	dat, err := e.Bytes()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return dat
+}
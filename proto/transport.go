@@ -0,0 +1,119 @@
+package proto
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// How connections are made and accepted. Normally this is TCP, but anything
+// that provides a net.Conn will do, such as the in memory network used to test
+// many peers in one process.
+type Transport interface {
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+type TCPTransport struct{}
+
+func (TCPTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// A network that exists only in memory, connections are made with net.Pipe. A
+// listener is reachable at exactly the address it was given.
+type MemoryNetwork struct {
+	lock      sync.Mutex
+	listeners map[string]*memoryListener
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{listeners: make(map[string]*memoryListener)}
+}
+
+func (mn *MemoryNetwork) Dial(addr string) (net.Conn, error) {
+	mn.lock.Lock()
+	listener, ok := mn.listeners[addr]
+	mn.lock.Unlock()
+
+	if !ok {
+		return nil, errors.New("Connection refused: " + addr)
+	}
+
+	client, server := net.Pipe()
+
+	select {
+	case listener.accept <- server:
+		return client, nil
+	case <-listener.closed:
+		return nil, errors.New("Connection refused: " + addr)
+	}
+}
+
+func (mn *MemoryNetwork) Listen(addr string) (net.Listener, error) {
+	mn.lock.Lock()
+	defer mn.lock.Unlock()
+
+	if _, ok := mn.listeners[addr]; ok {
+		return nil, errors.New("Address already in use: " + addr)
+	}
+
+	listener := &memoryListener{
+		network: mn,
+		addr:    memoryAddr(addr),
+		accept:  make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+
+	mn.listeners[addr] = listener
+
+	return listener, nil
+}
+
+type memoryAddr string
+
+func (ma memoryAddr) Network() string {
+	return "memory"
+}
+
+func (ma memoryAddr) String() string {
+	return string(ma)
+}
+
+type memoryListener struct {
+	network *MemoryNetwork
+	addr    memoryAddr
+
+	accept    chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (ml *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ml.accept:
+		return conn, nil
+	case <-ml.closed:
+		return nil, errors.New("Listener closed")
+	}
+}
+
+func (ml *memoryListener) Close() error {
+	ml.closeOnce.Do(func() {
+		close(ml.closed)
+
+		ml.network.lock.Lock()
+		delete(ml.network.listeners, string(ml.addr))
+		ml.network.lock.Unlock()
+	})
+
+	return nil
+}
+
+func (ml *memoryListener) Addr() net.Addr {
+	return ml.addr
+}
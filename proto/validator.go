@@ -0,0 +1,190 @@
+// Entries are checked before they go into the DHT. They must be signed by the
+// key their address was made from, fit within limits, have enough proof of
+// work, and can only replace an entry already held if they are at least as
+// new.
+
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zif/zif/dht"
+)
+
+type EntryValidator struct {
+	// The lowest proof of work difficulty accepted.
+	MinDifficulty int
+}
+
+func (ev EntryValidator) Validate(kv *dht.KeyValue, old []byte) error {
+	entry, err := VerifyPair(kv)
+
+	if err != nil {
+		return err
+	}
+
+	if err = entry.CheckWork(ev.MinDifficulty); err != nil {
+		return err
+	}
+
+	if old == nil {
+		return nil
+	}
+
+	prev, err := JsonToEntry(old)
+
+	// Whatever we had is no good, so anything valid may replace it.
+	if err != nil {
+		return nil
+	}
+
+	if entry.Seq < prev.Seq {
+		return &StaleEntry{entry.Seq, prev.Seq}
+	}
+
+	return nil
+}
+
+// An entry older than the one already held. Peers can send these without
+// doing anything wrong, if they have not yet seen the newer entry.
+type StaleEntry struct {
+	Seq  int64
+	Have int64
+}
+
+func (se *StaleEntry) Error() string {
+	return fmt.Sprintf("Stale entry, sequence %d but have %d", se.Seq, se.Have)
+}
+
+// An entry with less proof of work than we require. Not the fault of whoever
+// sent it, as peers may require different amounts.
+type InsufficientWork struct {
+	Difficulty int
+	Min        int
+}
+
+func (iw *InsufficientWork) Error() string {
+	return fmt.Sprintf("Insufficient work, difficulty %d but need %d", iw.Difficulty, iw.Min)
+}
+
+// Returned when a peer sends entries that fail to validate.
+type InvalidEntries struct {
+	Count  int
+	Reason error
+}
+
+func (ie *InvalidEntries) Error() string {
+	return fmt.Sprintf("%d invalid entries, last: %s", ie.Count, ie.Reason.Error())
+}
+
+// Whether err means the DHT turned an entry away as invalid, rather than just
+// older than one it already has or short of work. Only the former is the
+// sender's fault.
+func IsInvalidEntry(err error) bool {
+	rejected, ok := err.(*dht.Rejected)
+
+	if !ok {
+		return false
+	}
+
+	switch rejected.Reason.(type) {
+	case *StaleEntry, *InsufficientWork:
+		return false
+	}
+
+	return true
+}
+
+// Groups entries by where their peer really is, so that the DHT can limit how
+// many come from one subnet. A public address is only a claim, and one operator
+// could give each of its nodes a different name, so the IP a peer was seen at
+// is used first, then the IP its public address resolves to. Anything else is
+// grouped by hostname, which the DHT limits separately.
+type EntryGrouper struct {
+	// The IP the peer with an address was seen connecting from, nil if it has
+	// not been seen.
+	Observed func(addr dht.Address) net.IP
+
+	// Looks up the IP of a hostname, nil if it cannot be. Names are not
+	// resolved if this is nil. Groups are found with the DHT locked, so this
+	// must answer from what it already knows rather than wait on DNS.
+	Resolve func(host string) net.IP
+}
+
+func (eg EntryGrouper) Group(kv *dht.KeyValue) string {
+	entry, err := JsonToEntry(kv.Value())
+
+	if err != nil {
+		return ""
+	}
+
+	if eg.Observed != nil {
+		if ip := eg.Observed(entry.Address); ip != nil {
+			return dht.AddressGroup(ip.String())
+		}
+	}
+
+	if net.ParseIP(entry.PublicAddress) == nil && eg.Resolve != nil {
+		if ip := eg.Resolve(entry.PublicAddress); ip != nil {
+			return dht.AddressGroup(ip.String())
+		}
+	}
+
+	return dht.AddressGroup(entry.PublicAddress)
+}
+
+// Of the entries in pairs that verify, the one signed most recently. Used to
+// choose between what different lookup paths found, so that one path fed a
+// forged or stale entry cannot win out.
+func Freshest(pairs dht.Pairs) (*Entry, error) {
+	var best *Entry
+	var last error
+
+	invalid, stale := 0, 0
+
+	for _, i := range pairs {
+		entry, err := VerifyPair(i)
+
+		if err != nil {
+			invalid++
+			last = err
+			continue
+		}
+
+		switch {
+		case best == nil:
+			best = entry
+
+		case entry.Seq > best.Seq:
+			stale++
+			best = entry
+
+		case entry.Seq < best.Seq:
+			stale++
+		}
+	}
+
+	if best == nil {
+		if last == nil {
+			last = errors.New("No entries to choose from")
+		}
+
+		return nil, last
+	}
+
+	if invalid > 0 || stale > 0 {
+		s, _ := best.Address.String()
+
+		log.WithFields(log.Fields{
+			"address": s,
+			"paths":   len(pairs),
+			"invalid": invalid,
+			"stale":   stale,
+		}).Warn("Lookup paths disagreed")
+	}
+
+	return best, nil
+}
@@ -0,0 +1,256 @@
+package proto
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/zif/zif/dht"
+)
+
+func signedPair(t *testing.T, signer testSigner, entry *Entry) *dht.KeyValue {
+	data, _ := entry.Bytes()
+	entry.Signature = signer.Sign(data)
+
+	dat, err := entry.Json()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return dht.NewKeyValue(entry.Address, dat)
+}
+
+func TestEntryValidator(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	entry := testEntry(t, signer)
+	v := EntryValidator{}
+
+	entry.Seq = 5
+	current := signedPair(t, signer, entry)
+
+	if err := v.Validate(current, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The same entry again is fine, an older one is not.
+	if err := v.Validate(current, current.Value()); err != nil {
+		t.Error(err.Error())
+	}
+
+	entry.Seq = 4
+	older := signedPair(t, signer, entry)
+
+	if _, ok := v.Validate(older, current.Value()).(*StaleEntry); !ok {
+		t.Error("Older entry replaced a newer one")
+	}
+
+	entry.Seq = 6
+	newer := signedPair(t, signer, entry)
+
+	if err := v.Validate(newer, current.Value()); err != nil {
+		t.Error(err.Error())
+	}
+
+	// Signed with our own key, but claiming someone else's address.
+	other, _ := newTestSigner(t)
+	forged := testEntry(t, other)
+	forged.PublicKey = signer.public
+	forged.Seq = 7
+
+	if v.Validate(signedPair(t, signer, forged), current.Value()) == nil {
+		t.Error("Entry for another address accepted")
+	}
+}
+
+func TestEntryLimits(t *testing.T) {
+	signer, _ := newTestSigner(t)
+
+	for _, modify := range []func(*Entry){
+		func(e *Entry) { e.Name = string(make([]byte, MaxNameLength+1)) },
+		func(e *Entry) { e.Desc = string(make([]byte, MaxDescLength+1)) },
+		func(e *Entry) { e.Port = -1 },
+		func(e *Entry) { e.Seq = -1 },
+		func(e *Entry) { e.Seeds = make([][]byte, MaxSeeds+1) },
+		func(e *Entry) { e.Seeds = [][]byte{{1, 2, 3}} },
+		func(e *Entry) { e.Difficulty = dht.MaxDifficulty + 1 },
+	} {
+		entry := testEntry(t, signer)
+		modify(entry)
+
+		if _, err := VerifyPair(signedPair(t, signer, entry)); err == nil {
+			t.Errorf("Entry outside limits accepted: %+v", entry)
+		}
+	}
+}
+
+// Moving digits from one number to the next must not leave the signature
+// valid, otherwise a peer could raise the Seq of someone else's entry.
+func TestEntryShifted(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	entry := testEntry(t, signer)
+
+	entry.PostCount = 12
+	entry.Seq = 3
+	signedPair(t, signer, entry)
+
+	entry.PostCount = 1
+	entry.Seq = 23
+
+	if entry.Verify() == nil {
+		t.Error("Entry with shifted fields verified")
+	}
+
+	entry = testEntry(t, signer)
+	entry.Name = "te"
+	entry.Desc = "st"
+	signedPair(t, signer, entry)
+
+	entry.Name = "test"
+	entry.Desc = ""
+
+	if entry.Verify() == nil {
+		t.Error("Entry with shifted fields verified")
+	}
+
+	// Nor may a digit of the difficulty be moved into the nonce, claiming
+	// less work to get the same signature.
+	nonce, err := dht.Grind(context.Background(), signer.public, 10, nil)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	entry = testEntry(t, signer)
+	entry.Nonce = nonce
+	entry.Difficulty = 10
+	signedPair(t, signer, entry)
+
+	entry.Nonce = nonce*10 + 1
+	entry.Difficulty = 0
+
+	if entry.Verify() == nil {
+		t.Error("Entry with shifted work verified")
+	}
+}
+
+func TestEntryWork(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	entry := testEntry(t, signer)
+	v := EntryValidator{MinDifficulty: 8}
+
+	if _, ok := v.Validate(signedPair(t, signer, entry), nil).(*InsufficientWork); !ok {
+		t.Error("Entry without work accepted")
+	}
+
+	nonce, err := dht.Grind(context.Background(), signer.public, 8, nil)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Claiming work without doing it.
+	entry.Difficulty = 8
+
+	if dht.Work(signer.public, entry.Nonce) < 8 && v.Validate(signedPair(t, signer, entry), nil) == nil {
+		t.Error("Entry without the work it claims accepted")
+	}
+
+	entry.Nonce = nonce
+
+	if err := v.Validate(signedPair(t, signer, entry), nil); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestIsInvalidEntry(t *testing.T) {
+	if IsInvalidEntry(&dht.Rejected{Reason: &StaleEntry{1, 2}}) {
+		t.Error("Stale entry treated as invalid")
+	}
+
+	if IsInvalidEntry(&dht.Rejected{Reason: &InsufficientWork{0, 8}}) {
+		t.Error("Entry short of work treated as invalid")
+	}
+
+	if !IsInvalidEntry(&dht.Rejected{Reason: &InvalidEntries{1, nil}}) {
+		t.Error("Rejected entry not treated as invalid")
+	}
+}
+
+func TestEntryGrouper(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	entry := testEntry(t, signer)
+	groups := make([]string, 0)
+
+	for _, i := range []string{"10.0.0.1", "10.0.0.2", "10.0.1.1"} {
+		entry.PublicAddress = i
+		groups = append(groups, EntryGrouper{}.Group(signedPair(t, signer, entry)))
+	}
+
+	if groups[0] == "" || groups[0] != groups[1] || groups[0] == groups[2] {
+		t.Errorf("Entries grouped as %v", groups)
+	}
+
+	// Names that resolve to one subnet are grouped together, and where the
+	// peer was seen wins over anything it claims.
+	eg := EntryGrouper{
+		Resolve: func(host string) net.IP {
+			return net.ParseIP("10.0.0." + strconv.Itoa(len(host)))
+		},
+	}
+
+	entry.PublicAddress = "a.example.com"
+	a := eg.Group(signedPair(t, signer, entry))
+
+	entry.PublicAddress = "bb.example.com"
+	b := eg.Group(signedPair(t, signer, entry))
+
+	if a != groups[0] || b != groups[0] {
+		t.Errorf("Resolved names grouped as %s and %s", a, b)
+	}
+
+	eg.Observed = func(addr dht.Address) net.IP {
+		return net.ParseIP("10.0.1.1")
+	}
+
+	if g := eg.Group(signedPair(t, signer, entry)); g != groups[2] {
+		t.Errorf("Observed entry grouped as %s", g)
+	}
+}
+
+func TestFreshest(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	entry := testEntry(t, signer)
+	pairs := make(dht.Pairs, 0)
+
+	for _, seq := range []int64{5, 7, 6} {
+		entry.Seq = seq
+		pairs = append(pairs, signedPair(t, signer, entry))
+	}
+
+	// The newest of all, but forged.
+	entry.Seq = 8
+	forged := signedPair(t, signer, entry)
+	entry.Name = "forged"
+	dat, _ := entry.Json()
+	pairs = append(pairs, dht.NewKeyValue(*forged.Key(), dat))
+
+	best, err := Freshest(pairs)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if best.Seq != 7 {
+		t.Errorf("Chose sequence %d, expected 7", best.Seq)
+	}
+
+	if _, err := Freshest(pairs[3:]); err == nil {
+		t.Error("Chose a forged entry")
+	}
+
+	if _, err := Freshest(nil); err == nil {
+		t.Error("Chose from nothing")
+	}
+}
@@ -0,0 +1,319 @@
+// Publishing and finding provider records. We provide every infohash we have a
+// post for, so that someone holding a magnet link can find every peer that
+// describes it, and the most common terms in our titles so that we can be
+// found by a network search.
+
+package libzif
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zif/zif/data"
+	"github.com/zif/zif/dht"
+	"github.com/zif/zif/proto"
+)
+
+// How often records for all of our posts are published again, well within
+// dht.ProviderTTL.
+const ProviderRepublishInterval = time.Hour * 12
+
+// Terms are what a network search finds us by, and there are only a few of
+// them, so they are published again more often than posts.
+const TermRepublishInterval = time.Hour
+
+// How many new posts can wait to be provided. Any more are left until records
+// are next republished.
+const ProvideQueueSize = 256
+
+// How many keys ProvideAll publishes at once, and how long it has to publish
+// all of them. Anything left over is published next time round.
+const (
+	ProvideConcurrency = 8
+	ProvideAllTimeout  = time.Hour * 6
+)
+
+// Publishes a record saying we provide key to the closest peers to it that
+// answer. The record is kept locally too.
+func (lp *LocalPeer) Provide(ctx context.Context, key dht.Address) error {
+	pr := proto.NewProviderRecord(key, lp)
+	dat, err := pr.Json()
+
+	if err != nil {
+		return err
+	}
+
+	err = lp.DHT.AddProvider(key, &dht.Provider{Provider: pr.Provider, Value: dat, Expires: pr.Expires()})
+
+	if err != nil {
+		return err
+	}
+
+	closest, err := lp.DHT.FindNodes(ctx, lp, key)
+
+	if err != nil {
+		return err
+	}
+
+	if len(closest) == 0 {
+		return errors.New("No peers to publish to")
+	}
+
+	stored := 0
+
+	for _, i := range closest {
+		peer, err := lp.connectPair(i)
+
+		if err != nil {
+			continue
+		}
+
+		if err = peer.AddProviderContext(ctx, pr); err != nil {
+			s, _ := i.Key().String()
+			log.WithFields(log.Fields{"peer": s, "reason": err.Error()}).Debug("Failed to add provider")
+			continue
+		}
+
+		stored++
+	}
+
+	if stored == 0 {
+		return errors.New("Provider record not stored with any peer")
+	}
+
+	return nil
+}
+
+// Provides the most common terms in our titles, then every infohash we have a
+// post for. Failures are only logged, the records are published again next
+// time round.
+func (lp *LocalPeer) ProvideAll(ctx context.Context) error {
+	lp.ProvideTerms(ctx)
+
+	return lp.ProvidePosts(ctx)
+}
+
+// Provides the most common terms in our titles. Until this is next called,
+// new posts only provide terms that are not among them.
+func (lp *LocalPeer) ProvideTerms(ctx context.Context) error {
+	terms := data.NewTermCounter()
+
+	for post := range lp.Database.QueryPiecePosts(0, lp.pieceCount(), false) {
+		terms.Add(post.Title)
+	}
+
+	top := terms.Top(data.MaxTerms)
+
+	lp.termsLock.Lock()
+	lp.terms = make(map[string]bool)
+
+	for _, i := range top {
+		lp.terms[i] = true
+	}
+
+	lp.termsLock.Unlock()
+
+	lp.provideEach(ctx, "term", top, proto.TermKey)
+
+	return ctx.Err()
+}
+
+// Provides every infohash we have a post for.
+func (lp *LocalPeer) ProvidePosts(ctx context.Context) error {
+	infohashes := make([]string, 0, lp.Database.PostCount())
+
+	// Read everything first, rather than hold the database open while
+	// publishing.
+	for post := range lp.Database.QueryPiecePosts(0, lp.pieceCount(), false) {
+		infohashes = append(infohashes, post.InfoHash)
+	}
+
+	provided := lp.provideEach(ctx, "infohash", infohashes, proto.ProviderKey)
+
+	log.WithFields(log.Fields{"provided": provided, "posts": len(infohashes)}).Info("Provided posts")
+
+	return ctx.Err()
+}
+
+// How many pieces our posts fill, the last only partly.
+func (lp *LocalPeer) pieceCount() int {
+	return (int(lp.Database.PostCount()) + data.PieceSize - 1) / data.PieceSize
+}
+
+// Provides the key for each of names, ProvideConcurrency at a time, returning
+// how many were provided. Stops early if ctx is done.
+func (lp *LocalPeer) provideEach(ctx context.Context, what string, names []string, key func(string) dht.Address) int {
+	queue := make(chan string)
+	provided := int64(0)
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < ProvideConcurrency; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range queue {
+				pctx, cancel := context.WithTimeout(ctx, PublishTimeout)
+
+				if lp.provide(pctx, key(i), what, i) {
+					atomic.AddInt64(&provided, 1)
+				}
+
+				cancel()
+			}
+		}()
+	}
+
+send:
+	for _, i := range names {
+		select {
+		case queue <- i:
+		case <-ctx.Done():
+			break send
+		}
+	}
+
+	close(queue)
+	wg.Wait()
+
+	return int(provided)
+}
+
+// Provides key, logging why if it fails. what and name say what key is for.
+func (lp *LocalPeer) provide(ctx context.Context, key dht.Address, what, name string) bool {
+	err := lp.Provide(ctx, key)
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			what:     name,
+			"reason": err.Error(),
+		}).Debug("Failed to provide")
+	}
+
+	return err == nil
+}
+
+// Provides posts as they are added, and any terms in their titles not
+// already provided, until ctx is done.
+func (lp *LocalPeer) provideNew(ctx context.Context) {
+	for {
+		select {
+		case post := <-lp.newPosts:
+			pctx, cancel := context.WithTimeout(ctx, PublishTimeout)
+			lp.provide(pctx, proto.ProviderKey(post.InfoHash), "infohash", post.InfoHash)
+			cancel()
+
+			for _, i := range data.Terms(post.Title) {
+				if !lp.newTerm(i) {
+					continue
+				}
+
+				pctx, cancel := context.WithTimeout(ctx, PublishTimeout)
+				lp.provide(pctx, proto.TermKey(i), "term", i)
+				cancel()
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Whether term has not been provided since terms were last republished, in
+// which case it is marked as provided.
+func (lp *LocalPeer) newTerm(term string) bool {
+	lp.termsLock.Lock()
+	defer lp.termsLock.Unlock()
+
+	if lp.terms[term] {
+		return false
+	}
+
+	if lp.terms == nil {
+		lp.terms = make(map[string]bool)
+	}
+
+	lp.terms[term] = true
+
+	return true
+}
+
+// Finds the peers that provide key, asking the closest peers to it. Our own
+// records are included.
+func (lp *LocalPeer) FindProviders(ctx context.Context, key dht.Address) ([]*proto.ProviderRecord, error) {
+	pl := &providerLookup{lp: lp, found: make(map[string]*proto.ProviderRecord)}
+
+	for _, i := range lp.DHT.Providers(key) {
+		pr := &proto.ProviderRecord{}
+
+		if json.Unmarshal(i.Value, pr) == nil {
+			pl.add([]*proto.ProviderRecord{pr})
+		}
+	}
+
+	_, err := lp.DHT.FindNodes(ctx, pl, key)
+
+	return pl.records(), err
+}
+
+// A DHT network that asks each node for providers rather than values, and
+// collects every provider it is told of on the way.
+type providerLookup struct {
+	lp *LocalPeer
+
+	lock  sync.Mutex
+	found map[string]*proto.ProviderRecord
+}
+
+func (pl *providerLookup) FindValue(ctx context.Context, node *dht.KeyValue, target dht.Address) (*dht.KeyValue, dht.Pairs, error) {
+	peer, err := pl.lp.connectPair(node)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, closest, err := peer.GetProvidersContext(ctx, target)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pl.add(records)
+
+	return nil, closest, nil
+}
+
+// Keeps the newest record from each provider.
+func (pl *providerLookup) add(records []*proto.ProviderRecord) {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+
+	for _, i := range records {
+		s, _ := i.Provider.String()
+
+		if have, ok := pl.found[s]; !ok || i.Time > have.Time {
+			pl.found[s] = i
+		}
+	}
+}
+
+func (pl *providerLookup) records() []*proto.ProviderRecord {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+
+	ret := make([]*proto.ProviderRecord, 0, len(pl.found))
+
+	for _, i := range pl.found {
+		ret = append(ret, i)
+	}
+
+	return ret
+}
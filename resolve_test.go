@@ -0,0 +1,37 @@
+package libzif
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResolveInBackground(t *testing.T) {
+	lp := &LocalPeer{
+		hosts:     make(map[string]net.IP),
+		resolving: make(map[string]bool),
+	}
+
+	// Nothing is known yet, and the answer is not waited for.
+	if ip := lp.resolve("localhost"); ip != nil {
+		t.Fatal("Resolved before looking up")
+	}
+
+	deadline := time.Now().Add(HostLookupTimeout * 2)
+
+	for {
+		if ip := lp.resolve("localhost"); ip != nil {
+			if !ip.IsLoopback() {
+				t.Errorf("localhost resolved to %s", ip)
+			}
+
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("localhost was never resolved")
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
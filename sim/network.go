@@ -0,0 +1,236 @@
+// A simulated Zif network. Any number of LocalPeers run in one process,
+// talking to each other over an in memory transport. Each has its own data
+// directory, so nothing touches ./data and no ports are needed. Used to test
+// how peers behave together.
+
+package sim
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	zif "github.com/zif/zif"
+	"github.com/zif/zif/data"
+	"github.com/zif/zif/proto"
+)
+
+// Every simulated peer listens on this port, their addresses differ by name.
+const Port = 5050
+
+// Requests are local, so peers should not need long to finish them.
+const DrainTimeout = time.Second
+
+type Network struct {
+	Peers     []*zif.LocalPeer
+	Transport *proto.MemoryNetwork
+
+	dir string
+}
+
+// Starts n peers, each listening on the network. They do not know about each
+// other until Bootstrap is called.
+func NewNetwork(n int) (*Network, error) {
+	dir, err := ioutil.TempDir("", "zif-sim")
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Network{
+		Peers:     make([]*zif.LocalPeer, 0, n),
+		Transport: proto.NewMemoryNetwork(),
+		dir:       dir,
+	}
+
+	for i := 0; i < n; i++ {
+		lp, err := ret.start(fmt.Sprintf("peer%d", i))
+
+		if err != nil {
+			ret.Close()
+			return nil, err
+		}
+
+		ret.Peers = append(ret.Peers, lp)
+	}
+
+	return ret, nil
+}
+
+func (n *Network) start(name string) (*zif.LocalPeer, error) {
+	lp := &zif.LocalPeer{
+		DataDir:      filepath.Join(n.dir, name),
+		Transport:    n.Transport,
+		DrainTimeout: DrainTimeout,
+	}
+
+	lp.GenerateKey()
+	lp.Setup()
+
+	lp.Entry.Name = name
+	lp.Entry.Desc = "Simulated peer"
+	lp.Entry.PublicAddress = name
+	lp.Entry.Port = Port
+	lp.Entry.SetLocalPeer(lp)
+
+	lp.Database = data.NewDatabase(filepath.Join(lp.DataDir, "posts.db"))
+	err := lp.Database.Connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = lp.MigrateCollection()
+
+	if err != nil {
+		lp.Database.Close()
+		return nil, err
+	}
+
+	err = lp.Listen(fmt.Sprintf("%s:%d", name, Port))
+
+	if err != nil {
+		lp.Database.Close()
+		return nil, err
+	}
+
+	return lp, nil
+}
+
+// The Zif address of a peer.
+func (n *Network) Address(i int) string {
+	s, _ := n.Peers[i].Address().String()
+	return s
+}
+
+// The address a peer listens on.
+func (n *Network) PublicAddress(i int) string {
+	return fmt.Sprintf("%s:%d", n.Peers[i].Entry.PublicAddress, n.Peers[i].Entry.Port)
+}
+
+// Every peer announces itself to the first, and then bootstraps from it. After
+// this each peer is able to resolve every other.
+func (n *Network) Bootstrap() error {
+	if len(n.Peers) < 2 {
+		return nil
+	}
+
+	for i := 1; i < len(n.Peers); i++ {
+		if err := n.Announce(i, 0); err != nil {
+			return err
+		}
+	}
+
+	for i := 1; i < len(n.Peers); i++ {
+		peer, err := n.Peers[i].ConnectPeerDirect(n.PublicAddress(0))
+
+		if err != nil {
+			return err
+		}
+
+		stream, err := peer.Bootstrap(n.Peers[i].DHT)
+
+		if stream != nil {
+			stream.Close()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Connects directly to a peer, without needing to resolve it.
+func (n *Network) Connect(from, to int) (*zif.Peer, error) {
+	return n.Peers[from].ConnectPeerDirect(n.PublicAddress(to))
+}
+
+// Announces one peer to another.
+func (n *Network) Announce(from, to int) error {
+	peer, err := n.Connect(from, to)
+
+	if err != nil {
+		return err
+	}
+
+	return peer.Announce(n.Peers[from])
+}
+
+// Adds a post to a peer, and indexes it so that it can be searched for.
+func (n *Network) AddPost(i int, post data.Post) error {
+	id, err := n.Peers[i].AddPost(post, false)
+
+	if err != nil {
+		return err
+	}
+
+	return n.Peers[i].Database.GenerateFts(id - 1)
+}
+
+// Adds many posts to a peer at once, far quicker than AddPost as the collection
+// is only rebuilt at the end.
+func (n *Network) AddPosts(i int, posts []data.Post) error {
+	lp := n.Peers[i]
+
+	for _, post := range posts {
+		if _, err := lp.Database.InsertPost(post); err != nil {
+			return err
+		}
+	}
+
+	col, err := data.CreateCollection(lp.Database, 0, data.PieceSize)
+
+	if err != nil {
+		return err
+	}
+
+	lp.Collection = col
+	lp.UpdateEntry(func(e *proto.Entry) {
+		e.PostCount = int(lp.Database.PostCount())
+	})
+
+	return nil
+}
+
+// Searches the posts of one peer from another.
+func (n *Network) Search(from, to int, query string) ([]*data.Post, error) {
+	peer, err := n.Peers[from].ConnectPeer(n.Address(to))
+
+	if err != nil {
+		return nil, err
+	}
+
+	res, stream, err := peer.Search(query, 0)
+
+	if stream != nil {
+		stream.Close()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Posts, nil
+}
+
+// Mirrors the posts of one peer onto another, exactly as the API would.
+func (n *Network) Mirror(from, to int) error {
+	cs := zif.NewCommandServer(n.Peers[from])
+	res := cs.Mirror(context.Background(), zif.CommandMirror{Address: n.Address(to)})
+
+	return res.Error
+}
+
+// Stops every peer, and removes their data.
+func (n *Network) Close() {
+	for _, lp := range n.Peers {
+		lp.Close()
+	}
+
+	os.RemoveAll(n.dir)
+}
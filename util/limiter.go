@@ -1,10 +1,15 @@
 package util
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 type Limiter struct {
 	Throttle chan time.Time
 	Ticker   *time.Ticker
+
+	done chan struct{}
 }
 
 // Return a new rate limiter. This is used to make sure that something like a
@@ -23,16 +28,26 @@ func NewLimiter(rate time.Duration, burst int, fill bool) *Limiter {
 		}
 	}
 
+	done := make(chan struct{})
+
+	// Only this sends on throttle, so it is the one to close it.
 	go func() {
-		for t := range tick.C {
+		for {
 			select {
-			case throttle <- t:
-			default:
+			case t := <-tick.C:
+				select {
+				case throttle <- t:
+				default:
+				}
+
+			case <-done:
+				close(throttle)
+				return
 			}
 		}
 	}()
 
-	return &Limiter{throttle, tick}
+	return &Limiter{throttle, tick, done}
 }
 
 // Block until the given time has elapsed. Or just use a token from the bucket.
@@ -43,7 +58,7 @@ func (l *Limiter) Wait() {
 // Finish running.
 func (l *Limiter) Stop() {
 	l.Ticker.Stop()
-	close(l.Throttle)
+	close(l.done)
 }
 
 // Limits requests from peers
@@ -59,3 +74,59 @@ func (pl *PeerLimiter) Setup() {
 
 	pl.queryLimiter = NewLimiter(time.Second/3, 3, true)
 }
+
+// A token bucket that never blocks, for when anything over the limit should be
+// refused rather than made to wait. Refills a token every rate, holding at most
+// burst.
+type Bucket struct {
+	lock   sync.Mutex
+	rate   time.Duration
+	burst  int
+	tokens int
+	last   time.Time
+}
+
+func NewBucket(rate time.Duration, burst int) *Bucket {
+	return &Bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *Bucket) refill() {
+	refilled := int(time.Since(b.last) / b.rate)
+
+	if refilled > 0 {
+		b.tokens += refilled
+		b.last = b.last.Add(time.Duration(refilled) * b.rate)
+	}
+
+	if b.tokens >= b.burst {
+		b.tokens = b.burst
+		b.last = time.Now()
+	}
+}
+
+// Takes a token if there is one.
+func (b *Bucket) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+
+	if b.tokens == 0 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// Whether the bucket has refilled completely, meaning it has not been used in
+// a while.
+func (b *Bucket) Full() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+
+	return b.tokens == b.burst
+}